@@ -2,9 +2,12 @@ package alertcenter
 
 import (
 	"errors"
+	"net/http"
 	"sync"
 	"time"
 
+	"github.com/qiniu/http/httputil.v1"
+	"github.com/qiniu/log.v1"
 	"github.com/qiniu/xlog.v1"
 )
 
@@ -15,11 +18,17 @@ const (
 	DefaultBackupfile         = "run/active.data"
 )
 
+var (
+	ErrAlertNotFound = httputil.NewError(http.StatusNotFound, "alert not found")
+)
+
 type AlertActiveCfg struct {
 	EmergenctIntervalS int    `json:"emergency_interval_s"`
 	ResendIntervalS    int    `json:"resend_interval_s"`
 	BackupFile         string `json:"backup_file"`
 	BackupIntervalMS   int    `json:"backup_interval_ms"`
+
+	EscalationPolicies []EscalationPolicy `json:"escalation_policies"`
 }
 
 func (cfg *AlertActiveCfg) Check() {
@@ -35,6 +44,9 @@ func (cfg *AlertActiveCfg) Check() {
 	if cfg.BackupFile == "" {
 		cfg.BackupFile = DefaultBackupfile
 	}
+	for i := range cfg.EscalationPolicies {
+		cfg.EscalationPolicies[i].Check()
+	}
 }
 
 type AlertActive struct {
@@ -44,17 +56,27 @@ type AlertActive struct {
 	Tick      *time.Ticker  `json:"-"`
 	StopTickC chan struct{} `json:"-"`
 	ReqId     string        `json:"-"`
+	stopped   bool
+
+	// 下一个要执行的升级步骤
+	EscalationStep int `json:"escalationStep"`
 }
 
 func NewAlertActive(alert *Alert, xl *xlog.Logger) *AlertActive {
 	return &AlertActive{
-		Alert: alert,
-		xl:    xl,
-		ReqId: xl.ReqId(),
+		Alert:     alert,
+		xl:        xl,
+		ReqId:     xl.ReqId(),
+		StopTickC: make(chan struct{}),
 	}
 }
 
+// 在 aam.mutex 内调用，ack 之后恢复、重复 ack 时会调用多次
 func (aa *AlertActive) StopTick() {
+	if aa.stopped {
+		return
+	}
+	aa.stopped = true
 	close(aa.StopTickC)
 }
 
@@ -74,25 +96,41 @@ type AlertActiveMgr struct {
 	mutex      sync.Mutex
 	data       map[string]*AlertActive
 	f          func(msg Message)
+	ackF       func(xl *xlog.Logger, a *Alert, ack Ack)
 	historyMgr *HistoryMgr
+	events     *EventMgr
+	policies   map[string]EscalationPolicy
 }
 
-func NewAlertActiveMgr(f func(msg Message), cfg AlertActiveCfg, historyMgr *HistoryMgr) (aam *AlertActiveMgr) {
+func NewAlertActiveMgr(f func(msg Message), cfg AlertActiveCfg, historyMgr *HistoryMgr, events *EventMgr) (aam *AlertActiveMgr) {
 	xl := xlog.NewDummy()
 	cfg.Check()
 	data := make(map[string]*AlertActive)
+	policies := make(map[string]EscalationPolicy)
+	for _, p := range cfg.EscalationPolicies {
+		if _, ok := policies[p.Name]; ok {
+			log.Panic("duplicated escalation policy:", p.Name)
+		}
+		policies[p.Name] = p
+	}
 
 	aam = &AlertActiveMgr{
 		AlertActiveCfg: &cfg,
 		data:           data,
 		f:              f,
 		historyMgr:     historyMgr,
+		events:         events,
+		policies:       policies,
 	}
 	load(xl, &data, cfg.BackupFile)
 
 	// DoEmergenct
 	for _, v := range data {
 		v.xl = xlog.NewWith(v.ReqId)
+		v.StopTickC = make(chan struct{})
+		if v.Status == AlertAcked {
+			continue
+		}
 		go aam.DoEmergenct(v)
 	}
 
@@ -100,11 +138,12 @@ func NewAlertActiveMgr(f func(msg Message), cfg AlertActiveCfg, historyMgr *Hist
 	return
 }
 
+// 调用方保证 aa 没有被 ack 过，之后的 ack 通过 StopTickC 停止
 func (aam *AlertActiveMgr) DoEmergenct(aa *AlertActive) {
-	if aa.Status == AlertAcked {
+	if p, ok := aam.escalationPolicy(aa.Alertname); ok {
+		aam.doEscalation(aa, p)
 		return
 	}
-	aa.StopTickC = make(chan struct{})
 	if d := aa.EmergentLeft(aam.EmergenctIntervalS); d > 0 {
 		select {
 		case <-aa.StopTickC:
@@ -114,8 +153,15 @@ func (aam *AlertActiveMgr) DoEmergenct(aa *AlertActive) {
 	}
 
 	// begin resend
+	aam.mutex.Lock()
 	aa.IsEmergent = true
-	aam.f(NewMessage(aa.xl, aa.Alert)) // oncall
+	aam.mutex.Unlock()
+	msg := NewMessage(aa.xl, aa.Alert)
+	msg.Resend = true
+	aam.f(msg) // oncall
+	ev := NewEvent(EventEscalated, aa.Alert)
+	ev.Detail = "emergent"
+	aam.events.Record(aa.xl, ev)
 
 	aa.Tick = time.NewTicker(time.Duration(aam.ResendIntervalS) * time.Second)
 	for {
@@ -126,7 +172,9 @@ func (aam *AlertActiveMgr) DoEmergenct(aa *AlertActive) {
 			aa.Tick.Stop()
 			return
 		case <-aa.Tick.C:
-			aam.f(NewMessage(aa.xl, aa.Alert))
+			msg := NewMessage(aa.xl, aa.Alert)
+			msg.Resend = true
+			aam.f(msg)
 		}
 	}
 }
@@ -147,11 +195,76 @@ func (aam *AlertActiveMgr) Get(key string) (aa *AlertActive, ok bool) {
 	return
 }
 
-func (aam *AlertActiveMgr) Delete(key string) (err error) {
+// 返回当前所有活跃告警，调用方不应修改返回的告警
+func (aam *AlertActiveMgr) Alerts() (as []*Alert) {
+	aam.mutex.Lock()
+	defer aam.mutex.Unlock()
+
+	as = make([]*Alert, 0, len(aam.data))
+	for _, aa := range aam.data {
+		as = append(as, aa.Alert)
+	}
+	return
+}
+
+// 根据告警 id 查找活跃告警，返回告警的拷贝
+func (aam *AlertActiveMgr) GetById(id string) (a Alert, ok bool) {
+	aam.mutex.Lock()
+	defer aam.mutex.Unlock()
+
+	for _, aa := range aam.data {
+		if aa.Id.Hex() == id {
+			return *aa.Alert, true
+		}
+	}
+	return
+}
+
+// 手动恢复告警，和收到 resolved 的告警一样更新历史记录并发送恢复通知
+// 锁内只从内存中删除，历史记录的更新放到锁外
+func (aam *AlertActiveMgr) Resolve(xl *xlog.Logger, id string) (err error) {
+	var resolved *Alert
+	func() {
+		aam.mutex.Lock()
+		defer aam.mutex.Unlock()
+
+		for key, aa := range aam.data {
+			if aa.Id.Hex() != id {
+				continue
+			}
+			a := *aa.Alert
+			a.Status = AlertResolved
+			a.Severity = SeveritySuccess
+			a.EndsAt = time.Now()
+			err = aam.delete(key)
+			resolved = &a
+			break
+		}
+	}()
+
+	if resolved == nil {
+		return ErrAlertNotFound
+	}
+	err1 := aam.historyMgr.Update(xl, resolved.Id, &AlertHistoryUpdateArgs{resolved.Status, resolved.EndsAt})
+	if err1 != nil {
+		xl.Errorf("AlertActiveMgr.Resolve ==> aam.historyMgr.Update alert: %v, err: %v", resolved, err1)
+	}
+	if aam.f != nil {
+		aam.f(NewMessage(xl, resolved))
+	}
+	return
+}
+
+func (aam *AlertActiveMgr) Delete(xl *xlog.Logger, key string) (err error) {
 	aam.mutex.Lock()
 	defer aam.mutex.Unlock()
 
-	return aam.delete(key)
+	aa, ok := aam.data[key]
+	err = aam.delete(key)
+	if err == nil && ok {
+		aam.events.Record(xl, NewEvent(EventDeleted, aa.Alert))
+	}
+	return
 }
 
 func (aam *AlertActiveMgr) delete(key string) (err error) {
@@ -164,36 +277,51 @@ func (aam *AlertActiveMgr) delete(key string) (err error) {
 	return
 }
 
-func (aam *AlertActiveMgr) Ack(args *AlertsAckArgs) (err error) {
-	aam.mutex.Lock()
-	defer aam.mutex.Unlock()
-
-	f := func(a *AlertActive) error {
+func (aam *AlertActiveMgr) Ack(xl *xlog.Logger, args *AlertsAckArgs) (err error) {
+	// 只在锁内修改内存中的状态，事件、历史记录的写入放到锁外；已经 ack 过的告警不再处理
+	var acked []Alert
+	ack := Ack{args.Comment, time.Now(), args.Username}
+	f := func(a *AlertActive) {
+		if a.Status == AlertAcked {
+			return
+		}
 		a.Status = AlertAcked
-		ack := Ack{args.Comment, time.Now(), args.Username}
 		a.Acks = append(a.Acks, ack)
 		a.StopTick()
-		return aam.historyMgr.Ack(a.Id, ack)
+		acked = append(acked, *a.Alert)
 	}
 
-	if len(args.Alertnames) != 0 {
+	func() {
+		aam.mutex.Lock()
+		defer aam.mutex.Unlock()
+
 		for _, an := range args.Alertnames {
 			for _, alert := range aam.data {
 				if alert.Alertname == an {
-					err = f(alert)
+					f(alert)
 				}
 			}
 		}
-	}
-
-	for _, id := range args.Ids {
-		for _, alert := range aam.data {
-			if alert.Id.Hex() == id {
-				err = f(alert)
+		for _, id := range args.Ids {
+			for _, alert := range aam.data {
+				if alert.Id.Hex() == id {
+					f(alert)
+				}
 			}
 		}
+	}()
+
+	for i := range acked {
+		a := &acked[i]
+		ev := NewEvent(EventAcked, a)
+		ev.Username = ack.Username
+		ev.Detail = ack.Comment
+		aam.events.Record(xl, ev)
+		if aam.ackF != nil {
+			go aam.ackF(xl, a, ack)
+		}
+		err = aam.historyMgr.Ack(a.Id, ack)
 	}
-
 	return
 }
 
@@ -248,7 +376,7 @@ func (aam *AlertActiveMgr) Do(xl *xlog.Logger, as []*Alert) (newAs []*Alert) {
 
 	for _, a := range as {
 		if !a.NeedHandle {
-			err := aam.historyMgr.Create(a)
+			err := aam.historyMgr.Create(xl, a)
 			if err != nil {
 				xl.Errorf("AlertActiveMgr.Do ==> aam.historyMgr.Create alert: %v, err: %v", a, err)
 			}
@@ -258,8 +386,10 @@ func (aam *AlertActiveMgr) Do(xl *xlog.Logger, as []*Alert) (newAs []*Alert) {
 		}
 		if b, ok := aam.data[a.Key]; ok {
 			if a.Status == AlertResolved {
+				a.Id = b.Id
 				a.Severity = SeveritySuccess
-				err := aam.historyMgr.Update(b.Id, &AlertHistoryUpdateArgs{a.Status, a.EndsAt})
+				a.Escalations = b.Escalations
+				err := aam.historyMgr.Update(xl, b.Id, &AlertHistoryUpdateArgs{a.Status, a.EndsAt})
 				if err != nil {
 					xl.Errorf("AlertActiveMgr.Do ==>  aam.historyMgr.Update alert: %v, err: %v", a, err)
 				}
@@ -273,7 +403,7 @@ func (aam *AlertActiveMgr) Do(xl *xlog.Logger, as []*Alert) (newAs []*Alert) {
 			}
 		} else {
 			if a.Status == AlertFiring {
-				err := aam.historyMgr.Create(a)
+				err := aam.historyMgr.Create(xl, a)
 				if err != nil {
 					xl.Errorf("AlertActiveMgr.Do ==> aam.historyMgr.Create(alert) alert: %v, err: %v", a, err)
 				}
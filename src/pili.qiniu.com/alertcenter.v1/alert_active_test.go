@@ -42,7 +42,7 @@ func TestBackup(t *testing.T) {
 	done := make(chan struct{})
 	NewAlertActiveMgr(func(msg Message) {
 		sendC <- msg
-	}, AlertActiveCfg{1, 1, "tmp", 10000}, nil)
+	}, AlertActiveCfg{EmergenctIntervalS: 1, ResendIntervalS: 1, BackupFile: "tmp", BackupIntervalMS: 10000}, nil, nil)
 
 	go func() {
 		msg := <-sendC
@@ -53,3 +53,34 @@ func TestBackup(t *testing.T) {
 	<-done
 	os.Remove("tmp")
 }
+
+func TestAlertActiveAckTwice(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+
+	aam := &AlertActiveMgr{
+		AlertActiveCfg: &AlertActiveCfg{EmergenctIntervalS: 3600},
+		data:           make(map[string]*AlertActive),
+	}
+	ackC := make(chan string, 2)
+	aam.ackF = func(xl *xlog.Logger, a *Alert, ack Ack) {
+		ackC <- ack.Username
+	}
+	a := &Alert{Id: bson.NewObjectId(), Key: "k1", Alertname: "disk", Status: AlertFiring, StartsAt: time.Now()}
+	ast.NoError(aam.Add(xl, a))
+
+	// 第二次 ack 不再处理，也不会重复关闭 StopTickC
+	ast.NoError(aam.Ack(xl, &AlertsAckArgs{Ids: []string{a.Id.Hex()}, Username: "A"}))
+	ast.NoError(aam.Ack(xl, &AlertsAckArgs{Ids: []string{a.Id.Hex()}, Alertnames: []string{"disk"}, Username: "B"}))
+	ast.Equal("A", <-ackC)
+	select {
+	case name := <-ackC:
+		ast.Fail("acked twice by " + name)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	acked, ok := aam.GetById(a.Id.Hex())
+	ast.True(ok)
+	ast.Equal(AlertAcked, acked.Status)
+	ast.Equal(1, len(acked.Acks))
+}
@@ -27,15 +27,17 @@ type AlertProfileCfg struct {
 }
 
 type AlertProfile struct {
-	Alertname   string    `json:"alertname" bson:"_id"`
-	Description string    `json:"description" bson:"description"`
-	Tags        []string  `json:"tags" bson:"tags"`
-	NeedOncall  bool      `json:"needOncall" bson:"needOncall"`
-	Notifiers   []string  `json:"notifiers" bson:"notifiers"`
-	IsNew       bool      `json:"isNew" bson:"isNew"`
-	CreateAt    time.Time `json:"createAt" bson:"createAt"`
-	LatestTime  time.Time `json:"latestTime" bson:"latestTime"`
-	UpdateAt    time.Time `json:"updateAt" bson:"updateAt"`
+	Alertname        string    `json:"alertname" bson:"_id"`
+	Description      string    `json:"description" bson:"description"`
+	Tags             []string  `json:"tags" bson:"tags"`
+	NeedOncall       bool      `json:"needOncall" bson:"needOncall"`
+	Notifiers        []string  `json:"notifiers" bson:"notifiers"`
+	GroupBy          []string  `json:"groupBy" bson:"groupBy"`
+	EscalationPolicy string    `json:"escalationPolicy" bson:"escalationPolicy"`
+	IsNew            bool      `json:"isNew" bson:"isNew"`
+	CreateAt         time.Time `json:"createAt" bson:"createAt"`
+	LatestTime       time.Time `json:"latestTime" bson:"latestTime"`
+	UpdateAt         time.Time `json:"updateAt" bson:"updateAt"`
 }
 
 func (a *AlertProfile) Check() (err error) {
@@ -124,13 +126,15 @@ func (apm *AlertProfileMgr) Create(ap *AlertProfile) (err error) {
 }
 
 type AlertProfileUpdateArgs struct {
-	Alertname   string    `json:"alertname" bson:"-"`
-	Description string    `json:"description" bson:"description"`
-	Tags        []string  `json:"tags" bson:"tags"`
-	NeedOncall  bool      `json:"needOncall" bson:"needOncall"`
-	IsNew       bool      `json:"isNew" bson:"isNew"`
-	Notifiers   []string  `json:"notifiers" bson:"notifiers"`
-	UpdateAt    time.Time `bson:"updateAt" json:"-"`
+	Alertname        string    `json:"alertname" bson:"-"`
+	Description      string    `json:"description" bson:"description"`
+	Tags             []string  `json:"tags" bson:"tags"`
+	NeedOncall       bool      `json:"needOncall" bson:"needOncall"`
+	IsNew            bool      `json:"isNew" bson:"isNew"`
+	Notifiers        []string  `json:"notifiers" bson:"notifiers"`
+	GroupBy          []string  `json:"groupBy" bson:"groupBy"`
+	EscalationPolicy string    `json:"escalationPolicy" bson:"escalationPolicy"`
+	UpdateAt         time.Time `bson:"updateAt" json:"-"`
 }
 
 func (apm *AlertProfileMgr) Update(args *AlertProfileUpdateArgs) (err error) {
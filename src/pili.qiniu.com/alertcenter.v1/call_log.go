@@ -0,0 +1,234 @@
+package alertcenter
+
+import (
+	"sort"
+	"time"
+
+	"github.com/qiniu/http/httputil.v1"
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+
+	pmgo "pili.qiniu.com/mgo"
+)
+
+const (
+	DefaultCallLogListLimit = 1000
+	MaxCallStatsRange       = 31 * 24 * time.Hour
+	callLogDayLayout        = "2006-01-02"
+)
+
+var (
+	ErrInvalidCallStatsRange = httputil.NewError(400, "begin and end are required and at most 31 days apart")
+)
+
+// 每一次呼叫，用于审计和核对语音服务的账单
+type CallLog struct {
+	Id        bson.ObjectId `json:"id" bson:"_id"`
+	AlertId   bson.ObjectId `json:"alertId" bson:"alertId"`
+	Key       string        `json:"key" bson:"key"`
+	Alertname string        `json:"alertname" bson:"alertname"`
+	StaffId   bson.ObjectId `json:"staffId,omitempty" bson:"staffId,omitempty"`
+	Staff     string        `json:"staff" bson:"staff"`
+	Phone     string        `json:"phone" bson:"phone"`
+	Provider  string        `json:"provider" bson:"provider"`
+	Oid       string        `json:"oid" bson:"oid"`       // 语音服务返回的呼叫 id
+	Result    string        `json:"result" bson:"result"` // success 或者错误信息
+	Status    CallStatus    `json:"status,omitempty" bson:"status,omitempty"`
+	Retry     int           `json:"retry" bson:"retry"`   // 呼叫失败后第几次重试，0 表示第一次呼叫
+	Recall    bool          `json:"recall" bson:"recall"` // 是否是没有人接听之后的重拨
+	Time      time.Time     `json:"time" bson:"time"`
+	ReqId     string        `json:"reqId" bson:"reqId"`
+}
+
+type CallLogCfg struct {
+	MgoOpt pmgo.Option `json:"mgo_opt"`
+}
+
+type CallLogMgr struct {
+	*CallLogCfg
+	mgo pmgo.Mongo
+}
+
+func NewCallLogMgr(cfg CallLogCfg) *CallLogMgr {
+	callLogMgo, err := pmgo.New(cfg.MgoOpt)
+	if err != nil {
+		log.Panic("call_log: NewCallLogMgr pmgo.New(cfg.MgoOpt) err:", err)
+	}
+	for _, key := range [][]string{{"time"}, {"staff", "time"}, {"alertname", "time"}, {"oid"}} {
+		err = callLogMgo.Coll().EnsureIndex(mgo.Index{Key: key})
+		if err != nil {
+			log.Panicf("call_log: EnsureIndex(%v) err: %v", key, err)
+		}
+	}
+	return &CallLogMgr{&cfg, callLogMgo}
+}
+
+// cm 为 nil 时不记录，方便单独使用 Caller
+func (cm *CallLogMgr) Record(xl *xlog.Logger, l CallLog) {
+	if cm == nil {
+		return
+	}
+	l.Id = bson.NewObjectId()
+	if l.Time.IsZero() {
+		l.Time = time.Now()
+	}
+	l.ReqId = xl.ReqId()
+	err := cm.mgo.Coll().Insert(l)
+	if err != nil {
+		xl.Errorf("CallLogMgr.Record callLog: %v, err: %v", l, err)
+	}
+}
+
+// 收到状态回调时更新
+func (cm *CallLogMgr) UpdateStatus(xl *xlog.Logger, oid string, status CallStatus) {
+	if cm == nil || oid == "" || status == "" {
+		return
+	}
+	err := cm.mgo.Coll().Update(M{"oid": oid}, M{"$set": M{"status": status}})
+	if err != nil {
+		xl.Errorf("CallLogMgr.UpdateStatus oid: %v, status: %v, err: %v", oid, status, err)
+	}
+}
+
+type CallLogQuery struct {
+	Begin     string `json:"begin"`
+	End       string `json:"end"`
+	Staff     string `json:"staff"`
+	Alertname string `json:"alertname"`
+	Limit     int    `json:"limit"`
+	Marker    string `json:"marker"`
+}
+
+func (args *CallLogQuery) query() (q M, err error) {
+	q = M{}
+	timeFilter := M{}
+	if args.Begin != "" {
+		begin, ok := TimeOf(args.Begin)
+		if !ok {
+			return nil, httputil.NewError(400, "invalid begin time str")
+		}
+		timeFilter["$gte"] = begin
+	}
+	if args.End != "" {
+		end, ok := TimeOf(args.End)
+		if !ok {
+			return nil, httputil.NewError(400, "invalid end time str")
+		}
+		timeFilter["$lt"] = end
+	}
+	if len(timeFilter) != 0 {
+		q["time"] = timeFilter
+	}
+	if args.Staff != "" {
+		q["staff"] = args.Staff
+	}
+	if args.Alertname != "" {
+		q["alertname"] = args.Alertname
+	}
+	return
+}
+
+func (cm *CallLogMgr) List(args *CallLogQuery) (ret []CallLog, marker string, err error) {
+	q, err := args.query()
+	if err != nil {
+		return
+	}
+	if args.Marker != "" {
+		if !bson.IsObjectIdHex(args.Marker) {
+			return nil, "", ErrInvalidObjectId
+		}
+		q["_id"] = M{"$lt": bson.ObjectIdHex(args.Marker)}
+	}
+	if args.Limit <= 0 || args.Limit > DefaultCallLogListLimit {
+		args.Limit = DefaultCallLogListLimit
+	}
+	err = cm.mgo.Coll().Find(q).Sort("-_id").Limit(args.Limit).All(&ret)
+	if err != nil {
+		return
+	}
+	if len(ret) == args.Limit {
+		marker = ret[len(ret)-1].Id.Hex()
+	}
+	return
+}
+
+// 某一天某一个人的呼叫次数，Success 为语音服务接受的呼叫，Answered 为有人接听的呼叫
+type CallStat struct {
+	Day      string `json:"day"`
+	Staff    string `json:"staff"`
+	Total    int    `json:"total"`
+	Success  int    `json:"success"`
+	Answered int    `json:"answered"`
+}
+
+// 按本地时区的天统计，忽略 limit、marker；必须指定 begin、end，且不超过 MaxCallStatsRange
+func (cm *CallLogMgr) Stats(args *CallLogQuery) (ret []CallStat, err error) {
+	q, err := args.query()
+	if err != nil {
+		return
+	}
+	if args.Begin == "" || args.End == "" {
+		return nil, ErrInvalidCallStatsRange
+	}
+	begin, _ := TimeOf(args.Begin)
+	end, _ := TimeOf(args.End)
+	if end.Sub(begin) > MaxCallStatsRange {
+		return nil, ErrInvalidCallStatsRange
+	}
+	var logs []CallLog
+	err = cm.mgo.Coll().Find(q).Select(M{"time": 1, "staff": 1, "result": 1, "status": 1}).All(&logs)
+	if err != nil {
+		return
+	}
+	return CountCalls(logs, time.Local), nil
+}
+
+// 按天、人统计，按天、人排序
+func CountCalls(logs []CallLog, loc *time.Location) []CallStat {
+	type statKey struct {
+		day   string
+		staff string
+	}
+	stats := make(map[statKey]*CallStat)
+	for _, l := range logs {
+		k := statKey{l.Time.In(loc).Format(callLogDayLayout), l.Staff}
+		st, ok := stats[k]
+		if !ok {
+			st = &CallStat{Day: k.day, Staff: k.staff}
+			stats[k] = st
+		}
+		st.Total++
+		if l.Result == EventResultSuccess {
+			st.Success++
+		}
+		if l.Status == CallAnswered || l.Status == CallCompleted {
+			st.Answered++
+		}
+	}
+
+	ret := make([]CallStat, 0, len(stats))
+	for _, st := range stats {
+		ret = append(ret, *st)
+	}
+	sort.Sort(callStatsByDay(ret))
+	return ret
+}
+
+type callStatsByDay []CallStat
+
+func (s callStatsByDay) Len() int {
+	return len(s)
+}
+
+func (s callStatsByDay) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s callStatsByDay) Less(i, j int) bool {
+	if s[i].Day != s[j].Day {
+		return s[i].Day < s[j].Day
+	}
+	return s[i].Staff < s[j].Staff
+}
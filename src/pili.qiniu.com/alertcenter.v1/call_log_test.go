@@ -0,0 +1,118 @@
+package alertcenter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+
+	pmgo "pili.qiniu.com/mgo"
+)
+
+func TestCountCalls(t *testing.T) {
+	ast := assert.New(t)
+
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	ast.NoError(err)
+	// UTC 的 16:00 是 Asia/Shanghai 第二天的 00:00
+	day1 := time.Date(2017, 11, 13, 10, 0, 0, 0, time.UTC)
+	day2 := time.Date(2017, 11, 13, 16, 0, 0, 0, time.UTC)
+
+	logs := []CallLog{
+		{Staff: "B", Time: day1, Result: EventResultSuccess, Status: CallAnswered},
+		{Staff: "A", Time: day1, Result: EventResultSuccess, Status: CallNoAnswer},
+		{Staff: "A", Time: day1, Result: "timeout"},
+		{Staff: "A", Time: day2, Result: EventResultSuccess, Status: CallCompleted},
+	}
+	ast.Equal([]CallStat{
+		{Day: "2017-11-13", Staff: "A", Total: 2, Success: 1},
+		{Day: "2017-11-13", Staff: "B", Total: 1, Success: 1, Answered: 1},
+		{Day: "2017-11-14", Staff: "A", Total: 1, Success: 1, Answered: 1},
+	}, CountCalls(logs, shanghai))
+
+	ast.Equal([]CallStat{
+		{Day: "2017-11-13", Staff: "A", Total: 3, Success: 2, Answered: 1},
+		{Day: "2017-11-13", Staff: "B", Total: 1, Success: 1, Answered: 1},
+	}, CountCalls(logs, time.UTC))
+}
+
+func TestCallStatsRange(t *testing.T) {
+	ast := assert.New(t)
+
+	// 检查时间范围时还没有访问 mongo
+	cm := &CallLogMgr{}
+	_, err := cm.Stats(&CallLogQuery{})
+	ast.Equal(ErrInvalidCallStatsRange, err)
+	_, err = cm.Stats(&CallLogQuery{Begin: "1h-ago"})
+	ast.Equal(ErrInvalidCallStatsRange, err)
+	_, err = cm.Stats(&CallLogQuery{Begin: "2017-10-01", End: "2017-11-02"})
+	ast.Equal(ErrInvalidCallStatsRange, err)
+}
+
+func TestCallLog(t *testing.T) {
+	log.Println("TestCallLog Begin")
+	defer log.Println("TestCallLog End")
+	defer clearTestDB()
+	xl := xlog.NewDummy()
+	ast := assert.New(t)
+
+	// nil CallLogMgr 不记录
+	var cm *CallLogMgr
+	cm.Record(xl, CallLog{AlertId: bson.NewObjectId()})
+	cm.UpdateStatus(xl, "1", CallAnswered)
+
+	cm = NewCallLogMgr(CallLogCfg{
+		MgoOpt: pmgo.Option{
+			MgoDB:   "test-alertcenter",
+			MgoColl: "call_log",
+		},
+	})
+
+	a := &Alert{Id: bson.NewObjectId(), Key: "test", Alertname: "disk"}
+	now := time.Now()
+	cm.Record(xl, CallLog{AlertId: a.Id, Alertname: a.Alertname, Staff: "A", Phone: "1", Oid: "1", Result: EventResultSuccess, Time: now})
+	cm.Record(xl, CallLog{AlertId: a.Id, Alertname: a.Alertname, Staff: "B", Phone: "2", Result: EventResult(errors.New("timeout")), Time: now, Retry: 1})
+	cm.Record(xl, CallLog{AlertId: a.Id, Alertname: "cpu", Staff: "A", Phone: "1", Oid: "3", Result: EventResultSuccess, Time: now, Recall: true})
+	cm.UpdateStatus(xl, "1", CallAnswered)
+
+	logs, marker, err := cm.List(&CallLogQuery{Staff: "A"})
+	ast.NoError(err)
+	ast.Equal("", marker)
+	if ast.Equal(2, len(logs)) {
+		ast.Equal("3", logs[0].Oid)
+		ast.True(logs[0].Recall)
+		ast.Equal(CallAnswered, logs[1].Status)
+	}
+
+	logs, marker, err = cm.List(&CallLogQuery{Alertname: "disk", Limit: 1})
+	ast.NoError(err)
+	if ast.Equal(1, len(logs)) {
+		ast.Equal("B", logs[0].Staff)
+		ast.Equal(1, logs[0].Retry)
+		ast.Equal(logs[0].Id.Hex(), marker)
+	}
+	logs, _, err = cm.List(&CallLogQuery{Alertname: "disk", Marker: marker})
+	ast.NoError(err)
+	if ast.Equal(1, len(logs)) {
+		ast.Equal("A", logs[0].Staff)
+	}
+
+	logs, _, err = cm.List(&CallLogQuery{Begin: "1h-ago", End: "2h-ago"})
+	ast.NoError(err)
+	ast.Equal(0, len(logs))
+
+	_, _, err = cm.List(&CallLogQuery{Begin: "yesterday"})
+	ast.Error(err)
+
+	stats, err := cm.Stats(&CallLogQuery{Begin: "1h-ago", End: now.Add(time.Hour).Format(time.RFC3339)})
+	ast.NoError(err)
+	day := now.Format(callLogDayLayout)
+	ast.Equal([]CallStat{
+		{Day: day, Staff: "A", Total: 2, Success: 2, Answered: 1},
+		{Day: day, Staff: "B", Total: 1},
+	}, stats)
+}
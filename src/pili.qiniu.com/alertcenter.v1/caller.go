@@ -1,16 +1,24 @@
 package alertcenter
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/qiniu/http/httputil.v1"
 	"github.com/qiniu/rpc.v1"
 	"github.com/qiniu/xlog.v1"
+	"labix.org/v2/mgo/bson"
 	"qbox.us/oauth"
 )
 
@@ -22,8 +30,23 @@ const (
 	DefaultReCallIntervals    = 60
 	DefaultCallerFile         = "run/caller.data"
 	timeFmt                   = "15:04"
-	daySeconds                = 24 * 60 * 60
 	CallerName                = "caller"
+	DefaultCallbackTimeout    = 2 * 60
+	DefaultCallerAckComment   = "ack by phone"
+	DefaultLayerWait          = 2 * 60
+
+	CallerSignatureHeader = "X-Alertcenter-Signature"
+	CallerTimestampHeader = "X-Alertcenter-Timestamp"
+	CallerSignatureMaxAge = 5 * time.Minute
+)
+
+var (
+	ErrCallNotFound           = httputil.NewError(http.StatusNotFound, "call not found")
+	ErrInvalidCallerSignature = httputil.NewError(http.StatusUnauthorized, "invalid caller callback signature")
+	ErrCallerCallbackDisabled = httputil.NewError(http.StatusForbidden, "caller callback secret not configured")
+	ErrInvalidCallerCallback  = httputil.NewError(http.StatusBadRequest, "invalid caller callback")
+	ErrCallInCloseTime        = httputil.NewError(http.StatusConflict, "caller is temporarily closed")
+	ErrCallInQuietHours       = httputil.NewError(http.StatusConflict, "caller is in quiet hours")
 )
 
 var morseMsgRegex = regexp.MustCompile(`^[\da-zA-Z]{4,8}$`)
@@ -67,8 +90,17 @@ type SendOut struct {
 }
 
 func (m *MorseClient) SendVoiceSms(logger rpc.Logger, param SendSmsIn) (oid string, err error) {
+	return m.send(logger, "/api/notification/send/voicesms", param)
+}
+
+// 普通短信，内容不受语音短信只能是数字验证码的限制
+func (m *MorseClient) SendSms(logger rpc.Logger, param SendSmsIn) (oid string, err error) {
+	return m.send(logger, "/api/notification/send/sms", param)
+}
+
+func (m *MorseClient) send(logger rpc.Logger, path string, param SendSmsIn) (oid string, err error) {
 	var resp map[string]interface{}
-	err = m.Client.CallWithJson(logger, &resp, m.Host+"/api/notification/send/voicesms", &param)
+	err = m.Client.CallWithJson(logger, &resp, m.Host+path, &param)
 	if err != nil {
 		return "", err
 	}
@@ -103,12 +135,48 @@ type CallerCfg struct {
 	CallIntervals   int      `json:"call_intervals"` // 同类告警多少秒内打过一次了就先不打，尽量减低打电话的频率，减少不必要的成本，目前不做同类告警下更细分的处理
 	RecallTimes     int      `json:"recall_times"`
 	RecallIntervals int      `json:"recall_intervals"`
+
+	// 打电话的服务，morse、twilio 或者 fake，默认为 morse
+	VoiceProvider string `json:"voice_provider"`
+	// 主服务呼叫失败时使用的备用服务，为空时不切换
+	SecondaryVoiceProvider string    `json:"secondary_voice_provider"`
+	TwilioCfg              TwilioCfg `json:"twilio_cfg"`
+
+	// 语音服务支持状态回调时开启，依次呼叫值班人员，未接听时呼叫下一个人
+	WaitCallback bool `json:"wait_callback"`
+	// POST /caller/callback 的签名密钥，为空时不接受这个接口的回调
+	CallbackSecret string `json:"callback_secret"`
+	// 呼叫后多少秒内没有收到最终状态的回调就不再等待，开启 wait_callback 时视为未接听
+	CallbackTimeout int `json:"callback_timeout"`
+
+	// 按主值班、副值班、排班的升级联系人分层依次呼叫，优先于 wait_callback
+	Layered bool `json:"layered"`
+	// 每一层呼叫之后等待多少秒，没有人接听也没有 ack 告警时呼叫下一层
+	LayerWait int `json:"layer_wait"`
 }
 
 type CallerParams struct {
-	StartAt      int       `json:"start_at"`       // 每天第几秒开始不打电话, -1 表示未设置
-	EndAt        int       `json:"end_at"`         // 每天第几秒结束不打电话, -1 表示未设置
-	CloseEndTime time.Time `json:"close_end_time"` // 暂停电话功能的结束时间点
+	QuietHours   []QuietHour `json:"quiet_hours"`    // 不打电话的时间段
+	CloseEndTime time.Time   `json:"close_end_time"` // 暂停电话功能的结束时间点
+}
+
+// 之前保存的每天第几秒开始、结束不打电话，-1 表示未设置
+type legacyCallerParams struct {
+	StartAt *int `json:"start_at"`
+	EndAt   *int `json:"end_at"`
+}
+
+// 转换为每天的时间段，之前设置时使用的是本地时间
+func (p legacyCallerParams) QuietHour() (q QuietHour, ok bool) {
+	if p.StartAt == nil || p.EndAt == nil || *p.StartAt < 0 || *p.EndAt < 0 {
+		return
+	}
+	q = QuietHour{
+		Id:      bson.NewObjectId(),
+		StartAt: fmt.Sprintf("%02d:%02d", *p.StartAt/3600, *p.StartAt%3600/60),
+		EndAt:   fmt.Sprintf("%02d:%02d", *p.EndAt/3600, *p.EndAt%3600/60),
+	}
+	return q, true
 }
 
 type Caller struct {
@@ -116,10 +184,21 @@ type Caller struct {
 	CallerParams
 
 	dutyMgr DutyManager
+	events  *EventMgr
 	morse   *MorseClient
+	voice   VoiceProvider
+	twilio  *TwilioVoice
+	sms     *Sms
 	f       func(msg Message)
 	mutex   sync.RWMutex
 	alerts  map[string]time.Time // key 是要打电话的 alertname，value 是该告警上一次打电话的时间点
+
+	ackF      func(xl *xlog.Logger, args *AlertsAckArgs) error // 接听的人按键时 ack 告警
+	getAlertF func(id string) (Alert, bool)                    // 分层呼叫时检查告警是否已经 ack 或者恢复
+	callLogs  *CallLogMgr
+	callMutex sync.Mutex
+	calls     map[string]*callRecord  // key 是语音服务返回的呼叫 id
+	sessions  map[string]*callSession // key 是 alertId，只保留最近一次的呼叫
 }
 
 func NewAdminOAuth(tr http.RoundTripper, host, user, pwd string) (*oauth.Transport, error) {
@@ -155,28 +234,48 @@ func (cfg *CallerCfg) Check() {
 	if cfg.RecallIntervals == 0 {
 		cfg.RecallIntervals = DefaultReCallIntervals
 	}
+	if cfg.CallbackTimeout == 0 {
+		cfg.CallbackTimeout = DefaultCallbackTimeout
+	}
+	if cfg.LayerWait == 0 {
+		cfg.LayerWait = DefaultLayerWait
+	}
 }
 
-func NewCaller(cfg CallerCfg, dutyMgr DutyManager, f func(msg Message)) Caller {
+func NewCaller(cfg CallerCfg, dutyMgr DutyManager, f func(msg Message), events *EventMgr) Caller {
 	cfg.Check()
 
 	tr := NewTransport(cfg.ClientId, nil)
 	client := NewMorseClient(cfg.MorseHost, &rpc.Client{Client: &http.Client{Transport: tr}})
 
 	var params CallerParams
+	var legacy legacyCallerParams
 	err := load(xlog.NewDummy(), &params, cfg.FilePath)
-	if err != nil {
-		params.StartAt = -1
-		params.EndAt = -1
+	if err == nil && len(params.QuietHours) == 0 && load(xlog.NewDummy(), &legacy, cfg.FilePath) == nil {
+		if q, ok := legacy.QuietHour(); ok {
+			// 迁移之后马上保存，否则每次启动都会生成新的 id
+			params.QuietHours = []QuietHour{q}
+			save(xlog.NewDummy(), params, cfg.FilePath)
+		}
+	}
+
+	voice := NewVoiceProvider(cfg.VoiceProvider, &cfg, client)
+	if cfg.SecondaryVoiceProvider != "" {
+		voice = NewFailoverVoice(voice, NewVoiceProvider(cfg.SecondaryVoiceProvider, &cfg, client))
 	}
 
 	return Caller{
 		CallerCfg:    &cfg,
 		CallerParams: params,
 		dutyMgr:      dutyMgr,
+		events:       events,
 		morse:        client,
+		voice:        voice,
+		twilio:       findTwilioVoice(voice),
 		f:            f,
 		alerts:       make(map[string]time.Time),
+		calls:        make(map[string]*callRecord),
+		sessions:     make(map[string]*callSession),
 	}
 }
 
@@ -194,18 +293,15 @@ func (c *Caller) Notify(msg Message) (err error) {
 			continue
 		}
 
-		h := int(now.Unix() % daySeconds)
-		// silence 时间段内不Call
-		if c.StartAt != -1 && c.EndAt != -1 {
-			if h >= c.StartAt && h <= c.EndAt {
-				xl.Info("<In SilenceTime>", a.Description)
-				continue
-			}
+		// quiet hours 时间段内不Call，豁免的告警级别除外
+		if q, ok := c.InQuietHours(now, a.Severity); ok {
+			xl.Info("<In QuietHours>", q.Id.Hex(), a.Description)
+			continue
 		}
 
 		c.mutex.RLock()
-		// CallIntervals 时间段内不Call
-		if time.Now().Sub(c.alerts[a.Alertname]) < time.Duration(c.CallIntervals)*time.Second {
+		// CallIntervals 时间段内不Call，升级策略的呼叫除外
+		if !msg.Escalated && time.Now().Sub(c.alerts[a.Alertname]) < time.Duration(c.CallIntervals)*time.Second {
 			xl.Info("<In CallIntervals>", a.Description)
 			c.mutex.RUnlock()
 			continue
@@ -213,7 +309,7 @@ func (c *Caller) Notify(msg Message) (err error) {
 		c.mutex.RUnlock()
 
 		for i := 0; i < c.FailTryTimes+1; i++ {
-			err1 := c.SendVoiceSms(xl, a.Description)
+			err1 := c.dial(xl, a, msg.Staffs, i, false)
 			if err1 == nil {
 				c.mutex.Lock()
 				c.alerts[a.Alertname] = time.Now()
@@ -223,93 +319,603 @@ func (c *Caller) Notify(msg Message) (err error) {
 			err = err1
 		}
 
-		go c.recall(xl, a.Description)
+		// 依次呼叫、分层呼叫时由状态回调或者定时器驱动重拨
+		if !c.WaitCallback && !c.Layered {
+			go c.recall(xl, a, msg.Staffs)
+		}
+	}
+	return
+}
+
+// 测试告警只呼叫第一层值班人员一次，不重拨，也不影响 CallIntervals
+// 暂时关闭或者 quiet hours 内不呼叫，返回错误说明原因
+func (c *Caller) NotifyTest(xl *xlog.Logger, a *Alert) (err error) {
+	now := time.Now()
+	if now.Before(c.CloseEndTime) {
+		return ErrCallInCloseTime
+	}
+	if _, ok := c.InQuietHours(now, a.Severity); ok {
+		return ErrCallInQuietHours
+	}
+
+	layers, err := c.getLayers(xl, nil)
+	if err != nil {
+		return
+	}
+	if len(layers) > 1 {
+		layers = layers[:1]
+	}
+	s := c.newSession(a, layers)
+	s.test = true
+	defer c.endSession(a.Id.Hex(), s)
+	for _, t := range s.targets {
+		err1 := c.call(xl, s, t)
+		if err1 != nil {
+			err = err1
+		}
 	}
 	return
 }
 
-func (c *Caller) recall(xl *xlog.Logger, msg string) {
-	cnt := 0
-	for range time.After(time.Duration(c.RecallIntervals) * time.Second) {
-		if cnt == c.RecallTimes {
+// 有人接听之后不再重拨
+func (c *Caller) recall(xl *xlog.Logger, a *Alert, ids []bson.ObjectId) {
+	id := a.Id.Hex()
+	defer c.endSession(id, nil)
+
+	for cnt := 0; cnt < c.RecallTimes; cnt++ {
+		time.Sleep(time.Duration(c.RecallIntervals) * time.Second)
+		if c.Answered(id) {
+			xl.Info("<Answered>", a.Description)
 			return
 		}
-		err := c.SendVoiceSms(xl, msg)
+		err := c.dial(xl, a, ids, 0, true)
 		if err != nil {
 			xl.Errorf("recall Err, Time: %v, Err: %v", cnt, err)
 		}
-		cnt++
 	}
 }
 
 func (c *Caller) TempClose(xl *xlog.Logger, s int) {
-	defer save(xl, c.CallerParams, c.FilePath)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.CloseEndTime = time.Now().Add(time.Duration(s) * time.Second)
+	save(xl, c.CallerParams, c.FilePath)
 	return
 }
 
 func (c *Caller) UnsetTempClose(xl *xlog.Logger) {
-	defer save(xl, c.CallerParams, c.FilePath)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 	c.CloseEndTime = time.Time{}
+	save(xl, c.CallerParams, c.FilePath)
 	return
 }
 
-func (c *Caller) Silence(xl *xlog.Logger, startAt, endAt int) (err error) {
-	defer save(xl, c.CallerParams, c.FilePath)
-	c.StartAt = startAt
-	c.EndAt = endAt
-	return
+// 打完电话后再发一条短信，告诉接电话的人是什么告警
+func (c *Caller) FollowUpWithSms(sms *Sms) {
+	c.sms = sms
 }
 
-func (c *Caller) UnsetSilence(xl *xlog.Logger) (err error) {
-	defer save(xl, c.CallerParams, c.FilePath)
-	c.StartAt = -1
-	c.EndAt = -1
-	return
+// ids 为空时返回当前值班人员
+func getStaffs(xl *xlog.Logger, dutyMgr DutyManager, ids []bson.ObjectId) ([]Staff, error) {
+	if len(ids) == 0 {
+		return dutyMgr.GetCurrent(xl)
+	}
+	return dutyMgr.ListStaffs(ids)
+}
+
+// 分层呼叫并且 ids 为空时返回当前值班的各个层级，否则只有一层
+func (c *Caller) getLayers(xl *xlog.Logger, ids []bson.ObjectId) ([][]Staff, error) {
+	if c.Layered && len(ids) == 0 {
+		return c.dutyMgr.GetCurrentLayers(xl)
+	}
+	staffs, err := getStaffs(xl, c.dutyMgr, ids)
+	return [][]Staff{staffs}, err
+}
+
+func (c *Caller) SendVoiceSms(xl *xlog.Logger, a *Alert, ids []bson.ObjectId) (err error) {
+	return c.dial(xl, a, ids, 0, false)
 }
 
-func (c *Caller) SendVoiceSms(xl *xlog.Logger, msg string) (err error) {
-	xl.Info("(c *Caller) SendVoiceSms Begin", msg)
+// retry 是呼叫失败后第几次重试，recall 表示没有人接听之后的重拨，用于记录呼叫日志
+func (c *Caller) dial(xl *xlog.Logger, a *Alert, ids []bson.ObjectId, retry int, recall bool) (err error) {
+	xl.Info("(c *Caller) SendVoiceSms Begin", a.Description)
 	defer xl.Info("(c *Caller) SendVoiceSms End")
 
-	if msg == "" {
-		msg = DefaultCallerMsg
+	layers, err := c.getLayers(xl, ids)
+	if err != nil {
+		errMsg := fmt.Sprint("c.getLayers(xl, ids) error", err)
+		xl.Error(errMsg)
+		c.notifyErr(xl, errMsg)
+		return
+	}
+	s := c.newSession(a, layers)
+	s.retry, s.recall = retry, recall
+	switch {
+	case c.Layered:
+		return c.callLayer(xl, s)
+	case c.WaitCallback:
+		return c.callNext(xl, s)
 	}
-	if i, err := strconv.ParseInt(msg, 10, 64); err != nil || i < 100000 {
-		msg = DefaultCallerMsg
+	for _, t := range s.targets {
+		err1 := c.call(xl, s, t)
+		if err1 != nil {
+			err = err1
+		}
 	}
-	staffs, err := c.dutyMgr.GetCurrent(xl)
+	return
+}
+
+func (c *Caller) call(xl *xlog.Logger, s *callSession, t callTarget) (err error) {
+	a := s.alert
+	oid, provider, err := c.voice.Call(xl, t.phone, a)
+	ev := NewEvent(EventCalled, a)
+	ev.Result = EventResult(err)
+	ev.Detail = t.phone
+	c.events.Record(xl, ev)
+	c.callMutex.Lock()
+	recall := s.recall || s.round > 0
+	c.callMutex.Unlock()
+	c.callLogs.Record(xl, CallLog{
+		AlertId:   a.Id,
+		Key:       a.Key,
+		Alertname: a.Alertname,
+		StaffId:   t.staff.Id,
+		Staff:     t.staff.Name,
+		Phone:     t.phone,
+		Provider:  provider,
+		Oid:       oid,
+		Result:    EventResult(err),
+		Retry:     s.retry,
+		Recall:    recall,
+	})
 	if err != nil {
-		errMsg := fmt.Sprint("c.dutyMgr.GetCurrent(xl) error", err)
-		xl.Error(errMsg)
+		errMsg := fmt.Sprintf("Caller.SendVoiceSms phone: %v, Error: %v", t.phone, err)
+		xl.Errorf(errMsg)
 		c.notifyErr(xl, errMsg)
 		return
 	}
-	phones := []string{}
-	for _, staff := range staffs {
-		for _, phone := range staff.Phones {
-			phones = append(phones, phone)
+	xl.Infof("SendVoiceSms to %v success, Oid is %v", t.phone, oid)
+
+	rec := &callRecord{session: s, target: t, callId: oid, status: CallCalling, callAt: time.Now()}
+	c.callMutex.Lock()
+	c.calls[oid] = rec
+	s.records = append(s.records, rec)
+	c.callMutex.Unlock()
+	time.AfterFunc(time.Duration(c.CallbackTimeout)*time.Second, func() {
+		c.callbackTimeout(xl, oid)
+	})
+
+	if c.sms != nil {
+		c.sms.Send(xl, t.phone, []*Alert{a})
+	}
+	return
+}
+
+// ========================================
+// 呼叫状态回调
+
+type CallStatus string
+
+const (
+	CallCalling   CallStatus = "calling" // 还没有收到回调
+	CallAnswered  CallStatus = "answered"
+	CallCompleted CallStatus = "completed" // 接听之后挂断
+	CallNoAnswer  CallStatus = "no-answer"
+	CallBusy      CallStatus = "busy"
+	CallFailed    CallStatus = "failed"
+)
+
+// 语音服务的状态回调，接听的人按键时 Digits 不为空
+type CallCallbackArgs struct {
+	CallId string     `json:"call_id"`
+	Status CallStatus `json:"status"`
+	Digits string     `json:"digits"`
+}
+
+// 签名为 hex(HmacSHA256(secret, timestamp + ":" + body))
+func CallerSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + ":"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 用 CallbackSecret 校验回调的签名和时间戳
+func (c *Caller) ParseCallback(header http.Header, body []byte, now time.Time) (args *CallCallbackArgs, err error) {
+	if c.CallbackSecret == "" {
+		return nil, ErrCallerCallbackDisabled
+	}
+	timestamp := header.Get(CallerTimestampHeader)
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCallerSignature
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > CallerSignatureMaxAge || d < -CallerSignatureMaxAge {
+		return nil, ErrInvalidCallerSignature
+	}
+	sig := []byte(header.Get(CallerSignatureHeader))
+	if !hmac.Equal(sig, []byte(CallerSignature(c.CallbackSecret, timestamp, body))) {
+		return nil, ErrInvalidCallerSignature
+	}
+
+	args = &CallCallbackArgs{}
+	err = json.Unmarshal(body, args)
+	if err != nil || args.CallId == "" {
+		return nil, ErrInvalidCallerCallback
+	}
+	return
+}
+
+type callTarget struct {
+	staff Staff
+	phone string
+	layer int
+}
+
+// 一个告警的一次呼叫，依次呼叫时 next 是下一个要呼叫的号码，分层呼叫时 layer 是下一个要呼叫的层级，round 是已经重拨的次数
+type callSession struct {
+	alert    *Alert
+	layers   [][]Staff
+	targets  []callTarget
+	next     int
+	layer    int
+	round    int
+	answered bool
+	acked    bool // 已经有人按键 ack 过
+	retry    int
+	recall   bool
+	active   bool // 开始呼叫时告警是否是活跃的，测试告警等不是活跃的告警不检查 ack、恢复
+	test     bool // 测试告警的呼叫，未接听时不呼叫下一个人，按键时不 ack
+	startAt  time.Time
+	records  []*callRecord
+}
+
+type callRecord struct {
+	session *callSession
+	target  callTarget
+	callId  string
+	status  CallStatus
+	callAt  time.Time
+}
+
+func (c *Caller) newSession(a *Alert, layers [][]Staff) *callSession {
+	s := &callSession{alert: a, layers: layers, startAt: time.Now()}
+	if c.getAlertF != nil {
+		_, s.active = c.getAlertF(a.Id.Hex())
+	}
+	for i, staffs := range layers {
+		for _, staff := range staffs {
+			for _, phone := range staff.Phones {
+				s.targets = append(s.targets, callTarget{staff: staff, phone: phone, layer: i})
+			}
+		}
+	}
+	c.callMutex.Lock()
+	c.sessions[a.Id.Hex()] = s
+	c.callMutex.Unlock()
+	return s
+}
+
+// s 为空时不检查是否为最近一次的呼叫
+func (c *Caller) endSession(id string, s *callSession) {
+	c.callMutex.Lock()
+	defer c.callMutex.Unlock()
+	if s == nil || c.sessions[id] == s {
+		delete(c.sessions, id)
+	}
+}
+
+// 告警最近一次的呼叫是否有人接听
+func (c *Caller) Answered(id string) bool {
+	c.callMutex.Lock()
+	defer c.callMutex.Unlock()
+	s, ok := c.sessions[id]
+	return ok && s.answered
+}
+
+// 呼叫下一个号码，呼叫失败时继续呼叫下一个，都呼叫过之后等待 RecallIntervals 再从头开始
+func (c *Caller) callNext(xl *xlog.Logger, s *callSession) (err error) {
+	for {
+		c.callMutex.Lock()
+		if s.answered {
+			c.callMutex.Unlock()
+			return
+		}
+		if s.next >= len(s.targets) {
+			c.callMutex.Unlock()
+			c.recallLater(xl, s)
+			return
+		}
+		t := s.targets[s.next]
+		s.next++
+		c.callMutex.Unlock()
+
+		err = c.call(xl, s, t)
+		if err == nil {
+			return
 		}
 	}
-	for _, phone := range phones {
-		param := SendSmsIn{
-			Uid:         c.MorseUid,
-			PhoneNumber: phone,
-			Message:     msg, // 由于 morse api 的限制，这边只能填死
+}
+
+// 同时呼叫下一层的所有号码，等待 LayerWait 之后没有人接听也没有 ack 告警时呼叫下一层，
+// 这一层都呼叫失败时直接呼叫下一层，都呼叫过之后等待 RecallIntervals 再从第一层开始
+func (c *Caller) callLayer(xl *xlog.Logger, s *callSession) (err error) {
+	for {
+		if c.stopped(s) {
+			c.endSession(s.alert.Id.Hex(), s)
+			return
 		}
-		oid, err1 := c.morse.SendVoiceSms(xl, param)
-		if err1 != nil {
-			errMsg := fmt.Sprintf("Caller.SendVoiceSms param: %#v, Error: %v", param, err1)
-			xl.Errorf(errMsg)
-			c.notifyErr(xl, errMsg)
-			err = err1
-			continue
+		c.callMutex.Lock()
+		if s.layer >= len(s.layers) {
+			c.callMutex.Unlock()
+			c.recallLater(xl, s)
+			return
+		}
+		layer := s.layer
+		s.layer++
+		c.callMutex.Unlock()
+
+		called := false
+		for _, t := range s.targets {
+			if t.layer != layer {
+				continue
+			}
+			err1 := c.call(xl, s, t)
+			if err1 != nil {
+				err = err1
+				continue
+			}
+			called = true
+		}
+		if called {
+			err = nil
+			break
+		}
+	}
+
+	id := s.alert.Id.Hex()
+	time.AfterFunc(time.Duration(c.LayerWait)*time.Second, func() {
+		c.callMutex.Lock()
+		current := c.sessions[id] == s
+		c.callMutex.Unlock()
+		if current {
+			c.callLayer(xl, s)
+		}
+	})
+	return
+}
+
+// 有人接听，或者告警已经 ack、恢复
+func (c *Caller) stopped(s *callSession) bool {
+	c.callMutex.Lock()
+	answered := s.answered
+	c.callMutex.Unlock()
+	if answered || !s.active {
+		return answered
+	}
+	a, ok := c.getAlertF(s.alert.Id.Hex())
+	return !ok || a.Status == AlertAcked
+}
+
+func (c *Caller) recallLater(xl *xlog.Logger, s *callSession) {
+	id := s.alert.Id.Hex()
+	c.callMutex.Lock()
+	if s.round >= c.RecallTimes {
+		c.callMutex.Unlock()
+		c.endSession(id, s)
+		return
+	}
+	s.round++
+	c.callMutex.Unlock()
+
+	time.AfterFunc(time.Duration(c.RecallIntervals)*time.Second, func() {
+		c.callMutex.Lock()
+		if c.sessions[id] != s || s.answered {
+			c.callMutex.Unlock()
+			return
+		}
+		s.next = 0
+		s.layer = 0
+		c.callMutex.Unlock()
+		if c.Layered {
+			c.callLayer(xl, s)
+		} else {
+			c.callNext(xl, s)
+		}
+	})
+}
+
+// 接听或者按键之后不再重拨，按键时以接听人的名字 ack 告警，依次呼叫时未接听则呼叫下一个人
+func (c *Caller) Callback(xl *xlog.Logger, args *CallCallbackArgs) (err error) {
+	c.callMutex.Lock()
+	rec, ok := c.calls[args.CallId]
+	if !ok {
+		c.callMutex.Unlock()
+		return ErrCallNotFound
+	}
+	s := rec.session
+	if args.Status != "" {
+		rec.status = args.Status
+	}
+	next := false
+	switch args.Status {
+	case CallAnswered:
+		s.answered = true
+	case CallCompleted:
+		s.answered = true
+		delete(c.calls, args.CallId)
+	case CallNoAnswer, CallBusy, CallFailed:
+		delete(c.calls, args.CallId)
+		next = c.WaitCallback && !c.Layered && !s.answered && !s.test
+	}
+	if args.Digits != "" {
+		s.answered = true
+	}
+	// 同一次呼叫只 ack 一次，一层中多个人同时按键、语音服务重试回调时不重复 ack
+	ack := args.Digits != "" && !s.acked && !s.test
+	if ack {
+		s.acked = true
+	}
+	c.callMutex.Unlock()
+
+	a := s.alert
+	ev := NewEvent(EventCalled, a)
+	ev.Username = rec.target.staff.Name
+	ev.Detail = fmt.Sprintf("%v %v", rec.target.phone, args.Status)
+	c.events.Record(xl, ev)
+	c.callLogs.UpdateStatus(xl, args.CallId, args.Status)
+
+	if ack && c.ackF != nil && c.firing(a) {
+		err = c.ackF(xl, &AlertsAckArgs{
+			Ids:      []string{a.Id.Hex()},
+			Comment:  DefaultCallerAckComment,
+			Username: rec.target.staff.Name,
+		})
+		if err != nil {
+			xl.Errorf("Caller.Callback ack alert %v err: %v", a.Id.Hex(), err)
+			return
 		}
-		xl.Infof("SendVoiceSms to %v success, Oid is %v", phone, oid)
+	}
+	if s.answered && (c.WaitCallback || c.Layered) {
+		c.endSession(a.Id.Hex(), s)
+	}
+	if next {
+		go c.callNext(xl, s)
 	}
 	return
 }
 
+// ========================================
+// 呼叫链
+
+type CallState struct {
+	CallId string     `json:"callId"`
+	Staff  string     `json:"staff"`
+	Phone  string     `json:"phone"`
+	Layer  int        `json:"layer"`
+	Status CallStatus `json:"status"`
+	CallAt time.Time  `json:"callAt"`
+}
+
+// 一个告警正在进行中的呼叫，Layer 是下一个要呼叫的层级，Round 是已经重拨的次数
+type CallChain struct {
+	AlertId     string      `json:"alertId"`
+	Description string      `json:"description"`
+	Layers      [][]string  `json:"layers"`
+	Layer       int         `json:"layer"`
+	Round       int         `json:"round"`
+	Answered    bool        `json:"answered"`
+	StartAt     time.Time   `json:"startAt"`
+	Calls       []CallState `json:"calls"`
+}
+
+func (s *callSession) chain() CallChain {
+	ch := CallChain{
+		AlertId:     s.alert.Id.Hex(),
+		Description: s.alert.Description,
+		Layers:      make([][]string, 0, len(s.layers)),
+		Layer:       s.layer,
+		Round:       s.round,
+		Answered:    s.answered,
+		StartAt:     s.startAt,
+		Calls:       make([]CallState, 0, len(s.records)),
+	}
+	for _, staffs := range s.layers {
+		names := make([]string, 0, len(staffs))
+		for _, staff := range staffs {
+			names = append(names, staff.Name)
+		}
+		ch.Layers = append(ch.Layers, names)
+	}
+	for _, rec := range s.records {
+		ch.Calls = append(ch.Calls, CallState{
+			CallId: rec.callId,
+			Staff:  rec.target.staff.Name,
+			Phone:  rec.target.phone,
+			Layer:  rec.target.layer,
+			Status: rec.status,
+			CallAt: rec.callAt,
+		})
+	}
+	return ch
+}
+
+type chainsByStartAt []CallChain
+
+func (s chainsByStartAt) Len() int {
+	return len(s)
+}
+
+func (s chainsByStartAt) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (s chainsByStartAt) Less(i, j int) bool {
+	return s[i].StartAt.Before(s[j].StartAt)
+}
+
+// 按开始呼叫的时间排序
+func (c *Caller) Chains() []CallChain {
+	c.callMutex.Lock()
+	defer c.callMutex.Unlock()
+
+	chains := make([]CallChain, 0, len(c.sessions))
+	for _, s := range c.sessions {
+		chains = append(chains, s.chain())
+	}
+	sort.Sort(chainsByStartAt(chains))
+	return chains
+}
+
+func (c *Caller) Chain(id string) (ch CallChain, ok bool) {
+	c.callMutex.Lock()
+	defer c.callMutex.Unlock()
+
+	s, ok := c.sessions[id]
+	if !ok {
+		return
+	}
+	return s.chain(), true
+}
+
+// 告警已经通过 slack、portal 等 ack 或者已经恢复时不再 ack，getAlertF 为空时不检查
+func (c *Caller) firing(a *Alert) bool {
+	if c.getAlertF == nil {
+		return true
+	}
+	aa, ok := c.getAlertF(a.Id.Hex())
+	return ok && aa.Status == AlertFiring
+}
+
+func (c *Caller) CallbackTwilio(xl *xlog.Logger, header http.Header, form url.Values) (twiml string, err error) {
+	if c.twilio == nil {
+		return "", ErrTwilioNotConfigured
+	}
+	args, err := c.twilio.ParseCallback(header, form)
+	if err != nil {
+		return
+	}
+	err = c.Callback(xl, args)
+	if err != nil || args.Digits == "" {
+		return
+	}
+	return c.twilio.AckTwiml(), nil
+}
+
+// 超时之后不再等待回调，开启 wait_callback 时视为未接听
+func (c *Caller) callbackTimeout(xl *xlog.Logger, callId string) {
+	c.callMutex.Lock()
+	_, ok := c.calls[callId]
+	if ok && !c.WaitCallback {
+		delete(c.calls, callId)
+	}
+	c.callMutex.Unlock()
+	if ok && c.WaitCallback {
+		c.Callback(xl, &CallCallbackArgs{CallId: callId, Status: CallNoAnswer})
+	}
+}
+
 func (c *Caller) notifyErr(xl *xlog.Logger, errMsg string) {
 	as := []*Alert{
 		{
@@ -5,11 +5,15 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/qiniu/log.v1"
 	"github.com/qiniu/xlog.v1"
 	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
 	"qbox.us/api/message"
 	"qbox.us/oauth"
 )
@@ -98,7 +102,7 @@ func TestCaller(t *testing.T) {
 
 	dutyMgr := &FakeDutyMgr{}
 
-	caller := NewCaller(cfg, dutyMgr, nil)
+	caller := NewCaller(cfg, dutyMgr, nil, nil)
 
 	// // 换 Token
 	// ast.Equal(caller.Token.AccessToken, testCallerToken, "AccessToken should be same")
@@ -119,13 +123,14 @@ func TestCaller(t *testing.T) {
 
 	caller.CallIntervals = 0
 
-	// 模拟Silence时间内发送告警, 不会打电话
-	caller.Silence(xl, 0, daySeconds-1)
+	// 模拟QuietHours时间内发送告警, 不会打电话
+	q := &QuietHour{StartAt: "00:00", EndAt: "00:00"}
+	ast.NoError(caller.CreateQuietHour(xl, q))
 	msg.Alerts[0].Description = "333333"
 	caller.Notify(msg)
 
-	// 重置Silence功能，Silence功能失效
-	caller.UnsetSilence(xl)
+	// 删除QuietHours，QuietHours功能失效
+	ast.NoError(caller.RemoveQuietHour(xl, q.Id))
 
 	// 模拟从现在开始到8888秒后暂时关闭打电话功能，不会打电话
 	caller.TempClose(xl, 8888)
@@ -143,6 +148,231 @@ func TestCaller(t *testing.T) {
 	ast.Equal(2, receiceIdx, "just receive two calls")
 }
 
+type fakeStaffsDutyMgr struct {
+	FakeDutyMgr
+	staffs []Staff
+	layers [][]Staff
+}
+
+func (f *fakeStaffsDutyMgr) GetCurrent(xl *xlog.Logger) ([]Staff, error) {
+	return f.staffs, nil
+}
+
+func (f *fakeStaffsDutyMgr) GetCurrentLayers(xl *xlog.Logger) ([][]Staff, error) {
+	return f.layers, nil
+}
+
+func fakeCalls(v *FakeVoice) []FakeCall {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return append([]FakeCall{}, v.Calls...)
+}
+
+func TestCallerCallback(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+	defer os.Remove(testCallerFilePath)
+
+	dutyMgr := &fakeStaffsDutyMgr{staffs: []Staff{
+		{Name: "A", Phones: []string{"1"}},
+		{Name: "B", Phones: []string{"2"}},
+	}}
+	cfg := CallerCfg{
+		FilePath:      testCallerFilePath,
+		CallIntervals: 1,
+		VoiceProvider: VoiceFake,
+		WaitCallback:  true,
+	}
+	caller := NewCaller(cfg, dutyMgr, func(Message) {}, nil)
+	var acked *AlertsAckArgs
+	ackCnt := 0
+	caller.ackF = func(xl *xlog.Logger, args *AlertsAckArgs) error {
+		acked = args
+		ackCnt++
+		return nil
+	}
+	voice := caller.voice.(*FakeVoice)
+
+	// 依次呼叫，先只打给第一个人
+	a := &Alert{Id: bson.NewObjectId(), Alertname: "test", Status: AlertFiring}
+	ast.NoError(caller.Notify(NewMessage(xl, a)))
+	ast.Equal([]FakeCall{{Phone: "1", AlertId: a.Id.Hex()}}, fakeCalls(voice))
+
+	// 未接听，呼叫下一个人
+	ast.NoError(caller.Callback(xl, &CallCallbackArgs{CallId: "1", Status: CallNoAnswer}))
+	time.Sleep(20 * time.Millisecond)
+	ast.Equal(2, len(fakeCalls(voice)))
+	ast.Equal("2", fakeCalls(voice)[1].Phone)
+
+	// 按键 ack，不再呼叫
+	ast.NoError(caller.Callback(xl, &CallCallbackArgs{CallId: "2", Status: CallAnswered, Digits: "1"}))
+	ast.Equal(&AlertsAckArgs{Ids: []string{a.Id.Hex()}, Comment: DefaultCallerAckComment, Username: "B"}, acked)
+	// 语音服务重试回调时不重复 ack
+	ast.NoError(caller.Callback(xl, &CallCallbackArgs{CallId: "2", Digits: "1"}))
+	ast.Equal(1, ackCnt)
+	ast.NoError(caller.Callback(xl, &CallCallbackArgs{CallId: "2", Status: CallCompleted}))
+	ast.Equal(2, len(fakeCalls(voice)))
+
+	// 已经结束的呼叫
+	ast.Equal(ErrCallNotFound, caller.Callback(xl, &CallCallbackArgs{CallId: "2", Status: CallCompleted}))
+
+	// 告警已经在 slack 上 ack 过，按键不再 ack
+	a2 := &Alert{Id: bson.NewObjectId(), Alertname: "test2", Status: AlertFiring}
+	caller.getAlertF = func(id string) (Alert, bool) {
+		return Alert{Id: a2.Id, Status: AlertAcked}, id == a2.Id.Hex()
+	}
+	ast.NoError(caller.Notify(NewMessage(xl, a2)))
+	ast.NoError(caller.Callback(xl, &CallCallbackArgs{CallId: "3", Status: CallAnswered, Digits: "1"}))
+	ast.Equal(1, ackCnt)
+}
+
+func TestCallerParseCallback(t *testing.T) {
+	ast := assert.New(t)
+	defer os.Remove(testCallerFilePath)
+
+	caller := NewCaller(CallerCfg{FilePath: testCallerFilePath, VoiceProvider: VoiceFake}, &FakeDutyMgr{}, func(Message) {}, nil)
+	now := time.Now()
+	body := []byte(`{"call_id":"1","status":"answered","digits":"1"}`)
+	header := http.Header{}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header.Set(CallerTimestampHeader, timestamp)
+	header.Set(CallerSignatureHeader, CallerSignature("secret", timestamp, body))
+
+	// 没有配置密钥时不接受回调
+	_, err := caller.ParseCallback(header, body, now)
+	ast.Equal(ErrCallerCallbackDisabled, err)
+
+	caller.CallbackSecret = "secret"
+	args, err := caller.ParseCallback(header, body, now)
+	ast.NoError(err)
+	ast.Equal(&CallCallbackArgs{CallId: "1", Status: CallAnswered, Digits: "1"}, args)
+
+	_, err = caller.ParseCallback(header, []byte(`{"call_id":"2","status":"answered","digits":"1"}`), now)
+	ast.Equal(ErrInvalidCallerSignature, err)
+	_, err = caller.ParseCallback(header, body, now.Add(CallerSignatureMaxAge+time.Minute))
+	ast.Equal(ErrInvalidCallerSignature, err)
+	_, err = caller.ParseCallback(http.Header{}, body, now)
+	ast.Equal(ErrInvalidCallerSignature, err)
+
+	body = []byte(`{"status":"answered"}`)
+	header.Set(CallerSignatureHeader, CallerSignature("secret", timestamp, body))
+	_, err = caller.ParseCallback(header, body, now)
+	ast.Equal(ErrInvalidCallerCallback, err)
+}
+
+func TestCallerEscalated(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+	defer os.Remove(testCallerFilePath)
+
+	cfg := CallerCfg{
+		FilePath:      testCallerFilePath,
+		CallIntervals: 60,
+		VoiceProvider: VoiceFake,
+	}
+	caller := NewCaller(cfg, &FakeDutyMgr{}, func(Message) {}, nil)
+	voice := caller.voice.(*FakeVoice)
+
+	a := &Alert{Id: bson.NewObjectId(), Alertname: "test", Status: AlertFiring}
+	ast.NoError(caller.Notify(NewMessage(xl, a)))
+	ast.NoError(caller.Notify(NewMessage(xl, a)))
+	ast.Equal(1, len(fakeCalls(voice)))
+
+	// 升级策略的呼叫不受 CallIntervals 限制
+	msg := NewMessage(xl, a)
+	msg.Escalated = true
+	ast.NoError(caller.Notify(msg))
+	ast.Equal(2, len(fakeCalls(voice)))
+}
+
+func TestCallerRecallAnswered(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+	defer os.Remove(testCallerFilePath)
+
+	cfg := CallerCfg{
+		FilePath:        testCallerFilePath,
+		CallIntervals:   1,
+		RecallTimes:     1,
+		RecallIntervals: 1,
+		VoiceProvider:   VoiceFake,
+	}
+	caller := NewCaller(cfg, &FakeDutyMgr{}, func(Message) {}, nil)
+	voice := caller.voice.(*FakeVoice)
+
+	a := &Alert{Id: bson.NewObjectId(), Alertname: "test", Status: AlertFiring}
+	ast.NoError(caller.Notify(NewMessage(xl, a)))
+	ast.Equal(1, len(fakeCalls(voice)))
+
+	// 接听之后不再重拨
+	ast.NoError(caller.Callback(xl, &CallCallbackArgs{CallId: "1", Status: CallAnswered}))
+	ast.True(caller.Answered(a.Id.Hex()))
+	time.Sleep(1100 * time.Millisecond)
+	ast.Equal(1, len(fakeCalls(voice)))
+	ast.False(caller.Answered(a.Id.Hex()))
+}
+
+func TestCallerLayers(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+	defer os.Remove(testCallerFilePath)
+
+	dutyMgr := &fakeStaffsDutyMgr{layers: [][]Staff{
+		{{Name: "A", Phones: []string{"1"}}},
+		{{Name: "B", Phones: []string{"2", "3"}}},
+		{{Name: "C", Phones: []string{"4"}}},
+	}}
+	cfg := CallerCfg{
+		FilePath:      testCallerFilePath,
+		CallIntervals: 1,
+		VoiceProvider: VoiceFake,
+		Layered:       true,
+		LayerWait:     1,
+	}
+	caller := NewCaller(cfg, dutyMgr, func(Message) {}, nil)
+	voice := caller.voice.(*FakeVoice)
+
+	a := &Alert{Id: bson.NewObjectId(), Alertname: "test", Status: AlertFiring}
+	var mutex sync.Mutex
+	active := *a
+	caller.getAlertF = func(id string) (Alert, bool) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return active, id == a.Id.Hex()
+	}
+
+	// 先只呼叫主值班
+	ast.NoError(caller.Notify(NewMessage(xl, a)))
+	ast.Equal([]FakeCall{{Phone: "1", AlertId: a.Id.Hex()}}, fakeCalls(voice))
+
+	// 未接听时不会马上呼叫下一层
+	ast.NoError(caller.Callback(xl, &CallCallbackArgs{CallId: "1", Status: CallNoAnswer}))
+	ch, ok := caller.Chain(a.Id.Hex())
+	ast.True(ok)
+	ast.Equal([][]string{{"A"}, {"B"}, {"C"}}, ch.Layers)
+	ast.Equal(1, ch.Layer)
+	ast.Equal(1, len(ch.Calls))
+	ast.Equal(CallNoAnswer, ch.Calls[0].Status)
+	ast.Equal(1, len(fakeCalls(voice)))
+
+	// 等待 LayerWait 之后同时呼叫副值班的所有号码
+	time.Sleep(1100 * time.Millisecond)
+	calls := fakeCalls(voice)
+	ast.Equal(3, len(calls))
+	ast.Equal("2", calls[1].Phone)
+	ast.Equal("3", calls[2].Phone)
+	ast.Equal(1, len(caller.Chains()))
+
+	// 告警被 ack 之后不再呼叫升级联系人
+	mutex.Lock()
+	active.Status = AlertAcked
+	mutex.Unlock()
+	time.Sleep(1100 * time.Millisecond)
+	ast.Equal(3, len(fakeCalls(voice)))
+	_, ok = caller.Chain(a.Id.Hex())
+	ast.False(ok)
+}
+
 // func TestRealCall(t *testing.T) {
 // 	caller := NewCaller(
 // 		CallerCfg{
@@ -156,3 +386,57 @@ func TestCaller(t *testing.T) {
 // 	)
 // 	caller.SendVoiceSms(xlog.NewDummy(), "testtest")
 // }
+
+func TestCallerNotifyTest(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+	defer os.Remove(testCallerFilePath)
+
+	dutyMgr := &fakeStaffsDutyMgr{layers: [][]Staff{
+		{{Name: "A", Phones: []string{"1"}}},
+		{{Name: "B", Phones: []string{"2"}}},
+	}}
+	cfg := CallerCfg{
+		FilePath:        testCallerFilePath,
+		CallIntervals:   3600,
+		VoiceProvider:   VoiceFake,
+		Layered:         true,
+		LayerWait:       1,
+		RecallTimes:     1,
+		RecallIntervals: 1,
+	}
+	caller := NewCaller(cfg, dutyMgr, func(Message) {}, nil)
+	voice := caller.voice.(*FakeVoice)
+	ackCnt := 0
+	caller.ackF = func(xl *xlog.Logger, args *AlertsAckArgs) error {
+		ackCnt++
+		return nil
+	}
+
+	// 只呼叫主值班一次，按键不 ack，之后也不呼叫下一层、不重拨
+	a := NewTestAlert("", "")
+	err, resolveErr := SendTestAlert(xl, &caller, a)
+	ast.NoError(err)
+	ast.NoError(resolveErr)
+	ast.Equal([]FakeCall{{Phone: "1", AlertId: a.Id.Hex()}}, fakeCalls(voice))
+	ast.Equal(0, len(caller.Chains()))
+	ast.NoError(caller.Callback(xl, &CallCallbackArgs{CallId: "1", Status: CallNoAnswer}))
+	time.Sleep(1100 * time.Millisecond)
+	ast.Equal(1, len(fakeCalls(voice)))
+	ast.Equal(0, ackCnt)
+
+	// 不影响 CallIntervals
+	ast.NoError(caller.Notify(NewMessage(xl, &Alert{Id: bson.NewObjectId(), Alertname: TestAlertname, Status: AlertFiring})))
+	ast.Equal(2, len(fakeCalls(voice)))
+
+	// 暂时关闭、quiet hours 内不呼叫并返回原因
+	caller.TempClose(xl, 60)
+	err, _ = SendTestAlert(xl, &caller, NewTestAlert("", ""))
+	ast.Equal(ErrCallInCloseTime, err)
+	caller.UnsetTempClose(xl)
+	q := &QuietHour{StartAt: "00:00", EndAt: "00:00"}
+	ast.NoError(caller.CreateQuietHour(xl, q))
+	err, _ = SendTestAlert(xl, &caller, NewTestAlert("", ""))
+	ast.Equal(ErrCallInQuietHours, err)
+	ast.Equal(2, len(fakeCalls(voice)))
+}
@@ -16,11 +16,18 @@ type Config struct {
 
 	NotifiersCfg    NotifiersCfg    `json:"notifiers_cfg"`
 	CallerCfg       CallerCfg       `json:"caller_cfg"`
+	SmsCfg          SmsCfg          `json:"sms_cfg"`
 	AlertActiveCfg  AlertActiveCfg  `json:"alert_active_cfg"`
 	HistoryCfg      HistoryCfg      `json:"history_cfg"`
 	AlertProfileCfg AlertProfileCfg `json:"alerts_profile_cfg"`
 	ReloadMgoOpt    pmgo.Option     `json:"reload_mgo_opt"`
 	DutyCfg         DutyCfg         `json:"duty_cfg"`
+	SilenceCfg      SilenceCfg      `json:"silence_cfg"`
+	InhibitCfg      InhibitCfg      `json:"inhibit_cfg"`
+	GroupCfg        GroupCfg        `json:"group_cfg"`
+	EventCfg        EventCfg        `json:"event_cfg"`
+	OutboxCfg       OutboxCfg       `json:"outbox_cfg"`
+	CallLogCfg      CallLogCfg      `json:"call_log_cfg"`
 	MsgBacklog      int             `json:"msg_backlog"`
 
 	AnalyzerCfgs []analyzer.Config `json:"jobs"`
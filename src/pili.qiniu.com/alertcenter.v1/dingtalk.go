@@ -0,0 +1,280 @@
+package alertcenter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	DefaultDingTalkUrl           = "https://oapi.dingtalk.com/robot/send"
+	DefaultDingTalkTimeLayout    = "2006-01-02 15:04:05"
+	DefaultDingTalkMaxDisplayCnt = 3
+	DefaultDingTalkTimeoutMS     = 10 * 1e3
+	DefaultDingTalkMoreText      = "更多告警请点我"
+
+	DingTalkMarkdown   = "markdown"
+	DingTalkActionCard = "actionCard"
+)
+
+type DingTalkCfg struct {
+	Name        string `json:"name"`
+	Url         string `json:"url"`
+	AccessToken string `json:"access_token"`
+	// 机器人安全设置中的加签密钥，为空时不签名
+	Secret string `json:"secret"`
+	// markdown 或者 actionCard，actionCard 不支持 @
+	MsgType    string `json:"msg_type"`
+	TimeLayout string `json:"time_layout"`
+	// 表示一条消息里最多可以装多少条告警
+	MaxDisplayCnt int `json:"max_display_count"`
+	// P0 告警时 @ 当前值班人员
+	AtOncall  bool   `json:"at_oncall"`
+	TimeoutMS int    `json:"timeout_ms"`
+	PortalUrl string `json:"portal_url"`
+
+	// 每个告警的 title、body、footer 模板，title 前面加上级别，footer 不为空时追加在 body 后面
+	Template TemplateCfg `json:"template"`
+}
+
+// markdown 列表，标题为描述和状态，紧急告警在最后加粗提示
+var DefaultDingTalkTemplate = TemplateCfg{
+	Title: `{{.Description}} | {{.Status}}`,
+	Body: `- [StartsAt] {{.StartsAt.Format .TimeLayout}}
+- ` + DefaultLeanAlertIdHeader + ` {{.Id.Hex}} ` + DefaultSlackAlertKeyHeader + ` {{.Key}}`,
+	Footer: `{{if .IsEmergent}}- **` + DefaultLeanChatEmergencyText + `**{{end}}`,
+}
+
+func (cfg *DingTalkCfg) Check() {
+	if cfg.Name == "" {
+		log.Panic("miss Name of dingTalkCfg")
+	}
+	if cfg.AccessToken == "" {
+		log.Panic("miss AccessToken of dingTalkCfg:", cfg.Name)
+	}
+	if cfg.Url == "" {
+		cfg.Url = DefaultDingTalkUrl
+	}
+	if cfg.MsgType == "" {
+		cfg.MsgType = DingTalkMarkdown
+	}
+	if cfg.MsgType != DingTalkMarkdown && cfg.MsgType != DingTalkActionCard {
+		log.Panic("unknown MsgType of dingTalkCfg:", cfg.MsgType)
+	}
+	if cfg.TimeLayout == "" {
+		cfg.TimeLayout = DefaultDingTalkTimeLayout
+	}
+	if cfg.MaxDisplayCnt == 0 {
+		cfg.MaxDisplayCnt = DefaultDingTalkMaxDisplayCnt
+	}
+	if cfg.TimeoutMS == 0 {
+		cfg.TimeoutMS = DefaultDingTalkTimeoutMS
+	}
+}
+
+type DingTalk struct {
+	*DingTalkCfg
+	dutyMgr DutyManager
+	cli     *http.Client
+	tmpl    *Templates
+}
+
+func NewDingTalk(cfg DingTalkCfg, dutyMgr DutyManager) *DingTalk {
+	cfg.Check()
+	return &DingTalk{
+		DingTalkCfg: &cfg,
+		dutyMgr:     dutyMgr,
+		cli:         &http.Client{Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond},
+		tmpl:        NewTemplates(cfg.Template, DefaultDingTalkTemplate),
+	}
+}
+
+func NewDingTalkColor(s Severity) string {
+	switch s {
+	case SeverityCritical, SeverityP0:
+		return "#FF0000"
+	case SeveritySuccess:
+		return "#008000"
+	default:
+		return "#FF9900"
+	}
+}
+
+type dingTalkMarkdown struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+type dingTalkActionCard struct {
+	Title          string `json:"title"`
+	Text           string `json:"text"`
+	BtnOrientation string `json:"btnOrientation"`
+	SingleTitle    string `json:"singleTitle,omitempty"`
+	SingleURL      string `json:"singleURL,omitempty"`
+}
+
+type dingTalkAt struct {
+	AtMobiles []string `json:"atMobiles,omitempty"`
+	IsAtAll   bool     `json:"isAtAll"`
+}
+
+type DingTalkReq struct {
+	MsgType    string              `json:"msgtype"`
+	Markdown   *dingTalkMarkdown   `json:"markdown,omitempty"`
+	ActionCard *dingTalkActionCard `json:"actionCard,omitempty"`
+	At         *dingTalkAt         `json:"at,omitempty"`
+}
+
+type dingTalkResp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (n *DingTalk) Name() string {
+	return n.DingTalkCfg.Name
+}
+
+func (n *DingTalk) Notify(msg Message) (err error) {
+	xl := msg.xl
+	if len(msg.Alerts) == 0 {
+		return
+	}
+	err = n.SendMsg(xl, n.GetReq(xl, msg))
+	return
+}
+
+func (n *DingTalk) Preview(msg Message) (interface{}, error) {
+	return n.GetReq(msg.xl, msg), nil
+}
+
+func (n *DingTalk) GetReq(xl *xlog.Logger, msg Message) *DingTalkReq {
+	title := n.GetTitle(msg.Alerts[0])
+	lines := make([]string, 0, len(msg.Alerts)+2)
+	for i, a := range msg.Alerts {
+		lines = append(lines, n.GetText(a))
+		if i == n.MaxDisplayCnt-1 {
+			break
+		}
+	}
+	if len(msg.Alerts) > n.MaxDisplayCnt {
+		lines = append(lines, n.GetMoreAlertsText(len(msg.Alerts)))
+	}
+
+	req := &DingTalkReq{MsgType: n.MsgType}
+	switch n.MsgType {
+	case DingTalkActionCard:
+		req.ActionCard = &dingTalkActionCard{
+			Title:          title,
+			Text:           strings.Join(lines, "\n\n"),
+			BtnOrientation: "0",
+		}
+		if n.PortalUrl != "" {
+			req.ActionCard.SingleTitle = "查看详情"
+			req.ActionCard.SingleURL = n.PortalUrl
+		}
+	default:
+		var mobiles []string
+		if n.AtOncall {
+			mobiles = oncallMobiles(xl, n.dutyMgr, msg.Alerts)
+		}
+		if len(mobiles) != 0 {
+			ats := make([]string, 0, len(mobiles))
+			for _, m := range mobiles {
+				ats = append(ats, "@"+m)
+			}
+			lines = append(lines, strings.Join(ats, " "))
+			req.At = &dingTalkAt{AtMobiles: mobiles}
+		}
+		req.Markdown = &dingTalkMarkdown{
+			Title: title,
+			Text:  strings.Join(lines, "\n\n"),
+		}
+	}
+	return req
+}
+
+func (n *DingTalk) SendMsg(xl *xlog.Logger, req *DingTalkReq) (err error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	resp, err := n.cli.Post(n.GetUrl(time.Now()), "application/json", bytes.NewReader(b))
+	if err != nil {
+		xl.Errorf("DingTalk Notify(msg) error: %+v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var res dingTalkResp
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		xl.Errorf("DingTalk decode resp, status: %v, err: %v", resp.StatusCode, err)
+		return
+	}
+	if res.ErrCode != 0 {
+		xl.Errorf("Req: %+v, Resp: %+v", req, res)
+		err = fmt.Errorf("%v %v", res.ErrCode, res.ErrMsg)
+	}
+	return
+}
+
+// 签名为 base64(HmacSHA256(secret, timestamp + "\n" + secret))，timestamp 为毫秒
+func (n *DingTalk) Sign(timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(n.Secret))
+	mac.Write([]byte(fmt.Sprintf("%d\n%s", timestamp, n.Secret)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (n *DingTalk) GetUrl(now time.Time) string {
+	q := url.Values{}
+	q.Set("access_token", n.AccessToken)
+	if n.Secret != "" {
+		timestamp := now.UnixNano() / int64(time.Millisecond)
+		q.Set("timestamp", strconv.FormatInt(timestamp, 10))
+		q.Set("sign", n.Sign(timestamp))
+	}
+	return n.Url + "?" + q.Encode()
+}
+
+func (n *DingTalk) templateData(a *Alert) *TemplateData {
+	return &TemplateData{
+		Alert:      a,
+		PortalUrl:  n.PortalUrl,
+		TimeLayout: n.TimeLayout,
+	}
+}
+
+func (n *DingTalk) GetTitle(a *Alert) string {
+	return n.tmpl.Execute(TemplateTitle, n.templateData(a))
+}
+
+func (n *DingTalk) GetText(a *Alert) string {
+	title := n.GetTitle(a)
+	if a.GeneratorURL != "" {
+		title = fmt.Sprintf("[%v](%v)", title, a.GeneratorURL)
+	}
+	s := fmt.Sprintf("### <font color=\"%v\">[%v]</font> %v\n", NewDingTalkColor(a.Severity), a.Severity, title)
+	s += n.tmpl.Execute(TemplateBody, n.templateData(a))
+	if footer := n.tmpl.Execute(TemplateFooter, n.templateData(a)); footer != "" {
+		s += "\n" + footer
+	}
+	return s
+}
+
+func (n *DingTalk) GetMoreAlertsText(cnt int) string {
+	if n.PortalUrl == "" {
+		return fmt.Sprintf("共有 %v 个告警", cnt)
+	}
+	return fmt.Sprintf("共有 %v 个告警 [%v](%v)", cnt, DefaultDingTalkMoreText, n.PortalUrl)
+}
@@ -0,0 +1,71 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestDingTalk(t *testing.T) {
+	ast := assert.New(t)
+
+	type request struct {
+		query url.Values
+		req   DingTalkReq
+	}
+	reqC := make(chan request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req DingTalkReq
+		ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+		reqC <- request{r.URL.Query(), req}
+		w.Write([]byte(`{"errcode": 0, "errmsg": "ok"}`))
+	}))
+	defer ts.Close()
+
+	n := NewDingTalk(DingTalkCfg{
+		Name:          "dingtalk",
+		Url:           ts.URL,
+		AccessToken:   "token",
+		Secret:        "SEC000",
+		MaxDisplayCnt: 1,
+		AtOncall:      true,
+	}, &FakeDutyMgr{})
+
+	// base64(HmacSHA256("SEC000", "1577836800000\nSEC000"))
+	ast.Equal("sLtiQUMv1vBmuenplUukSZ+QlhX/gyh/F0ARoP5z+TM=", n.Sign(1577836800000))
+
+	a1 := &Alert{Id: bson.NewObjectId(), Key: "key1", Description: "a1", Status: AlertFiring, Severity: SeverityP0}
+	a2 := &Alert{Id: bson.NewObjectId(), Key: "key2", Description: "a2", Status: AlertFiring, Severity: SeverityP1}
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a1, a2)))
+
+	r := <-reqC
+	ast.Equal("token", r.query.Get("access_token"))
+	ast.NotEqual("", r.query.Get("timestamp"))
+	ast.NotEqual("", r.query.Get("sign"))
+	ast.Equal(DingTalkMarkdown, r.req.MsgType)
+	ast.Equal("a1 | firing", r.req.Markdown.Title)
+	ast.Contains(r.req.Markdown.Text, "key1")
+	ast.NotContains(r.req.Markdown.Text, "key2")
+	ast.Contains(r.req.Markdown.Text, "共有 2 个告警")
+	ast.Contains(r.req.Markdown.Text, "@18650317419")
+	ast.Equal([]string{"18650317419"}, r.req.At.AtMobiles)
+
+	// P1 告警不 @ 值班人员
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a2)))
+	r = <-reqC
+	ast.Nil(r.req.At)
+
+	n.MsgType = DingTalkActionCard
+	n.PortalUrl = "http://portal"
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a1)))
+	r = <-reqC
+	ast.Equal(DingTalkActionCard, r.req.MsgType)
+	ast.Equal("http://portal", r.req.ActionCard.SingleURL)
+	ast.Nil(r.req.At)
+}
@@ -33,6 +33,7 @@ type DutyCfg struct {
 
 type DutyManager interface {
 	GetCurrent(xl *xlog.Logger) ([]Staff, error)
+	GetCurrentLayers(xl *xlog.Logger) ([][]Staff, error)
 
 	CreateStaff(arg *Staff) error
 	UpdateStaff(id bson.ObjectId, arg *UpdateStaffArg) error
@@ -74,29 +75,51 @@ func getIdxByUnit(staffCnt, startIdx int, unit time.Duration, now, begin time.Ti
 	return (unitElapsed%staffCnt + startIdx - 1) % staffCnt
 }
 
-func (d *DutyMgr) GetCurrent(xl *xlog.Logger) (staffs []Staff, err error) {
+// 按 priority 找到当前生效的排班，idx 是当前值班的 Staffs 下标，没有生效的排班时 r 为空
+func (d *DutyMgr) getCurrentRoster(now time.Time) (r *Roster, idx int, err error) {
 	rosters, err := d.ListRosters()
 	if err != nil {
 		return
 	}
 
-	for _, r := range rosters {
-		now := time.Now()
+	for i := range rosters {
+		r = &rosters[i]
 		if r.Begin.After(now) || r.End.Before(now) {
 			continue
 		}
 		switch r.Unit {
 		case UnitDay:
-			ids := r.Staffs[getIdxByUnit(len(r.Staffs), r.StartIdx, day, now, r.Begin)]
-			staffs, err = d.ListStaffs(ids)
-			return
+			idx = getIdxByUnit(len(r.Staffs), r.StartIdx, day, now, r.Begin)
 		case UnitWeek:
-			staffs, err = d.ListStaffs(r.Staffs[getIdxByUnit(len(r.Staffs), r.StartIdx, week, now, r.Begin)])
-			return
+			idx = getIdxByUnit(len(r.Staffs), r.StartIdx, week, now, r.Begin)
 		default:
 			err = errors.New("Unknown Unit")
-			return
 		}
+		return
+	}
+	return nil, 0, nil
+}
+
+func (d *DutyMgr) GetCurrent(xl *xlog.Logger) (staffs []Staff, err error) {
+	r, idx, err := d.getCurrentRoster(time.Now())
+	if err != nil || r == nil {
+		return
+	}
+	return d.ListStaffs(r.Staffs[idx])
+}
+
+// 依次为主值班、副值班（排班中的下一组）、排班的升级联系人，没有的层级不返回
+func (d *DutyMgr) GetCurrentLayers(xl *xlog.Logger) (layers [][]Staff, err error) {
+	r, idx, err := d.getCurrentRoster(time.Now())
+	if err != nil || r == nil {
+		return
+	}
+	for _, ids := range r.Layers(idx) {
+		staffs, err := d.ListStaffs(ids)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, staffs)
 	}
 	return
 }
@@ -203,6 +226,9 @@ type Roster struct {
 	StartIdx int               `bson:"startIdx" json:"startIdx"`
 	Priority int               `bson:"priority" json:"priority"` // The smaller the number the higher the priority
 	UpdateAt time.Time         `bson:"updateAt" json:"updateAt"`
+
+	Secondary          [][]bson.ObjectId `bson:"secondary" json:"secondary"`                   // 副值班，和 Staffs 一起轮换，当前值班为 Staffs[i] 时副值班为 Secondary[i%len(Secondary)]
+	EscalationContacts []bson.ObjectId   `bson:"escalationContacts" json:"escalationContacts"` // 主值班、副值班都没有接听时呼叫
 }
 
 func (s *Roster) Check() error {
@@ -229,9 +255,26 @@ func (s *Roster) Check() error {
 			return httputil.NewError(400, "empty Staffs")
 		}
 	}
+	for _, ss := range s.Secondary {
+		if len(ss) == 0 {
+			return httputil.NewError(400, "empty Secondary")
+		}
+	}
 	return nil
 }
 
+// 当前值班为 Staffs[idx] 时的呼叫层级，没有设置副值班、升级联系人时没有这一层
+func (s *Roster) Layers(idx int) (layers [][]bson.ObjectId) {
+	layers = append(layers, s.Staffs[idx])
+	if len(s.Secondary) > 0 {
+		layers = append(layers, s.Secondary[idx%len(s.Secondary)])
+	}
+	if len(s.EscalationContacts) > 0 {
+		layers = append(layers, s.EscalationContacts)
+	}
+	return
+}
+
 func (s *Roster) Normalize() {
 	s.Begin = s.Begin.Local()
 	s.End = s.End.Local()
@@ -267,6 +310,9 @@ type UpdateRosterArg struct {
 	StartIdx int               `bson:"startIdx" json:"startidx"`
 	Priority int               `bson:"priority" json:"priority"`
 	UpdateAt time.Time         `bson:"updateAt" json:"-"`
+
+	Secondary          [][]bson.ObjectId `bson:"secondary" json:"secondary"`
+	EscalationContacts []bson.ObjectId   `bson:"escalationContacts" json:"escalationContacts"`
 }
 
 func (s *UpdateRosterArg) Check() error {
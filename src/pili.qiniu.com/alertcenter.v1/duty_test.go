@@ -18,6 +18,10 @@ type FakeDutyMgr struct {
 func (f *FakeDutyMgr) GetCurrent(xl *xlog.Logger) ([]Staff, error) {
 	return []Staff{{Name: "1", Phones: []string{"18650317419"}}}, nil
 }
+func (f *FakeDutyMgr) GetCurrentLayers(xl *xlog.Logger) ([][]Staff, error) {
+	staffs, err := f.GetCurrent(xl)
+	return [][]Staff{staffs}, err
+}
 func (f *FakeDutyMgr) CreateStaff(arg *Staff) error                              { return nil }
 func (f *FakeDutyMgr) UpdateStaff(id bson.ObjectId, arg *UpdateStaffArg) error   { return nil }
 func (f *FakeDutyMgr) RemoveStaff(id bson.ObjectId) error                        { return nil }
@@ -185,3 +189,27 @@ func TestGetStaffs(t *testing.T) {
 		}
 	}
 }
+
+func TestRosterLayers(t *testing.T) {
+	ast := assert.New(t)
+
+	ids := []bson.ObjectId{bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()}
+	r := Roster{Staffs: [][]bson.ObjectId{{ids[0]}, {ids[1]}}}
+	// 没有设置副值班时只有主值班
+	ast.Equal([][]bson.ObjectId{{ids[0]}}, r.Layers(0))
+	ast.Equal([][]bson.ObjectId{{ids[1]}}, r.Layers(1))
+
+	r.Secondary = [][]bson.ObjectId{{ids[1]}, {ids[0]}}
+	ast.Equal([][]bson.ObjectId{{ids[0]}, {ids[1]}}, r.Layers(0))
+	ast.Equal([][]bson.ObjectId{{ids[1]}, {ids[0]}}, r.Layers(1))
+
+	r.EscalationContacts = []bson.ObjectId{ids[2]}
+	ast.Equal([][]bson.ObjectId{{ids[1]}, {ids[0]}, {ids[2]}}, r.Layers(1))
+
+	// 副值班和主值班的组数不同时按 idx 取模
+	r.Secondary = [][]bson.ObjectId{{ids[3]}}
+	ast.Equal([][]bson.ObjectId{{ids[1]}, {ids[3]}, {ids[2]}}, r.Layers(1))
+
+	r.Secondary = [][]bson.ObjectId{{}}
+	ast.Error(r.Check())
+}
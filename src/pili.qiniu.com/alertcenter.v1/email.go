@@ -0,0 +1,315 @@
+package alertcenter
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/qiniu/log.v1"
+)
+
+const (
+	DefaultEmailPort          = 25
+	DefaultEmailTimeoutMS     = 10 * 1e3
+	DefaultEmailSubjectPrefix = "[Alertcenter]"
+	DefaultEmailTimeLayout    = "2006-01-02 15:04:05"
+)
+
+// TLS 为 true 时使用 implicit TLS（一般是 465 端口），否则 StartTLS 为 true 时在明文连接上升级为 TLS（一般是 587 端口）
+type EmailCfg struct {
+	Name               string   `json:"name"`
+	Host               string   `json:"host"`
+	Port               int      `json:"port"`
+	TLS                bool     `json:"tls"`
+	StartTLS           bool     `json:"starttls"`
+	InsecureSkipVerify bool     `json:"insecure_skip_verify"`
+	Username           string   `json:"username"`
+	Password           string   `json:"password"`
+	From               string   `json:"from"`
+	To                 []string `json:"to"`
+	SubjectPrefix      string   `json:"subject_prefix"`
+	TimeLayout         string   `json:"time_layout"`
+	TimeoutMS          int      `json:"timeout_ms"`
+	PortalUrl          string   `json:"portal_url"`
+
+	// 每个告警的 title、body、footer 模板，输出为普通文本，HTML 邮件中会转义；
+	// title 后面加上状态，有 generatorURL 时 HTML 邮件中 title 为链接，第一个告警的 title 同时用于邮件主题
+	Template TemplateCfg `json:"template"`
+}
+
+// 邮件主题为告警描述，正文为开始时间，最后附上告警的 id 和 key
+var DefaultEmailTemplate = TemplateCfg{
+	Title:  `{{.Description}}`,
+	Body:   `[StartsAt] {{.StartsAt.Format .TimeLayout}}`,
+	Footer: DefaultLeanAlertIdHeader + ` {{.Id.Hex}} ` + DefaultSlackAlertKeyHeader + ` {{.Key}}`,
+}
+
+func (cfg *EmailCfg) Check() {
+	if cfg.Name == "" {
+		log.Panic("miss Name of emailCfg")
+	}
+	if cfg.Host == "" {
+		log.Panic("miss Host of emailCfg:", cfg.Name)
+	}
+	if cfg.From == "" {
+		log.Panic("miss From of emailCfg:", cfg.Name)
+	}
+	if len(cfg.To) == 0 {
+		log.Panic("miss To of emailCfg:", cfg.Name)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = DefaultEmailPort
+	}
+	if cfg.SubjectPrefix == "" {
+		cfg.SubjectPrefix = DefaultEmailSubjectPrefix
+	}
+	if cfg.TimeLayout == "" {
+		cfg.TimeLayout = DefaultEmailTimeLayout
+	}
+	if cfg.TimeoutMS == 0 {
+		cfg.TimeoutMS = DefaultEmailTimeoutMS
+	}
+}
+
+func NewEmailColor(s Severity) string {
+	switch s {
+	case SeverityCritical, SeverityP0:
+		return "#d50000"
+	case SeveritySuccess:
+		return "#2e7d32"
+	default:
+		return "#ff8f00"
+	}
+}
+
+type emailAlert struct {
+	*Alert
+	Color  string
+	Title  string
+	Body   string
+	Footer string
+}
+
+type emailData struct {
+	Title     string
+	Alerts    []emailAlert
+	PortalUrl string
+}
+
+const emailTextTmpl = `{{.Title}}
+{{range .Alerts}}
+[{{.Severity}}] {{.Title}} | {{.Status}}{{if .IsEmergent}} | 该告警被升级请赶紧处理告警{{end}}
+{{if .Body}}{{.Body}}
+{{end}}{{if .GeneratorURL}}{{.GeneratorURL}}
+{{end}}{{if .Footer}}{{.Footer}}
+{{end}}{{end}}{{if .PortalUrl}}
+{{.PortalUrl}}
+{{end}}`
+
+const emailHTMLTmpl = `<html><body>
+<h3>{{.Title}}</h3>
+{{range .Alerts}}<table style="width:100%;border-left:4px solid {{.Color}};margin-bottom:12px;padding-left:8px">
+<tr><td><b>{{if .GeneratorURL}}<a href="{{.GeneratorURL}}">{{.Title}}</a>{{else}}{{.Title}}{{end}}</b> | {{.Status}}{{if .IsEmergent}} | <span style="color:#d50000">该告警被升级请赶紧处理告警</span>{{end}}</td></tr>
+<tr><td>[Severity] {{.Severity}} {{.Body}}</td></tr>
+{{if .Footer}}<tr><td style="color:#888;font-size:12px">{{.Footer}}</td></tr>
+{{end}}
+</table>
+{{end}}{{if .PortalUrl}}<p><a href="{{.PortalUrl}}">{{.PortalUrl}}</a></p>{{end}}
+</body></html>`
+
+var (
+	emailText = template.Must(template.New("email.text").Parse(emailTextTmpl))
+	emailHTML = htmltemplate.Must(htmltemplate.New("email.html").Parse(emailHTMLTmpl))
+)
+
+type Email struct {
+	*EmailCfg
+	tmpl *Templates
+}
+
+func NewEmail(cfg EmailCfg) *Email {
+	cfg.Check()
+	return &Email{
+		EmailCfg: &cfg,
+		tmpl:     NewTemplates(cfg.Template, DefaultEmailTemplate),
+	}
+}
+
+func (n *Email) Name() string {
+	return n.EmailCfg.Name
+}
+
+func (n *Email) Notify(msg Message) (err error) {
+	xl := msg.xl
+	if len(msg.Alerts) == 0 {
+		return
+	}
+
+	b, err := n.Render(msg)
+	if err != nil {
+		xl.Errorf("Email %v render message err: %v", n.Name(), err)
+		return
+	}
+	err = n.send(b)
+	if err != nil {
+		xl.Errorf("Email %v send to %v err: %v", n.Name(), n.To, err)
+	}
+	return
+}
+
+func (n *Email) Preview(msg Message) (interface{}, error) {
+	b, err := n.Render(msg)
+	return string(b), err
+}
+
+func (n *Email) GetSubject(msg Message) string {
+	firing := 0
+	for _, a := range msg.Alerts {
+		if a.Status != AlertResolved {
+			firing++
+		}
+	}
+	subject := fmt.Sprintf("%v %v", n.SubjectPrefix, n.tmpl.Execute(TemplateTitle, n.templateData(msg.Alerts[0])))
+	if len(msg.Alerts) > 1 {
+		subject += fmt.Sprintf(" 等 %v 个告警", len(msg.Alerts))
+	}
+	if firing == 0 {
+		subject += " | resolved"
+	} else {
+		subject += fmt.Sprintf(" | %v firing", firing)
+	}
+	return subject
+}
+
+func (n *Email) templateData(a *Alert) *TemplateData {
+	return &TemplateData{
+		Alert:      a,
+		PortalUrl:  n.PortalUrl,
+		TimeLayout: n.TimeLayout,
+	}
+}
+
+// 生成包含纯文本和 HTML 两部分的邮件
+func (n *Email) Render(msg Message) (b []byte, err error) {
+	data := emailData{
+		Title:     n.GetSubject(msg),
+		Alerts:    make([]emailAlert, 0, len(msg.Alerts)),
+		PortalUrl: n.PortalUrl,
+	}
+	for _, a := range msg.Alerts {
+		data.Alerts = append(data.Alerts, emailAlert{
+			Alert:  a,
+			Color:  NewEmailColor(a.Severity),
+			Title:  n.tmpl.Execute(TemplateTitle, n.templateData(a)),
+			Body:   n.tmpl.Execute(TemplateBody, n.templateData(a)),
+			Footer: n.tmpl.Execute(TemplateFooter, n.templateData(a)),
+		})
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	header := []string{
+		"From: " + n.From,
+		"To: " + strings.Join(n.To, ", "),
+		"Subject: " + mime.QEncoding.Encode("utf-8", data.Title),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/alternative; boundary=" + mw.Boundary(),
+	}
+	buf.WriteString(strings.Join(header, "\r\n") + "\r\n\r\n")
+
+	w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=UTF-8"}})
+	if err != nil {
+		return
+	}
+	err = emailText.Execute(w, data)
+	if err != nil {
+		return
+	}
+	w, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=UTF-8"}})
+	if err != nil {
+		return
+	}
+	err = emailHTML.Execute(w, data)
+	if err != nil {
+		return
+	}
+	err = mw.Close()
+	return buf.Bytes(), err
+}
+
+func (n *Email) send(b []byte) (err error) {
+	addr := net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+	timeout := time.Duration(n.TimeoutMS) * time.Millisecond
+	tlsCfg := &tls.Config{ServerName: n.Host, InsecureSkipVerify: n.InsecureSkipVerify}
+
+	var conn net.Conn
+	if n.TLS {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsCfg)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c, err := smtp.NewClient(conn, n.Host)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer c.Close()
+
+	if n.StartTLS && !n.TLS {
+		err = c.StartTLS(tlsCfg)
+		if err != nil {
+			return
+		}
+	}
+	if n.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", n.Username, n.Password, n.Host))
+		if err != nil {
+			return
+		}
+	}
+	// From 可以是 "Name <addr>" 的形式
+	from := n.From
+	if a, err1 := mail.ParseAddress(n.From); err1 == nil {
+		from = a.Address
+	}
+	err = c.Mail(from)
+	if err != nil {
+		return
+	}
+	for _, to := range n.To {
+		err = c.Rcpt(to)
+		if err != nil {
+			return
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return
+	}
+	_, err = w.Write(b)
+	if err != nil {
+		return
+	}
+	err = w.Close()
+	if err != nil {
+		return
+	}
+	return c.Quit()
+}
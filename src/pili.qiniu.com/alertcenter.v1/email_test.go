@@ -0,0 +1,118 @@
+package alertcenter
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+type fakeSMTPMail struct {
+	from string
+	to   []string
+	data string
+}
+
+// 只实现发送一封邮件需要的命令
+func fakeSMTPServer(t *testing.T) (port int, mailC chan fakeSMTPMail, closeF func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mailC = make(chan fakeSMTPMail, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+				var m fakeSMTPMail
+				reply("220 localhost ESMTP")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimSpace(line)
+					cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+					switch cmd {
+					case "EHLO", "HELO":
+						reply("250 localhost")
+					case "MAIL":
+						m.from = strings.Trim(strings.TrimPrefix(line, "MAIL FROM:"), "<>")
+						reply("250 OK")
+					case "RCPT":
+						m.to = append(m.to, strings.Trim(strings.TrimPrefix(line, "RCPT TO:"), "<>"))
+						reply("250 OK")
+					case "DATA":
+						reply("354 go ahead")
+						var data []string
+						for {
+							l, err := r.ReadString('\n')
+							if err != nil {
+								return
+							}
+							if l == ".\r\n" {
+								break
+							}
+							data = append(data, l)
+						}
+						m.data = strings.Join(data, "")
+						mailC <- m
+						reply("250 OK")
+					case "QUIT":
+						reply("221 bye")
+						return
+					default:
+						reply("502 not implemented")
+					}
+				}
+			}(conn)
+		}
+	}()
+	port, _ = strconv.Atoi(strings.Split(l.Addr().String(), ":")[1])
+	return port, mailC, func() { l.Close() }
+}
+
+func TestEmail(t *testing.T) {
+	ast := assert.New(t)
+
+	port, mailC, closeF := fakeSMTPServer(t)
+	defer closeF()
+
+	n := NewEmail(EmailCfg{
+		Name: "email",
+		Host: "127.0.0.1",
+		Port: port,
+		From: "Alertcenter <alert@example.com>",
+		To:   []string{"ops@example.com", "dev@example.com"},
+	})
+
+	a1 := &Alert{Id: bson.NewObjectId(), Key: "key1", Description: "disk full", Status: AlertFiring, Severity: SeverityP0, GeneratorURL: "http://prom/graph"}
+	a2 := &Alert{Id: bson.NewObjectId(), Key: "key2", Description: "cpu <high>", Status: AlertResolved, Severity: SeveritySuccess}
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a1, a2)))
+
+	m := <-mailC
+	ast.Equal("alert@example.com", m.from)
+	ast.Equal([]string{"ops@example.com", "dev@example.com"}, m.to)
+	ast.Contains(m.data, "To: ops@example.com, dev@example.com")
+	ast.Contains(m.data, "multipart/alternative")
+	ast.Contains(m.data, "text/plain")
+	ast.Contains(m.data, "[AlertId] "+a1.Id.Hex()+" [Key] key1")
+	ast.Contains(m.data, `<a href="http://prom/graph">disk full</a>`)
+	ast.Contains(m.data, "cpu &lt;high&gt;")
+	ast.Contains(m.data, NewEmailColor(SeverityP0))
+	ast.Contains(m.data, NewEmailColor(SeveritySuccess))
+
+	ast.Equal("[Alertcenter] disk full 等 2 个告警 | 1 firing", n.GetSubject(NewMessage(nil, a1, a2)))
+	ast.Equal("[Alertcenter] cpu <high> | resolved", n.GetSubject(NewMessage(nil, a2)))
+}
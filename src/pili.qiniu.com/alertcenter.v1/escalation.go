@@ -0,0 +1,132 @@
+package alertcenter
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"labix.org/v2/mgo/bson"
+)
+
+// 告警开始 DelayS 秒后仍未被 ack 或者恢复，就通过 Notifiers 发送一次告警
+// Notifiers 中包含 caller 时，Staffs 为空则打给当前值班人员，否则打给 Staffs 中的人员
+type EscalationStep struct {
+	DelayS    int             `json:"delay_s" bson:"delayS"`
+	Notifiers []string        `json:"notifiers" bson:"notifiers"`
+	Staffs    []bson.ObjectId `json:"staffs" bson:"staffs"`
+}
+
+type EscalationPolicy struct {
+	Name  string           `json:"name"`
+	Steps []EscalationStep `json:"steps"`
+	// 所有步骤执行完后每隔多少秒重复执行最后一步，0 表示不重复
+	RepeatIntervalS int `json:"repeat_interval_s"`
+}
+
+func (p *EscalationPolicy) Check() {
+	if p.Name == "" {
+		log.Panic("miss Name of escalationPolicy")
+	}
+	if len(p.Steps) == 0 {
+		log.Panic("empty Steps of escalationPolicy:", p.Name)
+	}
+	for i, step := range p.Steps {
+		if len(step.Notifiers) == 0 {
+			log.Panic("empty Notifiers of escalationPolicy:", p.Name, "step:", i)
+		}
+		if i > 0 && step.DelayS < p.Steps[i-1].DelayS {
+			log.Panic("Steps of escalationPolicy should be sorted by delay_s:", p.Name)
+		}
+	}
+}
+
+// 记录在告警历史中的每一步升级
+type EscalationRecord struct {
+	Policy    string          `json:"policy" bson:"policy"`
+	Step      int             `json:"step" bson:"step"`
+	Notifiers []string        `json:"notifiers" bson:"notifiers"`
+	Staffs    []bson.ObjectId `json:"staffs,omitempty" bson:"staffs,omitempty"`
+	Time      time.Time       `json:"time" bson:"time"`
+}
+
+func (aam *AlertActiveMgr) escalationPolicy(alertname string) (p EscalationPolicy, ok bool) {
+	if len(aam.policies) == 0 || aam.historyMgr == nil || aam.historyMgr.alertProfileMgr == nil {
+		return
+	}
+	ap, ok := aam.historyMgr.alertProfileMgr.GetByCache(alertname)
+	if !ok || ap.EscalationPolicy == "" {
+		return p, false
+	}
+	p, ok = aam.policies[ap.EscalationPolicy]
+	if !ok {
+		log.Errorf("unknown escalation policy %v of alertname %v", ap.EscalationPolicy, alertname)
+	}
+	return
+}
+
+// 按照 policy 依次执行每一步，ack 或者恢复时通过 StopTickC 停止
+func (aam *AlertActiveMgr) doEscalation(aa *AlertActive, p EscalationPolicy) {
+	for aa.EscalationStep < len(p.Steps) {
+		step := p.Steps[aa.EscalationStep]
+		if d := time.Duration(step.DelayS)*time.Second - time.Now().Sub(aa.StartsAt); d > 0 {
+			select {
+			case <-aa.StopTickC:
+				return
+			case <-time.After(d):
+			}
+		}
+		aam.escalate(aa, p, aa.EscalationStep)
+		aa.EscalationStep++
+	}
+
+	if p.RepeatIntervalS <= 0 {
+		return
+	}
+	aa.Tick = time.NewTicker(time.Duration(p.RepeatIntervalS) * time.Second)
+	for {
+		select {
+		case <-aa.StopTickC:
+			aa.Tick.Stop()
+			return
+		case <-aa.Tick.C:
+			aam.escalate(aa, p, len(p.Steps)-1)
+		}
+	}
+}
+
+func (aam *AlertActiveMgr) escalate(aa *AlertActive, p EscalationPolicy, i int) {
+	step := p.Steps[i]
+	if i > 0 {
+		aa.IsEmergent = true
+	}
+	aa.xl.Infof("escalate alert %v(%v), policy: %v, step: %v", aa.Alertname, aa.Key, p.Name, i)
+
+	record := EscalationRecord{
+		Policy:    p.Name,
+		Step:      i,
+		Notifiers: step.Notifiers,
+		Staffs:    step.Staffs,
+		Time:      time.Now(),
+	}
+	// 记录在内存中的告警上，ack、恢复时通知这些 notifier
+	aam.mutex.Lock()
+	aa.Escalations = append(aa.Escalations, record)
+	aam.mutex.Unlock()
+
+	msg := NewMessage(aa.xl, aa.Alert)
+	msg.Notifiers = step.Notifiers
+	msg.Staffs = step.Staffs
+	msg.Escalated = true
+	// delay_s 为 0 的步骤和告警的通知同时发送，不再重复发送给已经通知过的 notifier
+	msg.SkipRouted = step.DelayS == 0
+	aam.f(msg)
+
+	ev := NewEvent(EventEscalated, aa.Alert)
+	ev.Detail = fmt.Sprintf("policy: %v, step: %v, notifiers: %v", p.Name, i, step.Notifiers)
+	aam.events.Record(aa.xl, ev)
+
+	err := aam.historyMgr.Escalate(aa.Id, record)
+	if err != nil {
+		aa.xl.Errorf("aam.historyMgr.Escalate id: %v, record: %v, err: %v", aa.Id, record, err)
+	}
+}
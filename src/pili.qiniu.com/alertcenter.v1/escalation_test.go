@@ -0,0 +1,87 @@
+package alertcenter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+
+	pmgo "pili.qiniu.com/mgo"
+)
+
+func TestEscalation(t *testing.T) {
+	log.Println("TestEscalation Begin")
+	defer log.Println("TestEscalation End")
+	defer clearTestDB()
+	xl := xlog.NewDummy()
+	ast := assert.New(t)
+
+	apMgr := &AlertProfileMgr{
+		cache: map[string]AlertProfile{
+			"test": {Alertname: "test", EscalationPolicy: "default"},
+		},
+	}
+	historyMgr := NewHistoryMgr(HistoryCfg{
+		MgoOpt: pmgo.Option{
+			MgoDB:   "test-alertcenter",
+			MgoColl: "history",
+		},
+	}, apMgr, nil)
+
+	manager := bson.NewObjectId()
+	sendC := make(chan Message, 10)
+	aam := &AlertActiveMgr{
+		AlertActiveCfg: &AlertActiveCfg{},
+		data:           make(map[string]*AlertActive),
+		f: func(msg Message) {
+			sendC <- msg
+		},
+		historyMgr: historyMgr,
+		policies: map[string]EscalationPolicy{
+			"default": {
+				Name: "default",
+				Steps: []EscalationStep{
+					{DelayS: 0, Notifiers: []string{"slack"}},
+					{DelayS: 1, Notifiers: []string{CallerName}, Staffs: []bson.ObjectId{manager}},
+					{DelayS: 60, Notifiers: []string{CallerName}},
+				},
+			},
+		},
+	}
+
+	a := &Alert{Alertname: "test", Status: AlertFiring, StartsAt: time.Now()}
+	ast.NoError(historyMgr.Create(xl, a))
+	ast.NoError(aam.Add(xl, a))
+
+	msg := <-sendC
+	ast.Equal([]string{"slack"}, msg.Notifiers)
+	ast.True(msg.Escalated)
+	ast.True(msg.SkipRouted)
+	ast.False(a.IsEmergent)
+
+	msg = <-sendC
+	ast.Equal([]string{CallerName}, msg.Notifiers)
+	ast.Equal([]bson.ObjectId{manager}, msg.Staffs)
+	ast.True(msg.Escalated)
+	ast.False(msg.SkipRouted)
+	ast.True(a.IsEmergent)
+
+	// ack 之后不再继续升级
+	ast.NoError(aam.Ack(xl, &AlertsAckArgs{Ids: []string{a.Id.Hex()}, Username: "test"}))
+	select {
+	case <-sendC:
+		ast.Fail("should not escalate after ack")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	var ret Alert
+	ast.NoError(historyMgr.mgo.Coll().FindId(a.Id).One(&ret))
+	ast.Equal(2, len(ret.Escalations))
+	// 内存中的告警也记录了升级步骤，用于发送 ack 和恢复通知
+	aa, ok := aam.GetById(a.Id.Hex())
+	ast.True(ok)
+	ast.Equal(2, len(aa.Escalations))
+}
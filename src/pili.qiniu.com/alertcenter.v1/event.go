@@ -0,0 +1,115 @@
+package alertcenter
+
+import (
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+
+	pmgo "pili.qiniu.com/mgo"
+)
+
+type EventType string
+
+const (
+	EventFired     EventType = "fired"
+	EventGrouped   EventType = "grouped"
+	EventNotified  EventType = "notified"
+	EventCalled    EventType = "called"
+	EventEscalated EventType = "escalated"
+	EventAcked     EventType = "acked"
+	EventResolved  EventType = "resolved"
+	EventDeleted   EventType = "deleted"
+)
+
+const (
+	EventResultSuccess = "success"
+)
+
+// 告警生命周期中的一个事件，只追加不修改
+type Event struct {
+	Id       bson.ObjectId `json:"id" bson:"_id"`
+	AlertId  bson.ObjectId `json:"alertId" bson:"alertId"`
+	Key      string        `json:"key" bson:"key"`
+	Type     EventType     `json:"type" bson:"type"`
+	Time     time.Time     `json:"time" bson:"time"`
+	ReqId    string        `json:"reqId" bson:"reqId"`
+	Notifier string        `json:"notifier,omitempty" bson:"notifier,omitempty"`
+	Username string        `json:"username,omitempty" bson:"username,omitempty"`
+	Result   string        `json:"result,omitempty" bson:"result,omitempty"` // success 或者错误信息
+	Detail   string        `json:"detail,omitempty" bson:"detail,omitempty"`
+}
+
+func NewEvent(typ EventType, a *Alert) Event {
+	return Event{
+		AlertId: a.Id,
+		Key:     a.Key,
+		Type:    typ,
+	}
+}
+
+func EventResult(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return EventResultSuccess
+}
+
+type EventCfg struct {
+	MgoOpt pmgo.Option `json:"mgo_opt"`
+}
+
+type EventMgr struct {
+	*EventCfg
+	mgo pmgo.Mongo
+}
+
+func NewEventMgr(cfg EventCfg) *EventMgr {
+	eventMgo, err := pmgo.New(cfg.MgoOpt)
+	if err != nil {
+		log.Panic("event: NewEventMgr pmgo.New(cfg.MgoOpt) err:", err)
+	}
+	err = eventMgo.Coll().EnsureIndex(mgo.Index{Key: []string{"alertId", "time"}})
+	if err != nil {
+		log.Panic("event: EnsureIndex(alertId, time) err:", err)
+	}
+	return &EventMgr{&cfg, eventMgo}
+}
+
+// em 为 nil 时不记录，方便单独使用各个模块
+// 没有合法 AlertId 的告警（比如打电话失败的通知）不记录
+func (em *EventMgr) Record(xl *xlog.Logger, evs ...Event) {
+	if em == nil {
+		return
+	}
+	now := time.Now()
+	docs := make([]interface{}, 0, len(evs))
+	for i := range evs {
+		if !evs[i].AlertId.Valid() {
+			continue
+		}
+		evs[i].Id = bson.NewObjectId()
+		if evs[i].Time.IsZero() {
+			evs[i].Time = now
+		}
+		evs[i].ReqId = xl.ReqId()
+		docs = append(docs, evs[i])
+	}
+	if len(docs) == 0 {
+		return
+	}
+	err := em.mgo.Coll().Insert(docs...)
+	if err != nil {
+		xl.Errorf("EventMgr.Record events: %v, err: %v", evs, err)
+	}
+}
+
+func (em *EventMgr) Timeline(alertId bson.ObjectId) (ret []Event, err error) {
+	err = em.mgo.Coll().Find(M{"alertId": alertId}).Sort("time", "_id").All(&ret)
+	if err == mgo.ErrNotFound {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,58 @@
+package alertcenter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+
+	pmgo "pili.qiniu.com/mgo"
+)
+
+func TestEventTimeline(t *testing.T) {
+	log.Println("TestEventTimeline Begin")
+	defer log.Println("TestEventTimeline End")
+	defer clearTestDB()
+	xl := xlog.NewDummy()
+	ast := assert.New(t)
+
+	// nil EventMgr 不记录
+	var em *EventMgr
+	em.Record(xl, Event{AlertId: bson.NewObjectId(), Type: EventFired})
+
+	em = NewEventMgr(EventCfg{
+		MgoOpt: pmgo.Option{
+			MgoDB:   "test-alertcenter",
+			MgoColl: "event",
+		},
+	})
+
+	a := &Alert{Id: bson.NewObjectId(), Key: "test"}
+	now := time.Now()
+	fired := NewEvent(EventFired, a)
+	fired.Time = now
+	notified := NewEvent(EventNotified, a)
+	notified.Time = now.Add(time.Second)
+	notified.Notifier = "slack"
+	notified.Result = EventResult(errors.New("timeout"))
+	acked := NewEvent(EventAcked, a)
+	acked.Time = now.Add(2 * time.Second)
+	acked.Username = "test"
+	em.Record(xl, acked, fired, notified)
+
+	// 没有 AlertId 的事件被忽略
+	em.Record(xl, NewEvent(EventCalled, &Alert{Key: "test"}))
+
+	evs, err := em.Timeline(a.Id)
+	ast.NoError(err)
+	ast.Equal(3, len(evs))
+	ast.Equal(EventFired, evs[0].Type)
+	ast.Equal(EventNotified, evs[1].Type)
+	ast.Equal("timeout", evs[1].Result)
+	ast.Equal(EventAcked, evs[2].Type)
+	ast.Equal("test", evs[2].Username)
+}
@@ -0,0 +1,495 @@
+package alertcenter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniu/http/httputil.v1"
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	DefaultFeishuTimeLayout    = "2006-01-02 15:04:05"
+	DefaultFeishuMaxDisplayCnt = 3
+	DefaultFeishuTimeoutMS     = 10 * 1e3
+	DefaultFeishuAckText       = "Ack"
+	DefaultFeishuAckComment    = "ack from feishu"
+	DefaultFeishuPortalAckText = "去 Portal Ack"
+	DefaultFeishuApiUrl        = "https://open.feishu.cn/open-apis"
+	// tenant_access_token 过期前多久重新获取
+	DefaultFeishuTokenRefreshAhead = 5 * time.Minute
+
+	FeishuCallbackUrlVerification = "url_verification"
+)
+
+var (
+	ErrInvalidFeishuToken  = httputil.NewError(http.StatusUnauthorized, "invalid feishu verification token")
+	ErrInvalidFeishuAction = httputil.NewError(400, "invalid feishu action")
+)
+
+// 飞书的自定义机器人只支持跳转链接的按钮，所以配置了 AppId 时通过应用机器人发送卡片消息到 ChatId，
+// 卡片上 Ack 按钮的回调需要在飞书应用中配置请求网址为 POST /feishu/callback；
+// 只配置了 WebhookUrl 时通过自定义机器人发送，Ack 按钮改为跳转到 PortalUrl。
+// 回调中只有点击用户的 open_id，通过 Users 映射为用户名，找不到时使用 open_id
+type FeishuCfg struct {
+	Name       string `json:"name"`
+	WebhookUrl string `json:"webhook_url"`
+	// 应用机器人
+	AppId     string `json:"app_id"`
+	AppSecret string `json:"app_secret"`
+	ChatId    string `json:"chat_id"`
+	ApiUrl    string `json:"api_url"`
+	// 机器人安全设置中的签名校验密钥，为空时不签名
+	Secret string `json:"secret"`
+	// 飞书应用的 Verification Token，用来校验回调请求
+	VerificationToken string            `json:"verification_token"`
+	Users             map[string]string `json:"users"`
+	TimeLayout        string            `json:"time_layout"`
+	// 表示一条消息里最多可以装多少条告警
+	MaxDisplayCnt int    `json:"max_display_count"`
+	TimeoutMS     int    `json:"timeout_ms"`
+	PortalUrl     string `json:"portal_url"`
+
+	// 只有一个告警时卡片标题为级别加上 title，多个告警时为第一个告警的描述和告警个数；
+	// 每个告警的 body 为 lark_md 格式，footer 不为空时追加在 body 后面
+	Template TemplateCfg `json:"template"`
+}
+
+// 卡片标题为描述和状态，正文加粗描述后列出开始时间、id 和 key，紧急告警在最后加粗提示
+var DefaultFeishuTemplate = TemplateCfg{
+	Title: `{{.Description}} | {{.Status}}`,
+	Body: `**{{.Description}}** | {{.Status}}
+[StartsAt] {{.StartsAt.Format .TimeLayout}}
+` + DefaultLeanAlertIdHeader + ` {{.Id.Hex}} ` + DefaultSlackAlertKeyHeader + ` {{.Key}}`,
+	Footer: `{{if .IsEmergent}}**` + DefaultLeanChatEmergencyText + `**{{end}}`,
+}
+
+func (cfg *FeishuCfg) Check() {
+	if cfg.Name == "" {
+		log.Panic("miss Name of feishuCfg")
+	}
+	if cfg.AppId != "" {
+		if cfg.AppSecret == "" {
+			log.Panic("miss AppSecret of feishuCfg:", cfg.Name)
+		}
+		if cfg.ChatId == "" {
+			log.Panic("miss ChatId of feishuCfg:", cfg.Name)
+		}
+		if cfg.ApiUrl == "" {
+			cfg.ApiUrl = DefaultFeishuApiUrl
+		}
+		cfg.ApiUrl = strings.TrimSuffix(cfg.ApiUrl, "/")
+	} else if cfg.WebhookUrl == "" {
+		log.Panic("miss WebhookUrl of feishuCfg:", cfg.Name)
+	}
+	if cfg.TimeLayout == "" {
+		cfg.TimeLayout = DefaultFeishuTimeLayout
+	}
+	if cfg.MaxDisplayCnt == 0 {
+		cfg.MaxDisplayCnt = DefaultFeishuMaxDisplayCnt
+	}
+	if cfg.TimeoutMS == 0 {
+		cfg.TimeoutMS = DefaultFeishuTimeoutMS
+	}
+}
+
+type Feishu struct {
+	*FeishuCfg
+	cli  *http.Client
+	tmpl *Templates
+
+	mutex         sync.Mutex
+	token         string
+	tokenExpireAt time.Time
+}
+
+func NewFeishu(cfg FeishuCfg) *Feishu {
+	cfg.Check()
+	return &Feishu{
+		FeishuCfg: &cfg,
+		cli:       &http.Client{Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond},
+		tmpl:      NewTemplates(cfg.Template, DefaultFeishuTemplate),
+	}
+}
+
+// 卡片标题的颜色
+func NewFeishuColor(s Severity) string {
+	switch s {
+	case SeverityCritical, SeverityP0:
+		return "red"
+	case SeveritySuccess:
+		return "green"
+	default:
+		return "orange"
+	}
+}
+
+type feishuText struct {
+	Tag     string `json:"tag"`
+	Content string `json:"content"`
+}
+
+type feishuField struct {
+	IsShort bool       `json:"is_short"`
+	Text    feishuText `json:"text"`
+}
+
+type feishuAction struct {
+	Tag   string            `json:"tag"`
+	Text  feishuText        `json:"text"`
+	Url   string            `json:"url,omitempty"`
+	Type  string            `json:"type,omitempty"`
+	Value map[string]string `json:"value,omitempty"`
+}
+
+type feishuElement struct {
+	Tag     string         `json:"tag"`
+	Text    *feishuText    `json:"text,omitempty"`
+	Fields  []feishuField  `json:"fields,omitempty"`
+	Actions []feishuAction `json:"actions,omitempty"`
+}
+
+type feishuCard struct {
+	Config struct {
+		WideScreenMode bool `json:"wide_screen_mode"`
+	} `json:"config"`
+	Header struct {
+		Title    feishuText `json:"title"`
+		Template string     `json:"template"`
+	} `json:"header"`
+	Elements []feishuElement `json:"elements"`
+}
+
+type FeishuReq struct {
+	Timestamp string     `json:"timestamp,omitempty"`
+	Sign      string     `json:"sign,omitempty"`
+	MsgType   string     `json:"msg_type"`
+	Card      feishuCard `json:"card"`
+}
+
+type feishuResp struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+	// 老版本接口返回 StatusCode
+	StatusCode int `json:"StatusCode"`
+}
+
+func (n *Feishu) Name() string {
+	return n.FeishuCfg.Name
+}
+
+func (n *Feishu) Notify(msg Message) (err error) {
+	xl := msg.xl
+	if len(msg.Alerts) == 0 {
+		return
+	}
+	err = n.SendMsg(xl, n.GetReq(msg))
+	return
+}
+
+func (n *Feishu) Preview(msg Message) (interface{}, error) {
+	return n.GetReq(msg), nil
+}
+
+func (n *Feishu) GetReq(msg Message) *FeishuReq {
+	req := &FeishuReq{MsgType: "interactive"}
+	card := &req.Card
+	card.Config.WideScreenMode = true
+	card.Header.Title = feishuText{"plain_text", n.GetTitle(msg)}
+	card.Header.Template = NewFeishuColor(msg.Alerts[0].Severity)
+	for i, a := range msg.Alerts {
+		if i != 0 {
+			card.Elements = append(card.Elements, feishuElement{Tag: "hr"})
+		}
+		card.Elements = append(card.Elements, n.GetElements(a)...)
+		if i == n.MaxDisplayCnt-1 {
+			break
+		}
+	}
+	if len(msg.Alerts) > n.MaxDisplayCnt {
+		text := fmt.Sprintf("共有 %v 个告警", len(msg.Alerts))
+		if n.PortalUrl != "" {
+			text += fmt.Sprintf(" [%v](%v)", DefaultSlackMoreAlertsText, n.PortalUrl)
+		}
+		card.Elements = append(card.Elements, feishuElement{Tag: "div", Text: &feishuText{"lark_md", text}})
+	}
+	return req
+}
+
+func (n *Feishu) GetTitle(msg Message) string {
+	a := msg.Alerts[0]
+	if len(msg.Alerts) > 1 {
+		return fmt.Sprintf("[%v] %v 等 %v 个告警", a.Severity, a.Description, len(msg.Alerts))
+	}
+	return fmt.Sprintf("[%v] %v", a.Severity, n.tmpl.Execute(TemplateTitle, n.templateData(a)))
+}
+
+func (n *Feishu) templateData(a *Alert) *TemplateData {
+	return &TemplateData{
+		Alert:      a,
+		PortalUrl:  n.PortalUrl,
+		TimeLayout: n.TimeLayout,
+	}
+}
+
+// 每个告警包含描述、label 字段和按钮
+func (n *Feishu) GetElements(a *Alert) []feishuElement {
+	content := n.tmpl.Execute(TemplateBody, n.templateData(a))
+	if footer := n.tmpl.Execute(TemplateFooter, n.templateData(a)); footer != "" {
+		content += "\n" + footer
+	}
+	div := feishuElement{Tag: "div", Text: &feishuText{"lark_md", content}}
+
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		div.Fields = append(div.Fields, feishuField{
+			IsShort: true,
+			Text:    feishuText{"lark_md", fmt.Sprintf("**%v**\n%v", k, a.Labels[k])},
+		})
+	}
+
+	var actions []feishuAction
+	if a.GeneratorURL != "" {
+		actions = append(actions, feishuAction{
+			Tag:  "button",
+			Text: feishuText{"plain_text", "查看详情"},
+			Url:  a.GeneratorURL,
+			Type: "default",
+		})
+	}
+	for _, t := range a.AnalyzerTypes {
+		actions = append(actions, feishuAction{
+			Tag:  "button",
+			Text: feishuText{"plain_text", fmt.Sprintf("%v 分析结果", t)},
+			Url:  fmt.Sprintf("%v/loganalyzer?type=%v&alertId=%v", n.PortalUrl, t, a.Id.Hex()),
+			Type: "default",
+		})
+	}
+	if a.Status == AlertFiring && a.Id.Valid() {
+		if n.AppId != "" {
+			actions = append(actions, feishuAction{
+				Tag:   "button",
+				Text:  feishuText{"plain_text", DefaultFeishuAckText},
+				Type:  "primary",
+				Value: map[string]string{"notifier": n.Name(), "alertId": a.Id.Hex()},
+			})
+		} else if n.PortalUrl != "" {
+			actions = append(actions, feishuAction{
+				Tag:  "button",
+				Text: feishuText{"plain_text", DefaultFeishuPortalAckText},
+				Url:  n.PortalUrl,
+				Type: "primary",
+			})
+		}
+	}
+
+	elements := []feishuElement{div}
+	if len(actions) != 0 {
+		elements = append(elements, feishuElement{Tag: "action", Actions: actions})
+	}
+	return elements
+}
+
+// 签名为 base64(HmacSHA256(key: timestamp + "\n" + secret, data: 空))，timestamp 为秒
+func (n *Feishu) Sign(timestamp int64) string {
+	mac := hmac.New(sha256.New, []byte(fmt.Sprintf("%d\n%s", timestamp, n.Secret)))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (n *Feishu) SendMsg(xl *xlog.Logger, req *FeishuReq) (err error) {
+	if n.AppId != "" {
+		return n.sendByApp(xl, req)
+	}
+	if n.Secret != "" {
+		timestamp := time.Now().Unix()
+		req.Timestamp = strconv.FormatInt(timestamp, 10)
+		req.Sign = n.Sign(timestamp)
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	resp, err := n.cli.Post(n.WebhookUrl, "application/json", bytes.NewReader(b))
+	if err != nil {
+		xl.Errorf("Feishu Notify(msg) error: %+v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var res feishuResp
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		xl.Errorf("Feishu decode resp, status: %v, err: %v", resp.StatusCode, err)
+		return
+	}
+	if res.Code != 0 || res.StatusCode != 0 {
+		xl.Errorf("Req: %+v, Resp: %+v", req, res)
+		err = fmt.Errorf("%v %v", res.Code, res.Msg)
+	}
+	return
+}
+
+// ================================================
+// 应用机器人
+
+type feishuAppMsgReq struct {
+	ReceiveId string `json:"receive_id"`
+	MsgType   string `json:"msg_type"`
+	Content   string `json:"content"` // 卡片的 JSON 字符串
+}
+
+type feishuTokenResp struct {
+	Code              int    `json:"code"`
+	Msg               string `json:"msg"`
+	TenantAccessToken string `json:"tenant_access_token"`
+	Expire            int    `json:"expire"`
+}
+
+func (n *Feishu) sendByApp(xl *xlog.Logger, req *FeishuReq) (err error) {
+	token, err := n.tenantAccessToken(xl)
+	if err != nil {
+		return
+	}
+	content, err := json.Marshal(req.Card)
+	if err != nil {
+		return
+	}
+	var res feishuResp
+	err = n.callApi(xl, "/im/v1/messages?receive_id_type=chat_id", token,
+		&feishuAppMsgReq{ReceiveId: n.ChatId, MsgType: req.MsgType, Content: string(content)}, &res)
+	if err != nil {
+		return
+	}
+	if res.Code != 0 {
+		xl.Errorf("Feishu %v send to chat %v, Resp: %+v", n.Name(), n.ChatId, res)
+		// token 可能已经失效，下次重新获取
+		n.mutex.Lock()
+		n.token = ""
+		n.mutex.Unlock()
+		err = fmt.Errorf("%v %v", res.Code, res.Msg)
+	}
+	return
+}
+
+// 缓存 tenant_access_token，获取时不持有 n.mutex
+func (n *Feishu) tenantAccessToken(xl *xlog.Logger) (token string, err error) {
+	n.mutex.Lock()
+	token = n.token
+	valid := time.Now().Before(n.tokenExpireAt)
+	n.mutex.Unlock()
+	if token != "" && valid {
+		return
+	}
+
+	var res feishuTokenResp
+	err = n.callApi(xl, "/auth/v3/tenant_access_token/internal", "",
+		map[string]string{"app_id": n.AppId, "app_secret": n.AppSecret}, &res)
+	if err != nil {
+		return
+	}
+	if res.Code != 0 {
+		xl.Errorf("Feishu %v get tenant_access_token, code: %v, msg: %v", n.Name(), res.Code, res.Msg)
+		return "", fmt.Errorf("feishu tenant_access_token %v %v", res.Code, res.Msg)
+	}
+
+	n.mutex.Lock()
+	n.token = res.TenantAccessToken
+	n.tokenExpireAt = time.Now().Add(time.Duration(res.Expire)*time.Second - DefaultFeishuTokenRefreshAhead)
+	n.mutex.Unlock()
+	return res.TenantAccessToken, nil
+}
+
+func (n *Feishu) callApi(xl *xlog.Logger, path, token string, body, res interface{}) (err error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest("POST", n.ApiUrl+path, bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := n.cli.Do(req)
+	if err != nil {
+		xl.Errorf("Feishu %v %v error: %+v", n.Name(), path, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(res)
+	if err != nil {
+		xl.Errorf("Feishu %v decode resp, status: %v, err: %v", path, resp.StatusCode, err)
+	}
+	return
+}
+
+// ================================================
+// 卡片回调
+
+type FeishuCallbackArgs struct {
+	// 配置请求网址时的校验请求
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+
+	Token  string `json:"token"`
+	OpenId string `json:"open_id"`
+	UserId string `json:"user_id"`
+	Action struct {
+		Tag   string            `json:"tag"`
+		Value map[string]string `json:"value"`
+	} `json:"action"`
+}
+
+// 校验回调并生成 ack 参数，args.Type 为 url_verification 时 ackArgs 为 nil
+func ParseFeishuCallback(cfgs []FeishuCfg, args *FeishuCallbackArgs) (ackArgs *AlertsAckArgs, err error) {
+	var cfg *FeishuCfg
+	for i := range cfgs {
+		token := cfgs[i].VerificationToken
+		if token != "" && hmac.Equal([]byte(token), []byte(args.Token)) {
+			cfg = &cfgs[i]
+			break
+		}
+	}
+	if cfg == nil {
+		return nil, ErrInvalidFeishuToken
+	}
+	if args.Type == FeishuCallbackUrlVerification {
+		return
+	}
+
+	alertId := args.Action.Value["alertId"]
+	if alertId == "" {
+		return nil, ErrInvalidFeishuAction
+	}
+	username := cfg.Users[args.OpenId]
+	if username == "" {
+		username = args.UserId
+	}
+	if username == "" {
+		username = args.OpenId
+	}
+	ackArgs = &AlertsAckArgs{
+		Ids:      []string{alertId},
+		Comment:  DefaultFeishuAckComment,
+		Username: username,
+	}
+	return
+}
@@ -0,0 +1,180 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/qiniu/http/rpcutil.v1"
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestFeishu(t *testing.T) {
+	ast := assert.New(t)
+
+	reqC := make(chan FeishuReq, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req FeishuReq
+		ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+		reqC <- req
+		w.Write([]byte(`{"code": 0, "msg": "success"}`))
+	}))
+	defer ts.Close()
+
+	n := NewFeishu(FeishuCfg{
+		Name:       "feishu",
+		WebhookUrl: ts.URL,
+		Secret:     "secret",
+		PortalUrl:  "http://portal",
+	})
+
+	a := &Alert{
+		Id:            bson.NewObjectId(),
+		Key:           "key1",
+		Description:   "a1",
+		Status:        AlertFiring,
+		Severity:      SeverityP0,
+		GeneratorURL:  "http://prom",
+		Labels:        map[string]string{"idc": "xs", "node": "n1"},
+		AnalyzerTypes: []string{"sgforward"},
+	}
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a)))
+
+	req := <-reqC
+	ast.Equal("interactive", req.MsgType)
+	timestamp, err := strconv.ParseInt(req.Timestamp, 10, 64)
+	ast.NoError(err)
+	ast.Equal(n.Sign(timestamp), req.Sign)
+	ast.Equal("red", req.Card.Header.Template)
+	ast.Equal("[P0] a1 | firing", req.Card.Header.Title.Content)
+	ast.Equal(2, len(req.Card.Elements))
+	ast.Equal([]feishuField{
+		{true, feishuText{"lark_md", "**idc**\nxs"}},
+		{true, feishuText{"lark_md", "**node**\nn1"}},
+	}, req.Card.Elements[0].Fields)
+	actions := req.Card.Elements[1].Actions
+	ast.Equal(3, len(actions))
+	ast.Equal("http://prom", actions[0].Url)
+	ast.Equal("http://portal/loganalyzer?type=sgforward&alertId="+a.Id.Hex(), actions[1].Url)
+	// 自定义机器人不支持回调按钮，Ack 跳转到 portal
+	ast.Equal("http://portal", actions[2].Url)
+	ast.Nil(actions[2].Value)
+}
+
+func TestFeishuApp(t *testing.T) {
+	ast := assert.New(t)
+
+	tokenCnt := 0
+	reqC := make(chan feishuAppMsgReq, 2)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/auth/v3/tenant_access_token/internal":
+			var req map[string]string
+			ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+			ast.Equal(map[string]string{"app_id": "cli_1", "app_secret": "app-secret"}, req)
+			tokenCnt++
+			w.Write([]byte(`{"code": 0, "msg": "ok", "tenant_access_token": "t-1", "expire": 7200}`))
+		case "/im/v1/messages":
+			ast.Equal("chat_id", r.URL.Query().Get("receive_id_type"))
+			ast.Equal("Bearer t-1", r.Header.Get("Authorization"))
+			var req feishuAppMsgReq
+			ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+			reqC <- req
+			w.Write([]byte(`{"code": 0, "msg": "success"}`))
+		default:
+			ast.Fail("unexpected path " + r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	n := NewFeishu(FeishuCfg{
+		Name:      "feishu-app",
+		AppId:     "cli_1",
+		AppSecret: "app-secret",
+		ChatId:    "oc_1",
+		ApiUrl:    ts.URL + "/",
+	})
+	a := &Alert{Id: bson.NewObjectId(), Description: "a1", Status: AlertFiring, Severity: SeverityP0}
+	xl := xlog.NewDummy()
+	ast.NoError(n.Notify(NewMessage(xl, a)))
+	ast.NoError(n.Notify(NewMessage(xl, a)))
+	// token 被缓存
+	ast.Equal(1, tokenCnt)
+
+	req := <-reqC
+	ast.Equal("oc_1", req.ReceiveId)
+	ast.Equal("interactive", req.MsgType)
+	var card feishuCard
+	ast.NoError(json.Unmarshal([]byte(req.Content), &card))
+	actions := card.Elements[1].Actions
+	ast.Equal(map[string]string{"notifier": "feishu-app", "alertId": a.Id.Hex()}, actions[0].Value)
+}
+
+func TestParseFeishuCallback(t *testing.T) {
+	ast := assert.New(t)
+
+	cfgs := []FeishuCfg{{Name: "feishu", VerificationToken: "token", Users: map[string]string{"ou_1": "alice"}}}
+
+	args := &FeishuCallbackArgs{Type: FeishuCallbackUrlVerification, Token: "token", Challenge: "c"}
+	ackArgs, err := ParseFeishuCallback(cfgs, args)
+	ast.NoError(err)
+	ast.Nil(ackArgs)
+
+	args = &FeishuCallbackArgs{Token: "wrong"}
+	_, err = ParseFeishuCallback(cfgs, args)
+	ast.Equal(ErrInvalidFeishuToken, err)
+
+	args = &FeishuCallbackArgs{Token: "token", OpenId: "ou_1"}
+	args.Action.Value = map[string]string{"alertId": "id1"}
+	ackArgs, err = ParseFeishuCallback(cfgs, args)
+	ast.NoError(err)
+	ast.Equal([]string{"id1"}, ackArgs.Ids)
+	ast.Equal("alice", ackArgs.Username)
+
+	args.OpenId = "ou_2"
+	ackArgs, err = ParseFeishuCallback(cfgs, args)
+	ast.NoError(err)
+	ast.Equal("ou_2", ackArgs.Username)
+}
+
+func TestPostFeishuCallback(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+
+	aam := &AlertActiveMgr{
+		AlertActiveCfg: &AlertActiveCfg{EmergenctIntervalS: 3600},
+		data:           make(map[string]*AlertActive),
+	}
+	a := &Alert{Id: bson.NewObjectId(), Key: "k1", Alertname: "disk", Status: AlertFiring, StartsAt: time.Now()}
+	ast.NoError(aam.Add(xl, a))
+	s := &Service{
+		Config:         &Config{NotifiersCfg: NotifiersCfg{FeishuCfgs: []FeishuCfg{{Name: "feishu", VerificationToken: "token"}}}},
+		alertActiveMgr: aam,
+	}
+
+	post := func(id, user string) (map[string]string, error) {
+		args := &FeishuCallbackArgs{Token: "token", OpenId: user}
+		args.Action.Value = map[string]string{"alertId": id}
+		req := httptest.NewRequest("POST", "/feishu/callback", nil)
+		return s.PostFeishuCallback(args, &rpcutil.Env{W: httptest.NewRecorder(), Req: req})
+	}
+
+	// 第二次点击 Ack 不做处理
+	_, err := post(a.Id.Hex(), "A")
+	ast.NoError(err)
+	_, err = post(a.Id.Hex(), "B")
+	ast.NoError(err)
+	aa, ok := aam.GetById(a.Id.Hex())
+	ast.True(ok)
+	ast.Equal(AlertAcked, aa.Status)
+	ast.Equal(1, len(aa.Acks))
+	ast.Equal("A", aa.Acks[0].Username)
+
+	_, err = post(bson.NewObjectId().Hex(), "A")
+	ast.Equal(ErrAlertNotFound, err)
+}
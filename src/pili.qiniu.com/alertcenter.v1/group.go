@@ -0,0 +1,173 @@
+package alertcenter
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// 告警按 GroupBy 中的 label 分组，新分组先等待 GroupWaitMS 收集同组告警后再发送，
+// 之后同一分组最多每 GroupIntervalMS 发送一次
+// GroupWaitMS 和 GroupIntervalMS 都为 0 时不做分组，收到的消息直接发送
+type GroupCfg struct {
+	GroupBy         []string `json:"group_by"`
+	GroupWaitMS     int      `json:"group_wait_ms"`
+	GroupIntervalMS int      `json:"group_interval_ms"`
+}
+
+func (cfg *GroupCfg) Check() {
+	if len(cfg.GroupBy) == 0 {
+		cfg.GroupBy = []string{AlertNameLabel}
+	}
+}
+
+type alertGroup struct {
+	msg   Message
+	keys  map[string]int // alert key => index of msg.Alerts
+	timer *time.Timer
+}
+
+// 同一个告警在一个分组里只保留最新的状态
+func (ag *alertGroup) add(a *Alert) {
+	if i, ok := ag.keys[a.Key]; ok {
+		ag.msg.Alerts[i] = a
+		return
+	}
+	ag.keys[a.Key] = len(ag.msg.Alerts)
+	ag.msg.Alerts = append(ag.msg.Alerts, a)
+}
+
+type Grouper struct {
+	*GroupCfg
+	apMgr  *AlertProfileMgr
+	events *EventMgr
+	f      func(msg Message)
+
+	mutex     sync.Mutex
+	groups    map[string]*alertGroup
+	lastFlush map[string]time.Time
+	// 一条消息的告警可能分到多个分组，所有分组都发送后才能从 outbox 队列中删除
+	queued map[bson.ObjectId]int // queue id => 还没有发送的分组数
+}
+
+func NewGrouper(cfg GroupCfg, apMgr *AlertProfileMgr, events *EventMgr, f func(msg Message)) *Grouper {
+	cfg.Check()
+	return &Grouper{
+		GroupCfg:  &cfg,
+		apMgr:     apMgr,
+		events:    events,
+		f:         f,
+		groups:    make(map[string]*alertGroup),
+		lastFlush: make(map[string]time.Time),
+		queued:    make(map[bson.ObjectId]int),
+	}
+}
+
+func (g *Grouper) groupBy(a *Alert) []string {
+	if g.apMgr != nil {
+		if ap, ok := g.apMgr.GetByCache(a.Alertname); ok && len(ap.GroupBy) != 0 {
+			return ap.GroupBy
+		}
+	}
+	return g.GroupBy
+}
+
+func (g *Grouper) GroupKey(a *Alert) string {
+	groupBy := g.groupBy(a)
+	kvs := make([]string, 0, len(groupBy))
+	for _, name := range groupBy {
+		kvs = append(kvs, name+"="+a.LabelValue(name))
+	}
+	sort.Strings(kvs)
+	return strings.Join(kvs, ",")
+}
+
+func (g *Grouper) Add(msg Message) {
+	// 指定了 notifiers 的消息（比如告警升级）和紧急告警的重复发送不参与分组，
+	// 否则重复发送会被合并到同组的其他告警中，或者被 GroupIntervalMS 推迟
+	if (g.GroupWaitMS == 0 && g.GroupIntervalMS == 0) || len(msg.Notifiers) != 0 || msg.Resend {
+		g.f(msg)
+		return
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	added := make(map[string]*alertGroup)
+	for _, a := range msg.Alerts {
+		key := g.GroupKey(a)
+		ag, ok := g.groups[key]
+		if !ok {
+			ag = &alertGroup{
+				msg:  NewMessage(msg.xl),
+				keys: make(map[string]int),
+			}
+			g.groups[key] = ag
+			ag.timer = time.AfterFunc(g.delay(key), func() {
+				g.flush(key)
+			})
+		}
+		ag.add(a)
+		added[key] = ag
+
+		ev := NewEvent(EventGrouped, a)
+		ev.Detail = key
+		g.events.Record(msg.xl, ev)
+	}
+	for _, ag := range added {
+		ag.msg.queueIds = append(ag.msg.queueIds, msg.queueIds...)
+		for _, id := range msg.queueIds {
+			g.queued[id]++
+		}
+	}
+}
+
+// 新分组等待 GroupWaitMS，刚发送过的分组需要等到距离上一次发送满 GroupIntervalMS
+func (g *Grouper) delay(key string) time.Duration {
+	d := time.Duration(g.GroupWaitMS) * time.Millisecond
+	if last, ok := g.lastFlush[key]; ok {
+		left := time.Duration(g.GroupIntervalMS)*time.Millisecond - time.Since(last)
+		if left > d {
+			d = left
+		}
+	}
+	return d
+}
+
+func (g *Grouper) flush(key string) {
+	g.mutex.Lock()
+	ag, ok := g.groups[key]
+	if !ok {
+		g.mutex.Unlock()
+		return
+	}
+	delete(g.groups, key)
+
+	// 只带上所有分组都已经发送的 queue id
+	var done []bson.ObjectId
+	for _, id := range ag.msg.queueIds {
+		g.queued[id]--
+		if g.queued[id] <= 0 {
+			delete(g.queued, id)
+			done = append(done, id)
+		}
+	}
+	ag.msg.queueIds = done
+
+	now := time.Now()
+	g.lastFlush[key] = now
+	interval := time.Duration(g.GroupIntervalMS) * time.Millisecond
+	for k, last := range g.lastFlush {
+		if now.Sub(last) > interval {
+			delete(g.lastFlush, k)
+		}
+	}
+	g.mutex.Unlock()
+
+	sort.Sort(ByStartsAt(ag.msg.Alerts))
+	ag.msg.xl.Debugf("Grouper flush group: %v, alerts: %v", key, len(ag.msg.Alerts))
+	g.f(ag.msg)
+}
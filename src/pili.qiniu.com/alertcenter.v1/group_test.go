@@ -0,0 +1,119 @@
+package alertcenter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestGrouper(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+
+	recvC := make(chan Message, 10)
+	g := NewGrouper(GroupCfg{GroupWaitMS: 50, GroupIntervalMS: 300}, nil, nil, func(msg Message) {
+		recvC <- msg
+	})
+
+	// 同一个 alertname 的告警分多次请求发送，会被合并成一条消息
+	g.Add(NewMessage(xl, &Alert{Key: "1", Alertname: "a", Status: AlertFiring}))
+	g.Add(NewMessage(xl, &Alert{Key: "2", Alertname: "a", Status: AlertFiring}, &Alert{Key: "3", Alertname: "b"}))
+	g.Add(NewMessage(xl, &Alert{Key: "1", Alertname: "a", Status: AlertResolved}))
+
+	cnt := map[string]int{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-recvC:
+			cnt[msg.Alerts[0].Alertname] = len(msg.Alerts)
+			if msg.Alerts[0].Alertname == "a" {
+				ast.Equal(AlertResolved, msg.Alerts[0].Status, "latest status of the same alert should be kept")
+			}
+		case <-time.After(time.Second):
+			ast.Fail("group should be flushed after group_wait")
+		}
+	}
+	ast.Equal(map[string]int{"a": 2, "b": 1}, cnt)
+
+	// 刚发送过的分组需要等待 group_interval
+	begin := time.Now()
+	g.Add(NewMessage(xl, &Alert{Key: "4", Alertname: "a"}))
+	select {
+	case msg := <-recvC:
+		ast.Equal(1, len(msg.Alerts))
+		ast.True(time.Since(begin) > 200*time.Millisecond, "group should wait for group_interval")
+	case <-time.After(time.Second):
+		ast.Fail("group should be flushed after group_interval")
+	}
+}
+
+func TestGrouperQueueIds(t *testing.T) {
+	ast := assert.New(t)
+
+	recvC := make(chan Message, 10)
+	g := NewGrouper(GroupCfg{GroupWaitMS: 50}, nil, nil, func(msg Message) {
+		recvC <- msg
+	})
+
+	// 告警分到两个分组，第二个分组发送时才带上 queue id
+	id := bson.NewObjectId()
+	msg := NewMessage(xlog.NewDummy(), &Alert{Key: "1", Alertname: "a"}, &Alert{Key: "2", Alertname: "b"})
+	msg.queueIds = []bson.ObjectId{id}
+	g.Add(msg)
+	var got [][]bson.ObjectId
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-recvC:
+			got = append(got, msg.queueIds)
+		case <-time.After(time.Second):
+			ast.Fail("group should be flushed after group_wait")
+		}
+	}
+	ast.Equal([][]bson.ObjectId{nil, {id}}, got)
+	ast.Equal(0, len(g.queued))
+}
+
+func TestGrouperResend(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+
+	recvC := make(chan Message, 10)
+	g := NewGrouper(GroupCfg{GroupWaitMS: 300, GroupIntervalMS: 300}, nil, nil, func(msg Message) {
+		recvC <- msg
+	})
+
+	// 紧急告警的重复发送直接发送，不合并到同组正在等待的告警中
+	g.Add(NewMessage(xl, &Alert{Key: "1", Alertname: "a"}))
+	msg := NewMessage(xl, &Alert{Key: "2", Alertname: "a"})
+	msg.Resend = true
+	g.Add(msg)
+	select {
+	case msg := <-recvC:
+		ast.Equal(1, len(msg.Alerts))
+		ast.Equal("2", msg.Alerts[0].Key)
+	case <-time.After(100 * time.Millisecond):
+		ast.Fail("resend should not be grouped")
+	}
+	select {
+	case msg := <-recvC:
+		ast.Equal(1, len(msg.Alerts))
+		ast.Equal("1", msg.Alerts[0].Key)
+	case <-time.After(time.Second):
+		ast.Fail("group should be flushed after group_wait")
+	}
+}
+
+func TestGrouperDisabled(t *testing.T) {
+	ast := assert.New(t)
+
+	var got []Message
+	g := NewGrouper(GroupCfg{}, nil, nil, func(msg Message) {
+		got = append(got, msg)
+	})
+	g.Add(NewMessage(xlog.NewDummy(), &Alert{Key: "1"}, &Alert{Key: "2"}))
+	if ast.Equal(1, len(got)) {
+		ast.Equal(2, len(got[0].Alerts))
+	}
+}
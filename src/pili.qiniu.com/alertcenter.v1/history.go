@@ -6,6 +6,7 @@ import (
 
 	"github.com/qiniu/http/httputil.v1"
 	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 
@@ -25,18 +26,19 @@ type HistoryMgr struct {
 	*HistoryCfg
 	mgo             pmgo.Mongo
 	alertProfileMgr *AlertProfileMgr
+	events          *EventMgr
 }
 
-func NewHistoryMgr(cfg HistoryCfg, alertProfileMgr *AlertProfileMgr) *HistoryMgr {
+func NewHistoryMgr(cfg HistoryCfg, alertProfileMgr *AlertProfileMgr, events *EventMgr) *HistoryMgr {
 	mgo, err := pmgo.New(cfg.MgoOpt)
 	if err != nil {
 		log.Panic("history: NewHistory pmgo.New(cfg.MgoOpt) err:", err)
 	}
 	// TODO mgo.Coll().EnsureIndex(index)
-	return &HistoryMgr{&cfg, mgo, alertProfileMgr}
+	return &HistoryMgr{&cfg, mgo, alertProfileMgr, events}
 }
 
-func (hm *HistoryMgr) Create(alert *Alert) (err error) {
+func (hm *HistoryMgr) Create(xl *xlog.Logger, alert *Alert) (err error) {
 	if alert.Id == "" {
 		alert.Id = bson.NewObjectId()
 	}
@@ -47,6 +49,7 @@ func (hm *HistoryMgr) Create(alert *Alert) (err error) {
 		}
 		return
 	}
+	hm.events.Record(xl, NewEvent(EventFired, alert))
 	now := time.Now()
 
 	// try to insert into alertProfile(may already exist)
@@ -79,13 +82,23 @@ type AlertHistoryUpdateArgs struct {
 	EndsAt time.Time   `json:"endsAt" bson:"endsAt"`
 }
 
-func (hm *HistoryMgr) Update(id bson.ObjectId, args *AlertHistoryUpdateArgs) (err error) {
+// hm 为 nil 时不记录，方便单独使用 AlertActiveMgr
+func (hm *HistoryMgr) Update(xl *xlog.Logger, id bson.ObjectId, args *AlertHistoryUpdateArgs) (err error) {
+	if hm == nil {
+		return
+	}
 	if args.Status == AlertResolved && args.EndsAt.IsZero() {
 		args.EndsAt = time.Now()
 	}
 	err = hm.mgo.Coll().UpdateId(id, M{"$set": args})
-	if err == mgo.ErrNotFound {
-		err = ErrAlertHistoryNotFound
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			err = ErrAlertHistoryNotFound
+		}
+		return
+	}
+	if args.Status == AlertResolved {
+		hm.events.Record(xl, Event{AlertId: id, Type: EventResolved, Time: args.EndsAt})
 	}
 	return
 }
@@ -98,7 +111,11 @@ func (hm *HistoryMgr) UpdateStatus(id bson.ObjectId, status AlertStatus) (err er
 	return
 }
 
+// hm 为 nil 时不记录，方便单独使用 AlertActiveMgr
 func (hm *HistoryMgr) Ack(id bson.ObjectId, ack Ack) (err error) {
+	if hm == nil {
+		return
+	}
 	err = hm.mgo.Coll().UpdateId(id, M{
 		"$set":      M{"status": AlertAcked},
 		"$addToSet": M{"acks": M{"username": ack.Username, "time": ack.Time, "comment": ack.Comment}},
@@ -110,6 +127,17 @@ func (hm *HistoryMgr) Ack(id bson.ObjectId, ack Ack) (err error) {
 	return
 }
 
+func (hm *HistoryMgr) Escalate(id bson.ObjectId, record EscalationRecord) (err error) {
+	err = hm.mgo.Coll().UpdateId(id, M{
+		"$set":  M{"isEmergent": record.Step > 0},
+		"$push": M{"escalations": record},
+	})
+	if err == mgo.ErrNotFound {
+		err = ErrAlertHistoryNotFound
+	}
+	return
+}
+
 func (hm *HistoryMgr) Rename(oldName, newName string) (ids []interface{}, err error) {
 	iter := hm.mgo.Coll().Find(M{"alertname": oldName}).Sort("_id").Iter()
 
@@ -0,0 +1,112 @@
+package alertcenter
+
+import (
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+// 当 source 告警正在触发时，抑制与之 Equal 中的 label 值都相同的 target 告警
+// 例如机房链路故障时，抑制该机房下所有 pili_vdn_node_* 告警
+type InhibitRule struct {
+	SourceMatchers Matchers `json:"source_matchers"`
+	TargetMatchers Matchers `json:"target_matchers"`
+	Equal          []string `json:"equal"`
+}
+
+func (r *InhibitRule) Check() (err error) {
+	err = r.SourceMatchers.Check()
+	if err != nil {
+		return
+	}
+	return r.TargetMatchers.Check()
+}
+
+func (r *InhibitRule) equal(source, target *Alert) bool {
+	for _, name := range r.Equal {
+		if source.LabelValue(name) != target.LabelValue(name) {
+			return false
+		}
+	}
+	return true
+}
+
+type InhibitCfg struct {
+	Rules []InhibitRule `json:"rules"`
+}
+
+func (cfg *InhibitCfg) Check() {
+	for i := range cfg.Rules {
+		if err := cfg.Rules[i].Check(); err != nil {
+			log.Panic("inhibit: invalid rule", i, "err:", err)
+		}
+	}
+}
+
+type Inhibitor struct {
+	*InhibitCfg
+	alertActiveMgr *AlertActiveMgr
+}
+
+func NewInhibitor(cfg InhibitCfg, alertActiveMgr *AlertActiveMgr) *Inhibitor {
+	cfg.Check()
+	return &Inhibitor{
+		InhibitCfg:     &cfg,
+		alertActiveMgr: alertActiveMgr,
+	}
+}
+
+// 同一批次里正在触发的告警也可以作为 source
+func (ih *Inhibitor) sources(as []*Alert) (sources []*Alert) {
+	sources = ih.alertActiveMgr.Alerts()
+	for _, a := range as {
+		if a.Status == AlertFiring {
+			sources = append(sources, a)
+		}
+	}
+	return
+}
+
+func (ih *Inhibitor) inhibitedBy(a *Alert, sources []*Alert) string {
+	for i := range ih.Rules {
+		r := &ih.Rules[i]
+		if !r.TargetMatchers.Match(a) {
+			continue
+		}
+		for _, s := range sources {
+			if s.Key == a.Key || s.Status == AlertResolved {
+				continue
+			}
+			if r.SourceMatchers.Match(s) && r.equal(s, a) {
+				return s.Key
+			}
+		}
+	}
+	return ""
+}
+
+// implement action interface
+// 被抑制的告警会在 InhibitedBy 中记录 source 告警的 key，并随告警一起写入历史
+func (ih *Inhibitor) Do(xl *xlog.Logger, as []*Alert) []*Alert {
+	if len(ih.Rules) == 0 {
+		return as
+	}
+
+	sources := ih.sources(as)
+	for _, a := range as {
+		a.InhibitedBy = ih.inhibitedBy(a, sources)
+		if a.InhibitedBy != "" {
+			xl.Infof("alert %v(%v) is inhibited by %v", a.Alertname, a.Key, a.InhibitedBy)
+		}
+	}
+	return as
+}
+
+// 重新计算抑制关系并返回需要通知的告警
+func (ih *Inhibitor) Filter(xl *xlog.Logger, as []*Alert) (newAs []*Alert) {
+	for _, a := range ih.Do(xl, as) {
+		if a.InhibitedBy == "" {
+			newAs = append(newAs, a)
+		}
+	}
+	return
+}
@@ -0,0 +1,60 @@
+package alertcenter
+
+import (
+	"testing"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInhibitor(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+
+	aam := &AlertActiveMgr{data: make(map[string]*AlertActive)}
+	linkDown := &Alert{
+		Key:       "link",
+		Status:    AlertFiring,
+		Alertname: "pili_idc_link_down",
+		Labels:    map[string]string{"idc": "gzgy"},
+	}
+	aam.data[linkDown.Key] = &AlertActive{Alert: linkDown}
+
+	ih := NewInhibitor(InhibitCfg{
+		Rules: []InhibitRule{
+			{
+				SourceMatchers: Matchers{{Name: "alertname", Value: "pili_idc_link_down"}},
+				TargetMatchers: Matchers{{Name: "alertname", Value: "pili_vdn_node_.*", Type: MatchRegexp}},
+				Equal:          []string{"idc"},
+			},
+		},
+	}, aam)
+
+	as := []*Alert{
+		{Key: "1", Status: AlertFiring, Alertname: "pili_vdn_node_lrtime", Labels: map[string]string{"idc": "gzgy"}},
+		{Key: "2", Status: AlertFiring, Alertname: "pili_vdn_node_lrtime", Labels: map[string]string{"idc": "bjyz"}},
+		{Key: "3", Status: AlertFiring, Alertname: "pili_streamd_fd", Labels: map[string]string{"idc": "gzgy"}},
+	}
+	as = ih.Do(xl, as)
+	ast.Equal(3, len(as), "inhibited alerts should be kept by the action")
+	ast.Equal("link", as[0].InhibitedBy)
+	ast.Equal("", as[1].InhibitedBy)
+	ast.Equal("", as[2].InhibitedBy)
+
+	// source 在同一批次中也能抑制 target
+	as = []*Alert{
+		{Key: "4", Status: AlertFiring, Alertname: "pili_idc_link_down", Labels: map[string]string{"idc": "bjyz"}},
+		{Key: "2", Status: AlertFiring, Alertname: "pili_vdn_node_lrtime", Labels: map[string]string{"idc": "bjyz"}},
+	}
+	as = ih.Filter(xl, as)
+	if ast.Equal(1, len(as)) {
+		ast.Equal("4", as[0].Key)
+	}
+
+	// source 恢复后不再抑制
+	delete(aam.data, linkDown.Key)
+	as = ih.Filter(xl, []*Alert{
+		{Key: "1", Status: AlertFiring, Alertname: "pili_vdn_node_lrtime", Labels: map[string]string{"idc": "gzgy"}},
+	})
+	ast.Equal(1, len(as))
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/qiniu/log.v1"
 	"github.com/qiniu/rpc.v1/lb.v2.1"
 	"github.com/qiniu/xlog.v1"
 )
@@ -18,15 +19,17 @@ const (
 	DefaultLeanChatMoreAlertsText      = "更多告警请点我"
 	DefaultLeanChatMaxDisplayCnt       = 3
 	DefaultLeanChatMinCloseAlertsTimes = 3
+	DefaultLeanChatEmergencyText       = "该告警被升级请赶紧处理告警"
 )
 
 type LeanChatCfg struct {
+	Name            string   `json:"name"`
 	Hosts           []string `json:"hosts"`
 	ServiceId       string   `json:"service_id"`
 	Path            string   `json:"path"`
 	Channel         string   `json:"channel"`
 	PhotoUrl        string   `json:"photo_url"`
-	DisplayUserName string   `json:"name"`
+	DisplayUserName string   `json:"display_name"`
 	// 头像Url
 	AvatarUrl string `json:"avataurl"`
 
@@ -47,15 +50,32 @@ type LeanChatCfg struct {
 
 	DialTimeoutMs int    `json:"dial_timeout_ms"`
 	TryTimes      uint32 `json:"try_times"`
+
+	PortalUrl string `json:"portal_url"`
+
+	// 告警的 title 和 description 模板，footer 不为空时追加在 description 后面
+	Template TemplateCfg `json:"template"`
+}
+
+// 标题为描述和状态，恢复的告警标题末尾多一个空格，正文为开始时间和告警 id
+var DefaultLeanChatTemplate = TemplateCfg{
+	Title: `{{.Description}} | {{.Status}}{{if eq .Status "resolved"}} {{end}}`,
+	Body:  `{{.TimeHeader}} {{.StartsAt.Format .TimeLayout}}    {{.AlertIdHeader}} {{.Id.Hex}}`,
 }
 
 type LeanChat struct {
 	*LeanChatCfg
-	From string
 	cli  *lb.Client
+	tmpl *Templates
 }
 
-func CheckLeanChatCfg(cfg *LeanChatCfg) {
+func (cfg *LeanChatCfg) Check() {
+	if cfg.Name == "" {
+		log.Panic("miss Name of leanChatCfg")
+	}
+	if len(cfg.Hosts) == 0 {
+		log.Panic("miss Hosts of leanChatCfg")
+	}
 	if cfg.TimeLayout == "" {
 		cfg.TimeLayout = DefaultLeanChatTimeLayout
 	}
@@ -84,15 +104,16 @@ func CheckLeanChatCfg(cfg *LeanChatCfg) {
 	}
 }
 
-func NewLeanChat(cfg *LeanChatCfg) *LeanChat {
-	CheckLeanChatCfg(cfg)
+func NewLeanChat(cfg LeanChatCfg) *LeanChat {
+	cfg.Check()
 
 	transport := lb.NewTransport(&lb.TransportConfig{
 		DialTimeoutMS: cfg.DialTimeoutMs,
 	})
 
 	return &LeanChat{
-		LeanChatCfg: cfg,
+		LeanChatCfg: &cfg,
+		tmpl:        NewTemplates(cfg.Template, DefaultLeanChatTemplate),
 		cli: lb.New(
 			&lb.Config{
 				Hosts:    cfg.Hosts,
@@ -165,13 +186,23 @@ type leanChatResp struct {
 }
 
 func (n *LeanChat) Name() string {
-	return "LeanChat"
+	return n.LeanChatCfg.Name
 }
 
-func (n *LeanChat) Notify(xl *xlog.Logger, msg *Message) (err error) {
+func (n *LeanChat) Notify(msg Message) (err error) {
+	xl := msg.xl
 	if len(msg.Alerts) == 0 {
 		return
 	}
+	err = n.SendMsg(xl, n.GetReq(msg))
+	return
+}
+
+func (n *LeanChat) Preview(msg Message) (interface{}, error) {
+	return n.GetReq(msg), nil
+}
+
+func (n *LeanChat) GetReq(msg Message) *leanChatReq {
 	atts := make([]leanChatAttachment, 0, len(msg.Alerts))
 	descs := ""
 
@@ -197,23 +228,19 @@ func (n *LeanChat) Notify(xl *xlog.Logger, msg *Message) (err error) {
 	}
 
 	if len(msg.Alerts) > n.MaxDisplayCnt {
-		req.Buttons = []leanChatButton{
-			{
-				Text: n.GetMoreAlertsText(len(msg.Alerts)),
-			},
-		}
+		req.Buttons = append(req.Buttons, leanChatButton{
+			Text: n.GetMoreAlertsText(len(msg.Alerts)),
+			Url:  n.PortalUrl,
+		})
 	}
 
 	if msg.Alerts[0].IsEmergent {
-		req.Buttons = []leanChatButton{
-			{
-				Text: n.GetEmergencyText(),
-			},
-		}
+		req.Buttons = append(req.Buttons, leanChatButton{
+			Text: n.GetEmergencyText(),
+			Url:  n.PortalUrl,
+		})
 	}
-
-	err = n.SendMsg(xl, req)
-	return
+	return req
 }
 
 func (n *LeanChat) SendMsg(xl *xlog.Logger, req *leanChatReq) (err error) {
@@ -257,17 +284,28 @@ func (n *LeanChat) GetMoreAlertsText(cnt int) string {
 	return fmt.Sprintf("共有 %v 个告警 %v", cnt, n.MoreAlertsText)
 }
 
-func (n *LeanChat) GetTitle(a *Alert) string {
-	if a.Status == AlertResolved {
-		return fmt.Sprintf("%v | %v ", a.Description, a.Status)
+func (n *LeanChat) templateData(a *Alert) *TemplateData {
+	return &TemplateData{
+		Alert:         a,
+		PortalUrl:     n.PortalUrl,
+		TimeLayout:    n.TimeLayout,
+		TimeHeader:    n.TimeHeader,
+		AlertIdHeader: n.AlertIdHeader,
 	}
-	return fmt.Sprintf("%v | %v", a.Description, a.Status)
+}
+
+func (n *LeanChat) GetTitle(a *Alert) string {
+	return n.tmpl.Execute(TemplateTitle, n.templateData(a))
 }
 
 func (n *LeanChat) GetDescription(a *Alert) string {
-	return fmt.Sprintf("%v %v    %s %s", n.TimeHeader, a.StartsAt.Format(n.TimeLayout), DefaultLeanAlertIdHeader, a.Id)
+	desc := n.tmpl.Execute(TemplateBody, n.templateData(a))
+	if footer := n.tmpl.Execute(TemplateFooter, n.templateData(a)); footer != "" {
+		desc += "\n" + footer
+	}
+	return desc
 }
 
 func (n *LeanChat) GetEmergencyText() string {
-	return fmt.Sprintf("该告警被升级请赶紧处理告警")
+	return DefaultLeanChatEmergencyText
 }
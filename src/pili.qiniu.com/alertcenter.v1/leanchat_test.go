@@ -0,0 +1,56 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestLeanChat(t *testing.T) {
+	ast := assert.New(t)
+
+	reqC := make(chan leanChatReq, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ast.Equal("/services/test-service", r.URL.Path)
+		var req leanChatReq
+		ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+		reqC <- req
+		w.Write([]byte(`{"error": 0}`))
+	}))
+	defer ts.Close()
+
+	ns := NewNotifiers(NotifiersCfg{
+		Default: "leanchat",
+		LeanChatCfgs: []LeanChatCfg{
+			{
+				Name:          "leanchat",
+				Hosts:         []string{ts.URL},
+				ServiceId:     "test-service",
+				Channel:       "alert",
+				MaxDisplayCnt: 1,
+				PortalUrl:     "http://portal",
+			},
+		},
+	}, nil, nil, nil)
+	ast.Equal([]string{"leanchat"}, ns.GetNames())
+
+	n := ns.notifiers["leanchat"]
+	a1 := &Alert{Id: bson.NewObjectId(), Description: "a1", Status: AlertFiring, Severity: SeverityCritical, IsEmergent: true}
+	a2 := &Alert{Id: bson.NewObjectId(), Description: "a2", Status: AlertFiring}
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a1, a2)))
+
+	req := <-reqC
+	ast.Equal("alert", req.Channel)
+	ast.Equal(DefaultLeanChatDisplayUser, req.DisplayUser.Name)
+	ast.Equal(1, len(req.Attachments))
+	ast.Equal("a1 | firing", req.Attachments[0].Title)
+	ast.Equal(LeanChatError, req.Attachments[0].Color)
+	ast.Equal(2, len(req.Buttons))
+	ast.Equal("http://portal", req.Buttons[0].Url)
+	ast.Equal(DefaultLeanChatEmergencyText, req.Buttons[1].Text)
+}
@@ -2,6 +2,8 @@ package alertcenter
 
 import (
 	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"sort"
 	"sync"
@@ -39,7 +41,13 @@ type Service struct {
 	dutyMgr         DutyManager
 	historyMgr      *HistoryMgr
 	alertProfileMgr *AlertProfileMgr
+	silenceMgr      *SilenceMgr
+	inhibitor       *Inhibitor
+	grouper         *Grouper
+	eventMgr        *EventMgr
+	outbox          *Outbox
 	sendC           chan Message
+	sendF           func(msg Message)
 	analyzers       map[string]Analyzer
 }
 
@@ -52,11 +60,6 @@ func (cfg *Config) Check() {
 func NewService(cfg *Config) *Service {
 	cfg.Check()
 
-	sendC := make(chan Message, cfg.MsgBacklog)
-	sendF := func(msg Message) {
-		sendC <- msg
-	}
-
 	reloadMgo, err := pmgo.New(cfg.ReloadMgoOpt)
 	if err != nil {
 		log.Panic("pmgo.New(cfg.ReloadMgoOpt) err:", err)
@@ -64,11 +67,23 @@ func NewService(cfg *Config) *Service {
 	cfg.AlertProfileCfg.ReloadColl = reloadMgo
 
 	alertProfileMgr := NewAlertProfileMgr(cfg.AlertProfileCfg)
-	historyMgr := NewHistoryMgr(cfg.HistoryCfg, alertProfileMgr)
+	eventMgr := NewEventMgr(cfg.EventCfg)
+	historyMgr := NewHistoryMgr(cfg.HistoryCfg, alertProfileMgr, eventMgr)
+
+	// Outbox
+	outbox := NewOutbox(cfg.OutboxCfg, eventMgr)
+	sendC := make(chan Message, cfg.MsgBacklog)
+	// 先持久化再放入 sendC，进程重启后由 outbox.Queued 恢复
+	sendF := func(msg Message) {
+		outbox.Queue(&msg)
+		sendC <- msg
+	}
 
 	// Actions
-	alertActiveMgr := NewAlertActiveMgr(sendF, cfg.AlertActiveCfg, historyMgr)
-	actions := NewActions(alertActiveMgr)
+	silenceMgr := NewSilenceMgr(cfg.SilenceCfg)
+	alertActiveMgr := NewAlertActiveMgr(sendF, cfg.AlertActiveCfg, historyMgr, eventMgr)
+	inhibitor := NewInhibitor(cfg.InhibitCfg, alertActiveMgr)
+	actions := NewActions(silenceMgr, inhibitor, alertActiveMgr)
 
 	// DutyMgr
 	dutyMgr, err := NewDutyMgr(cfg.DutyCfg)
@@ -77,12 +92,22 @@ func NewService(cfg *Config) *Service {
 	}
 
 	// Notifiers
-	ns := NewNotifiers(cfg.NotifiersCfg, alertProfileMgr)
+	ns := NewNotifiers(cfg.NotifiersCfg, alertProfileMgr, dutyMgr, eventMgr)
 
 	// Caller
-	caller := NewCaller(cfg.CallerCfg, dutyMgr, sendF)
+	caller := NewCaller(cfg.CallerCfg, dutyMgr, sendF, eventMgr)
+	caller.callLogs = NewCallLogMgr(cfg.CallLogCfg)
 	ns.Append(&caller)
 
+	// Sms
+	sms := NewSms(cfg.SmsCfg, cfg.CallerCfg.MorseUid, caller.morse, dutyMgr, eventMgr)
+	ns.Append(sms)
+	if sms.CallFollowUp {
+		caller.FollowUpWithSms(sms)
+	}
+
+	ns.UseOutbox(outbox)
+
 	// Analyzer
 	analyzers := make(map[string]Analyzer)
 	for _, j := range cfg.AnalyzerCfgs {
@@ -103,10 +128,28 @@ func NewService(cfg *Config) *Service {
 		analyzers:       analyzers,
 		notifiers:       ns,
 		sendC:           sendC,
+		sendF:           sendF,
 		historyMgr:      historyMgr,
 		alertProfileMgr: alertProfileMgr,
+		silenceMgr:      silenceMgr,
+		inhibitor:       inhibitor,
+		eventMgr:        eventMgr,
+		outbox:          outbox,
 	}
+	// 通过闭包获取 s.notifiers，便于替换 notifiers
+	s.grouper = NewGrouper(cfg.GroupCfg, alertProfileMgr, eventMgr, func(msg Message) {
+		s.notifiers.Notify(msg)
+	})
+	alertActiveMgr.ackF = func(xl *xlog.Logger, a *Alert, ack Ack) {
+		if ns, ok := s.notifiers.(Notifiers); ok {
+			ns.Ack(xl, a, ack)
+		}
+	}
+	caller.ackF = alertActiveMgr.Ack
+	caller.getAlertF = alertActiveMgr.GetById
 	go s.Send()
+	go s.requeue(xlog.NewDummy())
+	go outbox.Run(xlog.NewDummy())
 	return s
 }
 
@@ -114,11 +157,32 @@ func (s *Service) Send() {
 	for {
 		select {
 		case msg := <-s.sendC:
-			s.notifiers.Notify(msg)
+			msg.Alerts = s.silenceMgr.Filter(msg.xl, msg.Alerts)
+			msg.Alerts = s.inhibitor.Filter(msg.xl, msg.Alerts)
+			if len(msg.Alerts) == 0 {
+				s.outbox.Dequeue(msg)
+				continue
+			}
+			s.grouper.Add(msg)
 		}
 	}
 }
 
+// 重新发送上一次退出时还在 sendC 或者分组中的消息，它们已经持久化过，不再调用 sendF
+func (s *Service) requeue(xl *xlog.Logger) {
+	msgs, err := s.outbox.Queued()
+	if err != nil {
+		xl.Errorf("Service.requeue outbox.Queued() err: %v", err)
+		return
+	}
+	if len(msgs) != 0 {
+		xl.Infof("Service.requeue %v queued messages", len(msgs))
+	}
+	for _, msg := range msgs {
+		s.sendC <- msg
+	}
+}
+
 type cmdArgs struct {
 	CmdArgs []string
 }
@@ -160,7 +224,7 @@ func (s *Service) PostAlerts(args *PostAlertsPushArgs, env *rpcutil.Env) (err er
 	m, _ := json.Marshal(msg)
 	xl.Debugf("%s", string(m))
 
-	s.sendC <- msg
+	s.sendF(msg)
 	return
 }
 
@@ -226,7 +290,7 @@ func (s *Service) PostPrometheusAlerts(args *PostPrometheusAlertsPushArgs, env *
 	m, _ := json.Marshal(msg)
 	xl.Debugf("%s", string(m))
 
-	s.sendC <- msg
+	s.sendF(msg)
 	return
 }
 
@@ -307,13 +371,122 @@ func (s *Service) PostAlertsAck(args *AlertsAckArgs, env *rpcutil.Env) (err erro
 	xl.Debugf("PostAlertsAck Begin, Args: %v", args)
 	defer xl.Debugf("PostAlertsAck End")
 
-	err = s.alertActiveMgr.Ack(args)
+	err = s.alertActiveMgr.Ack(xl, args)
 	if err != nil {
 		xl.Errorf("[AlertProfileMgr.Ack] AlertsAckArgs: %v, err: %v", args, err)
 	}
 	return
 }
 
+/*
+POST /feishu/callback
+飞书应用机器人卡片上 Ack 按钮的回调，以点击用户的名字 ack 告警，告警已经恢复或者不存在时返回 404
+告警已经被 ack 时再点击 Ack 不做处理
+*/
+func (s *Service) PostFeishuCallback(args *FeishuCallbackArgs, env *rpcutil.Env) (ret map[string]string, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("PostFeishuCallback Begin, Args: %v", args)
+	defer xl.Debugf("PostFeishuCallback End")
+
+	ackArgs, err := ParseFeishuCallback(s.NotifiersCfg.FeishuCfgs, args)
+	if err != nil {
+		xl.Errorf("[ParseFeishuCallback] args: %v, err: %v", args, err)
+		return
+	}
+	if ackArgs == nil {
+		return map[string]string{"challenge": args.Challenge}, nil
+	}
+	ids := ackArgs.Ids[:0]
+	for _, id := range ackArgs.Ids {
+		a, ok := s.alertActiveMgr.GetById(id)
+		if !ok {
+			xl.Errorf("[PostFeishuCallback] alertId: %v, err: %v", id, ErrAlertNotFound)
+			return nil, ErrAlertNotFound
+		}
+		if a.Status == AlertAcked {
+			xl.Infof("[PostFeishuCallback] alertId: %v already acked", id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return map[string]string{}, nil
+	}
+	ackArgs.Ids = ids
+	err = s.alertActiveMgr.Ack(xl, ackArgs)
+	if err != nil {
+		xl.Errorf("[AlertActiveMgr.Ack] AlertsAckArgs: %v, err: %v", ackArgs, err)
+		return
+	}
+	return map[string]string{}, nil
+}
+
+/*
+POST /slack/interactions
+Slack 消息上 Ack、Silence 1h、Resolve 按钮的回调，校验签名后以点击用户的名字执行操作，返回更新后的消息替换原消息
+告警已经被 ack 时再点击 Ack 不做处理，只在消息中显示之前 ack 的人
+*/
+func (s *Service) PostSlackInteractions(env *rpcutil.Env) (ret *SlackReq, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("PostSlackInteractions Begin")
+	defer xl.Debugf("PostSlackInteractions End")
+
+	body, err := ioutil.ReadAll(env.Req.Body)
+	if err != nil {
+		return
+	}
+	p, username, err := ParseSlackInteraction(s.NotifiersCfg.SlackCfgs, env.Req.Header, body, time.Now())
+	if err != nil {
+		xl.Errorf("[ParseSlackInteraction] err: %v", err)
+		return
+	}
+
+	id := p.CallbackId
+	var text string
+	switch p.Actions[0].Name {
+	case SlackActionAck:
+		a, ok := s.alertActiveMgr.GetById(id)
+		if !ok {
+			err = ErrAlertNotFound
+			break
+		}
+		if a.Status == AlertAcked {
+			text = "already acked"
+			if len(a.Acks) != 0 {
+				text = fmt.Sprintf("already acked by *%v*", a.Acks[len(a.Acks)-1].Username)
+			}
+			break
+		}
+		ackArgs := &AlertsAckArgs{
+			Ids:      []string{id},
+			Comment:  DefaultSlackAckComment,
+			Username: username,
+		}
+		err = s.alertActiveMgr.Ack(xl, ackArgs)
+		text = fmt.Sprintf("*%v* acked", username)
+	case SlackActionSilence:
+		a, ok := s.alertActiveMgr.GetById(id)
+		if !ok {
+			err = ErrAlertNotFound
+			break
+		}
+		silence := NewSlackSilence(&a, username, time.Now())
+		err = s.silenceMgr.Create(silence)
+		text = fmt.Sprintf("*%v* silenced until %v", username, silence.EndsAt.Format(timeFmt))
+	case SlackActionResolve:
+		err = s.alertActiveMgr.Resolve(xl, id)
+		text = fmt.Sprintf("*%v* resolved", username)
+	default:
+		err = ErrInvalidSlackAction
+	}
+	if err != nil {
+		xl.Errorf("[PostSlackInteractions] action: %v, alertId: %v, err: %v", p.Actions[0].Name, id, err)
+		return
+	}
+	ret = p.UpdatedMessage(text)
+	return
+}
+
 // 创建 AlertProfile
 func (s *Service) PostAlertsProfiles(args *AlertProfile, env *rpcutil.Env) (err error) {
 	xl := xlog.New(env.W, env.Req)
@@ -447,24 +620,252 @@ func (s *Service) GetAlertsNotifiers(args *AlertProfileArgs, env *rpcutil.Env) (
 	return
 }
 
+type NotifierTestArgs struct {
+	Notifier    string   `json:"notifier"`
+	Severity    Severity `json:"severity"`
+	Description string   `json:"description"`
+	Confirm     bool     `json:"confirm"` // 测试 caller、sms 时必须为 true
+}
+
+type NotifierTestRet struct {
+	Notifier     string `json:"notifier"`
+	Success      bool   `json:"success"`
+	Error        string `json:"error,omitempty"`
+	ResolveError string `json:"resolve_error,omitempty"`
+	DurationMS   int64  `json:"duration_ms"`
+}
+
+/*
+POST /alerts/notifiers/test
+通过指定的 notifier 直接发送一条测试告警并返回发送结果，不经过 outbox，也不记录告警历史
+发送成功后再发送一条恢复通知；caller、sms 会打扰值班人员，需要 confirm 为 true
+*/
+func (s *Service) PostAlertsNotifiersTest(args *NotifierTestArgs, env *rpcutil.Env) (ret NotifierTestRet, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("PostAlertsNotifiersTest Begin, Args: %v", args)
+	defer xl.Debugf("PostAlertsNotifiersTest End")
+
+	ns, ok := s.notifiers.(Notifiers)
+	if !ok {
+		return ret, httputil.NewError(http.StatusInternalServerError, "s.notifiers is not type of Notifiers")
+	}
+	n, ok := ns.Get(args.Notifier)
+	if !ok {
+		return ret, ErrNotifierNotFound
+	}
+	if NeedTestConfirm(n) && !args.Confirm {
+		return ret, ErrTestNotConfirmed
+	}
+
+	start := time.Now()
+	err1, resolveErr := SendTestAlert(xl, n, NewTestAlert(args.Severity, args.Description))
+	ret = NotifierTestRet{
+		Notifier:   args.Notifier,
+		Success:    err1 == nil,
+		DurationMS: int64(time.Since(start) / time.Millisecond),
+	}
+	if err1 != nil {
+		xl.Errorf("[PostAlertsNotifiersTest] notifier: %v, err: %v", args.Notifier, err1)
+		ret.Error = err1.Error()
+	}
+	if resolveErr != nil {
+		xl.Errorf("[PostAlertsNotifiersTest] notifier: %v, resolve err: %v", args.Notifier, resolveErr)
+		ret.ResolveError = resolveErr.Error()
+	}
+	return
+}
+
+type NotifierPreviewArgs struct {
+	Notifier string   `json:"notifier"`
+	Alerts   []*Alert `json:"alerts"`
+}
+
+type NotifierPreviewRet struct {
+	Notifier string      `json:"notifier"`
+	Payload  interface{} `json:"payload"`
+}
+
+/*
+POST /alerts/notifiers/preview
+返回 notifier 渲染后的消息但是不发送，alerts 为空时使用测试告警
+*/
+func (s *Service) PostAlertsNotifiersPreview(args *NotifierPreviewArgs, env *rpcutil.Env) (ret NotifierPreviewRet, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("PostAlertsNotifiersPreview Begin, Args: %v", args)
+	defer xl.Debugf("PostAlertsNotifiersPreview End")
+
+	ns, ok := s.notifiers.(Notifiers)
+	if !ok {
+		return ret, httputil.NewError(http.StatusInternalServerError, "s.notifiers is not type of Notifiers")
+	}
+	n, ok := ns.Get(args.Notifier)
+	if !ok {
+		return ret, ErrNotifierNotFound
+	}
+	p, ok := n.(Previewer)
+	if !ok {
+		return ret, ErrPreviewNotSupported
+	}
+
+	as := args.Alerts
+	if len(as) == 0 {
+		as = []*Alert{NewTestAlert("", "")}
+	}
+	for _, a := range as {
+		if a.Status == "" {
+			a.Status = AlertFiring
+		}
+	}
+	ret.Notifier = args.Notifier
+	ret.Payload, err = p.Preview(NewMessage(xl, as...))
+	if err != nil {
+		xl.Errorf("[Previewer.Preview] notifier: %v, err: %v", args.Notifier, err)
+		err = httputil.NewError(400, err.Error())
+	}
+	return
+}
+
 func (s *Service) DeleteAlerts_(args *cmdArgs, env *rpcutil.Env) (err error) {
 	xl := xlog.New(env.W, env.Req)
 	xl.Debugf("DeleteAlerts_ Begin, Args: %v", args)
 	defer xl.Debugf("DeleteAlerts_ End")
 
-	err = s.alertActiveMgr.Delete(args.CmdArgs[0])
+	err = s.alertActiveMgr.Delete(xl, args.CmdArgs[0])
 	if err != nil {
 		xl.Errorf("[AlertActiveMgr.Delete] cmdArgs: %v, err: %v", args, err)
 	}
 	return
 }
 
+/*
+GET /alerts/:id/timeline
+返回告警从触发到恢复过程中的所有事件，按时间排序
+*/
+func (s *Service) GetAlerts_Timeline(args *cmdArgs, env *rpcutil.Env) (ret []Event, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("GetAlerts_Timeline Begin, Args: %v", args)
+	defer xl.Debugf("GetAlerts_Timeline End")
+
+	id := args.CmdArgs[0]
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidObjectId
+	}
+	ret, err = s.eventMgr.Timeline(bson.ObjectIdHex(id))
+	if err != nil {
+		xl.Errorf("[EventMgr.Timeline] id: %v, err: %v", id, err)
+	}
+	return
+}
+
+// =================== Outbox ===================
+
+/*
+GET /outbox/deliveries?status=<status>&notifier=<notifier>&limit=<limit>&marker=<marker>
+列出还没有发送成功的消息
+*/
+func (s *Service) GetOutboxDeliveries(args *DeliveriesQuery, env *rpcutil.Env) (ret map[string]interface{}, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("GetOutboxDeliveries Begin, Args: %v", args)
+	defer xl.Debugf("GetOutboxDeliveries End")
+
+	deliveries, rmarker, err := s.outbox.List(args)
+	if err != nil {
+		xl.Errorf("[Outbox.List] args: %v, err: %v", args, err)
+		return
+	}
+
+	ret = bson.M{
+		"items":  deliveries,
+		"marker": rmarker,
+	}
+	return
+}
+
+// POST /outbox/deliveries/:id/replay
+func (s *Service) PostOutboxDeliveries_Replay(args *cmdArgs, env *rpcutil.Env) (err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("PostOutboxDeliveries_Replay Begin, Args: %v", args)
+	defer xl.Debugf("PostOutboxDeliveries_Replay End")
+
+	id := args.CmdArgs[0]
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidObjectId
+	}
+	err = s.outbox.Replay(bson.ObjectIdHex(id))
+	if err != nil {
+		xl.Errorf("[Outbox.Replay] id: %v, err: %v", id, err)
+	}
+	return
+}
+
+// =================== Silences ===================
+
+/*
+POST /silences
+{
+  "matchers": [ // 必填
+    {
+      "name": "alertname",
+      "value": "pili_vdn_node_.*",
+      "type": "=~" // = | != | =~ | !~
+    }
+  ],
+  "startsAt": "", // 不填则从现在开始
+  "endsAt": "", // 必填
+  "createdBy": "", // 必填
+  "comment": ""
+}
+*/
+func (s *Service) PostSilences(args *Silence, env *rpcutil.Env) (ret Silence, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("PostSilences Begin, Args: %v", args)
+	defer xl.Debugf("PostSilences End")
+
+	err = s.silenceMgr.Create(args)
+	if err != nil {
+		xl.Errorf("[SilenceMgr.Create] silence: %v, err: %v", args, err)
+		return
+	}
+	ret = *args
+	return
+}
+
+// GET /silences
+func (s *Service) GetSilences(env *rpcutil.Env) (ret []Silence, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debug("GetSilences Begin")
+	defer xl.Debug("GetSilences End")
+
+	ret, err = s.silenceMgr.List()
+	if err != nil {
+		xl.Errorf("[SilenceMgr.List] err: %v", err)
+	}
+	return
+}
+
+// GET /silences/:id
+func (s *Service) GetSilences_(arg *cmdArgs) (interface{}, error) {
+	id := arg.CmdArgs[0]
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidObjectId
+	}
+	return s.silenceMgr.Get(bson.ObjectIdHex(id))
+}
+
+// DELETE /silences/:id
+func (s *Service) DeleteSilences_(arg *cmdArgs) error {
+	id := arg.CmdArgs[0]
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidObjectId
+	}
+	return s.silenceMgr.Delete(bson.ObjectIdHex(id))
+}
+
 // =================== Caller ===================
 
 type CallerParamsRet struct {
-	StartAt      int       `json:"startAt"`
-	EndAt        int       `json:"endAt"`
-	CloseEndTime time.Time `json:"closeEndTime"`
+	QuietHours   []QuietHour `json:"quietHours"`
+	CloseEndTime time.Time   `json:"closeEndTime"`
 }
 
 func (s *Service) GetCallerParams(env *rpcutil.Env) (ret CallerParamsRet, err error) {
@@ -473,8 +874,7 @@ func (s *Service) GetCallerParams(env *rpcutil.Env) (ret CallerParamsRet, err er
 	defer xl.Debug("GetCallerParams End")
 
 	ret = CallerParamsRet{
-		StartAt:      s.caller.StartAt,
-		EndAt:        s.caller.EndAt,
+		QuietHours:   s.caller.ListQuietHours(),
 		CloseEndTime: s.caller.CloseEndTime,
 	}
 	return
@@ -505,49 +905,194 @@ func (s *Service) DeleteCallerTempclose(env *rpcutil.Env) (err error) {
 	return
 }
 
-type CallerSilenceArgs struct {
-	StartAt string `json:"startAt"`
-	EndAt   string `json:"endAt"`
+/*
+POST /caller/quiethours
+新增不打电话的时间段
+*/
+func (s *Service) PostCallerQuiethours(args *QuietHour, env *rpcutil.Env) (ret QuietHour, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("PostCallerQuiethours Begin, Args: %v", args)
+	defer xl.Debugf("PostCallerQuiethours End")
+
+	err = s.caller.CreateQuietHour(xl, args)
+	if err != nil {
+		xl.Errorf("[Caller.CreateQuietHour] args: %v, err: %v", args, err)
+		return
+	}
+	return *args, nil
 }
 
-func (s *Service) PostCallerSilence(args *CallerSilenceArgs, env *rpcutil.Env) (err error) {
+func (s *Service) GetCallerQuiethours(env *rpcutil.Env) (ret []QuietHour, err error) {
 	xl := xlog.New(env.W, env.Req)
-	xl.Debug("PostCallerSilence Begin")
-	defer xl.Debug("PostCallerSilence End")
+	xl.Debug("GetCallerQuiethours Begin")
+	defer xl.Debug("GetCallerQuiethours End")
 
-	if args.StartAt == "" || args.EndAt == "" {
-		err = httputil.NewError(400, "startAt or startAt cann't be empty")
-		return
+	return s.caller.ListQuietHours(), nil
+}
+
+func (s *Service) GetCallerQuiethours_(args *cmdArgs, env *rpcutil.Env) (ret QuietHour, err error) {
+	id := args.CmdArgs[0]
+	if !bson.IsObjectIdHex(id) {
+		return ret, ErrQuietHourNotFound
 	}
+	return s.caller.GetQuietHour(bson.ObjectIdHex(id))
+}
+
+type updateQuietHourArg struct {
+	CmdArgs []string
+	QuietHour
+}
+
+/*
+POST /caller/quiethours/<id>
+修改不打电话的时间段，使用请求中的所有字段替换原来的时间段
+*/
+func (s *Service) PostCallerQuiethours_(args *updateQuietHourArg, env *rpcutil.Env) (err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("PostCallerQuiethours_ Begin, Args: %v", args)
+	defer xl.Debugf("PostCallerQuiethours_ End")
 
-	sa, err := time.Parse(timeFmt, args.StartAt)
+	id := args.CmdArgs[0]
+	if !bson.IsObjectIdHex(id) {
+		return ErrQuietHourNotFound
+	}
+	err = s.caller.UpdateQuietHour(xl, bson.ObjectIdHex(id), &args.QuietHour)
 	if err != nil {
-		err = httputil.NewError(400, "startAt fmt error")
-		return
+		xl.Errorf("[Caller.UpdateQuietHour] args: %v, err: %v", args, err)
+	}
+	return
+}
+
+func (s *Service) DeleteCallerQuiethours_(args *cmdArgs, env *rpcutil.Env) (err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("DeleteCallerQuiethours_ Begin, Args: %v", args)
+	defer xl.Debugf("DeleteCallerQuiethours_ End")
+
+	id := args.CmdArgs[0]
+	if !bson.IsObjectIdHex(id) {
+		return ErrQuietHourNotFound
 	}
-	ea, err := time.Parse(timeFmt, args.EndAt)
+	return s.caller.RemoveQuietHour(xl, bson.ObjectIdHex(id))
+}
+
+/*
+GET /caller/calls?begin=<begin>&end=<end>&staff=<staff>&alertname=<alertname>&limit=<limit>&marker=<marker>
+呼叫日志，按时间倒序
+*/
+func (s *Service) GetCallerCalls(args *CallLogQuery, env *rpcutil.Env) (ret map[string]interface{}, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("GetCallerCalls Begin, Args: %v", args)
+	defer xl.Debugf("GetCallerCalls End")
+
+	logs, rmarker, err := s.caller.callLogs.List(args)
 	if err != nil {
-		err = httputil.NewError(400, "endAt fmt error")
+		xl.Errorf("[CallLogMgr.List] args: %v, err: %v", args, err)
 		return
 	}
-	if sa.After(ea) {
-		err = httputil.NewError(400, "startAt after endAt")
-		return
+
+	ret = bson.M{
+		"items":  logs,
+		"marker": rmarker,
+	}
+	return
+}
+
+/*
+GET /caller/calls/stats?begin=<begin>&end=<end>&staff=<staff>&alertname=<alertname>
+按天、人统计呼叫次数，用于核对语音服务的账单，begin、end 必须指定且不超过 31 天
+*/
+func (s *Service) GetCallerCallsStats(args *CallLogQuery, env *rpcutil.Env) (ret []CallStat, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("GetCallerCallsStats Begin, Args: %v", args)
+	defer xl.Debugf("GetCallerCallsStats End")
+
+	ret, err = s.caller.callLogs.Stats(args)
+	if err != nil {
+		xl.Errorf("[CallLogMgr.Stats] args: %v, err: %v", args, err)
 	}
+	return
+}
+
+/*
+GET /caller/chains
+正在进行中的呼叫，按开始呼叫的时间排序
+*/
+func (s *Service) GetCallerChains(env *rpcutil.Env) (ret []CallChain, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debug("GetCallerChains Begin")
+	defer xl.Debug("GetCallerChains End")
+
+	return s.caller.Chains(), nil
+}
+
+/*
+GET /caller/chains/<alertId>
+*/
+func (s *Service) GetCallerChains_(args *cmdArgs, env *rpcutil.Env) (ret CallChain, err error) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("GetCallerChains_ Begin, Args: %v", args)
+	defer xl.Debugf("GetCallerChains_ End")
 
-	err = s.caller.Silence(xl, sa.Hour()*60*60+sa.Minute()*60, ea.Hour()*60*60+ea.Minute()*60)
+	ret, ok := s.caller.Chain(args.CmdArgs[0])
+	if !ok {
+		err = ErrCallNotFound
+	}
 	return
 }
 
-func (s *Service) DeleteCallerSilence(env *rpcutil.Env) (err error) {
+/*
+POST /caller/callback
+语音服务的呼叫状态回调，使用 caller_cfg 中的 callback_secret 校验签名，
+接听或按键之后不再重拨，按键时以接听人的名字 ack 告警
+*/
+func (s *Service) PostCallerCallback(env *rpcutil.Env) (err error) {
 	xl := xlog.New(env.W, env.Req)
-	xl.Debug("DeleteCallerSilence Begin")
-	defer xl.Debug("DeleteCallerSilence End")
+	xl.Debugf("PostCallerCallback Begin")
+	defer xl.Debugf("PostCallerCallback End")
 
-	s.caller.UnsetSilence(xl)
+	body, err := ioutil.ReadAll(env.Req.Body)
+	if err != nil {
+		return
+	}
+	args, err := s.caller.ParseCallback(env.Req.Header, body, time.Now())
+	if err != nil {
+		xl.Errorf("[Caller.ParseCallback] err: %v", err)
+		return
+	}
+	err = s.caller.Callback(xl, args)
+	if err != nil {
+		xl.Errorf("[Caller.Callback] args: %v, err: %v", args, err)
+	}
 	return
 }
 
+/*
+POST /caller/callback/twilio
+Twilio 的状态回调以及 <Gather> 按键的回调，校验签名，按键时返回 TwiML 播报已确认
+*/
+func (s *Service) PostCallerCallbackTwilio(env *rpcutil.Env) {
+	xl := xlog.New(env.W, env.Req)
+	xl.Debugf("PostCallerCallbackTwilio Begin")
+	defer xl.Debugf("PostCallerCallbackTwilio End")
+
+	err := env.Req.ParseForm()
+	if err != nil {
+		httputil.Error(env.W, httputil.NewError(400, err.Error()))
+		return
+	}
+	twiml, err := s.caller.CallbackTwilio(xl, env.Req.Header, env.Req.PostForm)
+	if err != nil {
+		xl.Errorf("[Caller.CallbackTwilio] form: %v, err: %v", env.Req.PostForm, err)
+		httputil.Error(env.W, err)
+		return
+	}
+	if twiml == "" {
+		httputil.ReplyWithCode(env.W, http.StatusNoContent)
+		return
+	}
+	httputil.ReplyWith(env.W, http.StatusOK, "text/xml", []byte(twiml))
+}
+
 // =================== Analyzer ===================
 
 type ResultArgs struct {
@@ -46,6 +46,30 @@ func initService() (s *Service) {
 					MgoColl: "history",
 				},
 			},
+			SilenceCfg: SilenceCfg{
+				MgoOpt: pmgo.Option{
+					MgoDB:   "test-alertcenter",
+					MgoColl: "silence",
+				},
+			},
+			EventCfg: EventCfg{
+				MgoOpt: pmgo.Option{
+					MgoDB:   "test-alertcenter",
+					MgoColl: "event",
+				},
+			},
+			OutboxCfg: OutboxCfg{
+				MgoOpt: pmgo.Option{
+					MgoDB:   "test-alertcenter",
+					MgoColl: "outbox",
+				},
+			},
+			CallLogCfg: CallLogCfg{
+				MgoOpt: pmgo.Option{
+					MgoDB:   "test-alertcenter",
+					MgoColl: "call_log",
+				},
+			},
 		},
 	)
 }
@@ -181,7 +205,7 @@ func TestAlertSilence(t *testing.T) {
 	service.Config.AlertActiveCfg.ResendIntervalS = 1
 
 	internet := make(chan Message)
-	ns := NewNotifiers(NotifiersCfg{Default: "FakeNotifier"}, service.alertProfileMgr)
+	ns := NewNotifiers(NotifiersCfg{Default: "FakeNotifier"}, service.alertProfileMgr, nil, nil)
 	ns.Append(&FakeNotifier{internet})
 	service.notifiers = ns
 
@@ -248,7 +272,7 @@ func TestAll(t *testing.T) {
 	service.alertActiveMgr.EmergenctIntervalS = 1
 
 	internet := make(chan Message)
-	ns := NewNotifiers(NotifiersCfg{Default: "FakeNotifier"}, service.alertProfileMgr)
+	ns := NewNotifiers(NotifiersCfg{Default: "FakeNotifier"}, service.alertProfileMgr, nil, nil)
 	ns.Append(&FakeNotifier{internet})
 	service.notifiers = ns
 
@@ -1,14 +1,42 @@
 package alertcenter
 
 import (
+	"net/http"
+	"time"
+
+	"github.com/qiniu/http/httputil.v1"
 	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+	"labix.org/v2/mgo/bson"
+)
+
+const (
+	TestAlertname          = "alertcenter_test"
+	TestLabel              = "test"
+	DefaultTestDescription = "这是一条测试告警，请忽略"
+	testDescriptionPrefix  = "[TEST] "
+)
+
+var (
+	ErrNotifierNotFound    = httputil.NewError(http.StatusNotFound, "notifier not found")
+	ErrPreviewNotSupported = httputil.NewError(400, "notifier does not support preview")
+	ErrTestNotConfirmed    = httputil.NewError(400, "testing caller or sms notifies on-call staff, set confirm to true")
 )
 
 type NotifiersCfg struct {
-	Default   string              `json:"default"`
-	Routes    map[string][]string `json:"routes"`
-	SlackCfgs []SlackCfg          `json:"slack_cfgs"`
-	QQCfgs    []QQCfg             `json:"qq_cfgs"`
+	Default       string              `json:"default"`
+	Routes        map[string][]string `json:"routes"`
+	SlackCfgs     []SlackCfg          `json:"slack_cfgs"`
+	QQCfgs        []QQCfg             `json:"qq_cfgs"`
+	LeanChatCfgs  []LeanChatCfg       `json:"leanchat_cfgs"`
+	WebhookCfgs   []WebhookCfg        `json:"webhook_cfgs"`
+	EmailCfgs     []EmailCfg          `json:"email_cfgs"`
+	DingTalkCfgs  []DingTalkCfg       `json:"dingtalk_cfgs"`
+	WeComCfgs     []WeComCfg          `json:"wecom_cfgs"`
+	FeishuCfgs    []FeishuCfg         `json:"feishu_cfgs"`
+	TelegramCfgs  []TelegramCfg       `json:"telegram_cfgs"`
+	PagerDutyCfgs []PagerDutyCfg      `json:"pagerduty_cfgs"`
+	TeamsCfgs     []TeamsCfg          `json:"teams_cfgs"`
 }
 
 func (cfg *NotifiersCfg) Check() {
@@ -22,19 +50,26 @@ type Notifier interface {
 	Notify(msg Message) error
 }
 
+// 返回渲染后但是没有发送的消息，用于预览
+type Previewer interface {
+	Preview(msg Message) (interface{}, error)
+}
+
 type Notifiers struct {
 	NotifiersCfg
 	names     []string
 	notifiers map[string]Notifier
 	musts     map[string]Notifier
 
-	apMgr *AlertProfileMgr
+	apMgr  *AlertProfileMgr
+	events *EventMgr
+	outbox *Outbox
 }
 
-func NewNotifiers(cfg NotifiersCfg, apMgr *AlertProfileMgr) Notifiers {
+func NewNotifiers(cfg NotifiersCfg, apMgr *AlertProfileMgr, dutyMgr DutyManager, events *EventMgr) Notifiers {
 	cfg.Check()
 	ns := make(map[string]Notifier)
-	names := make([]string, 0, len(cfg.SlackCfgs)+len(cfg.QQCfgs))
+	names := make([]string, 0, len(cfg.SlackCfgs)+len(cfg.QQCfgs)+len(cfg.LeanChatCfgs)+len(cfg.WebhookCfgs)+len(cfg.EmailCfgs)+len(cfg.DingTalkCfgs)+len(cfg.WeComCfgs)+len(cfg.FeishuCfgs)+len(cfg.TelegramCfgs)+len(cfg.PagerDutyCfgs)+len(cfg.TeamsCfgs))
 
 	// Slack
 	for _, c := range cfg.SlackCfgs {
@@ -48,12 +83,67 @@ func NewNotifiers(cfg NotifiersCfg, apMgr *AlertProfileMgr) Notifiers {
 		ns[n.Name()] = n
 		names = append(names, n.Name())
 	}
+	// LeanChat
+	for _, c := range cfg.LeanChatCfgs {
+		n := NewLeanChat(c)
+		ns[n.Name()] = n
+		names = append(names, n.Name())
+	}
+	// Webhook
+	for _, c := range cfg.WebhookCfgs {
+		n := NewWebhook(c)
+		ns[n.Name()] = n
+		names = append(names, n.Name())
+	}
+	// Email
+	for _, c := range cfg.EmailCfgs {
+		n := NewEmail(c)
+		ns[n.Name()] = n
+		names = append(names, n.Name())
+	}
+	// DingTalk
+	for _, c := range cfg.DingTalkCfgs {
+		n := NewDingTalk(c, dutyMgr)
+		ns[n.Name()] = n
+		names = append(names, n.Name())
+	}
+	// WeCom
+	for _, c := range cfg.WeComCfgs {
+		n := NewWeCom(c, dutyMgr)
+		ns[n.Name()] = n
+		names = append(names, n.Name())
+	}
+	// Feishu
+	for _, c := range cfg.FeishuCfgs {
+		n := NewFeishu(c)
+		ns[n.Name()] = n
+		names = append(names, n.Name())
+	}
+	// Telegram
+	for _, c := range cfg.TelegramCfgs {
+		n := NewTelegram(c)
+		ns[n.Name()] = n
+		names = append(names, n.Name())
+	}
+	// PagerDuty
+	for _, c := range cfg.PagerDutyCfgs {
+		n := NewPagerDuty(c)
+		ns[n.Name()] = n
+		names = append(names, n.Name())
+	}
+	// Teams
+	for _, c := range cfg.TeamsCfgs {
+		n := NewTeams(c)
+		ns[n.Name()] = n
+		names = append(names, n.Name())
+	}
 	return Notifiers{
 		NotifiersCfg: cfg,
 		names:        names,
 		notifiers:    ns,
 		musts:        make(map[string]Notifier),
 		apMgr:        apMgr,
+		events:       events,
 	}
 }
 
@@ -62,6 +152,12 @@ func (ns *Notifiers) Append(n Notifier) {
 	ns.names = append(ns.names, n.Name())
 }
 
+// 使用 outbox 持久化发送记录并在失败时重试
+func (ns *Notifiers) UseOutbox(o *Outbox) {
+	o.notifiers = ns.notifiers
+	ns.outbox = o
+}
+
 func (ns *Notifiers) AppendMust(n Notifier) {
 	ns.musts[n.Name()] = n
 	ns.names = append(ns.names, n.Name())
@@ -76,27 +172,21 @@ func (ns Notifiers) Notify(msg Message) (err error) {
 
 	nMsgMap := make(map[string]Message) // notifier => message
 	for _, a := range msg.Alerts {
-		var notifiers []string
-		if ap, ok := ns.apMgr.GetByCache(a.Alertname); ok {
-			if len(ap.Notifiers) != 0 {
-				notifiers = ap.Notifiers
-			}
-		}
-
-		// use default
-		if len(notifiers) == 0 {
-			notifiers = []string{ns.Default}
-		}
-
-		// handle oncall
-		if ap, ok := ns.apMgr.GetByCache(a.Alertname); a.IsEmergent || (ok && ap.NeedOncall) {
-			notifiers = append(notifiers, CallerName)
+		notifiers := msg.Notifiers
+		if len(notifiers) == 0 && a.Status == AlertResolved {
+			notifiers = ns.deliveredTo(a)
+		} else if len(notifiers) == 0 {
+			notifiers = ns.route(a)
+		} else if msg.SkipRouted {
+			notifiers = ns.skipRouted(a, notifiers, len(msg.Staffs) != 0)
 		}
 
 		for _, notifier := range notifiers {
 			m, ok := nMsgMap[notifier]
 			if !ok {
 				m.xl = msg.xl
+				m.Staffs = msg.Staffs
+				m.Escalated = msg.Escalated
 			}
 			m.Alerts = append(m.Alerts, a)
 			nMsgMap[notifier] = m
@@ -104,9 +194,130 @@ func (ns Notifiers) Notify(msg Message) (err error) {
 	}
 	for _, notifier := range ns.notifiers {
 		if msg, ok := nMsgMap[notifier.Name()]; ok {
-			go notifier.Notify(msg)
+			ns.notify(notifier, msg)
+		}
+	}
+	// delivery 都已经写入 outbox，不再需要从队列中恢复
+	ns.outbox.Dequeue(msg)
+	return
+}
+
+// 写入 outbox 后异步发送
+// caller 有自己的重拨逻辑，不经过 outbox
+func (ns Notifiers) notify(n Notifier, msg Message) {
+	if ns.outbox != nil && n.Name() != CallerName {
+		ns.outbox.Deliver(n, msg)
+		return
+	}
+	go ns.notifyDirect(n, msg)
+}
+
+// 记录每个 notifier 的发送结果
+func (ns Notifiers) notifyDirect(n Notifier, msg Message) {
+	err := n.Notify(msg)
+	evs := make([]Event, 0, len(msg.Alerts))
+	for _, a := range msg.Alerts {
+		ev := NewEvent(EventNotified, a)
+		ev.Notifier = n.Name()
+		ev.Result = EventResult(err)
+		evs = append(evs, ev)
+	}
+	ns.events.Record(msg.xl, evs...)
+}
+
+// 告警被 ack 时通知实现了 AckNotifier 的 notifier，比如 PagerDuty
+func (ns Notifiers) Ack(xl *xlog.Logger, a *Alert, ack Ack) {
+	for _, name := range ns.deliveredTo(a) {
+		n, ok := ns.notifiers[name].(AckNotifier)
+		if !ok {
+			continue
+		}
+		err := n.Ack(xl, a, ack)
+		ev := NewEvent(EventNotified, a)
+		ev.Notifier = name
+		ev.Result = EventResult(err)
+		ev.Detail = "ack"
+		ns.events.Record(xl, ev)
+	}
+}
+
+// 告警发送过的 notifier，除了 route 选中的，还有升级策略发送过的，比如只在升级步骤中配置的 PagerDuty
+// ack 和恢复通知都发送给这些 notifier
+func (ns Notifiers) deliveredTo(a *Alert) (notifiers []string) {
+	notifiers = ns.route(a)
+	seen := make(map[string]bool)
+	for _, name := range notifiers {
+		seen[name] = true
+	}
+	for _, e := range a.Escalations {
+		for _, name := range e.Notifiers {
+			if !seen[name] {
+				seen[name] = true
+				notifiers = append(notifiers, name)
+			}
+		}
+	}
+	return
+}
+
+// 去掉 route 已经选中的 notifier，指定了打电话的人时 caller 打给的是不同的人，不去掉
+func (ns Notifiers) skipRouted(a *Alert, notifiers []string, hasStaffs bool) (ret []string) {
+	routed := make(map[string]bool)
+	for _, name := range ns.route(a) {
+		routed[name] = true
+	}
+	for _, name := range notifiers {
+		if routed[name] && !(name == CallerName && hasStaffs) {
+			continue
+		}
+		ret = append(ret, name)
+	}
+	return
+}
+
+// 根据 AlertProfile 选择 notifiers
+func (ns Notifiers) route(a *Alert) (notifiers []string) {
+	if ap, ok := ns.apMgr.GetByCache(a.Alertname); ok {
+		if len(ap.Notifiers) != 0 {
+			notifiers = append(notifiers, ap.Notifiers...)
+		}
+	}
+
+	// use default
+	if len(notifiers) == 0 {
+		notifiers = []string{ns.Default}
+	}
+
+	// handle oncall
+	if ap, ok := ns.apMgr.GetByCache(a.Alertname); a.IsEmergent || (ok && ap.NeedOncall) {
+		notifiers = append(notifiers, CallerName)
+	}
+	return
+}
+
+// 有正在触发的 P0 告警时返回当前值班人员的手机号，用于在群消息中 @ 值班人员
+func oncallMobiles(xl *xlog.Logger, dutyMgr DutyManager, as []*Alert) (mobiles []string) {
+	if dutyMgr == nil {
+		return
+	}
+	needAt := false
+	for _, a := range as {
+		if a.Severity == SeverityP0 && a.Status == AlertFiring {
+			needAt = true
+			break
 		}
 	}
+	if !needAt {
+		return
+	}
+	staffs, err := dutyMgr.GetCurrent(xl)
+	if err != nil {
+		xl.Errorf("oncallMobiles dutyMgr.GetCurrent err: %v", err)
+		return
+	}
+	for _, staff := range staffs {
+		mobiles = append(mobiles, staff.Phones...)
+	}
 	return
 }
 
@@ -120,3 +331,60 @@ func (ns Notifiers) MustNotify(msg Message) (err error) {
 func (ns Notifiers) GetNames() (names []string) {
 	return ns.names
 }
+
+func (ns Notifiers) Get(name string) (n Notifier, ok bool) {
+	n, ok = ns.notifiers[name]
+	if !ok {
+		n, ok = ns.musts[name]
+	}
+	return
+}
+
+// 打电话、发短信的测试会打扰值班人员，需要确认之后才发送
+func NeedTestConfirm(n Notifier) bool {
+	switch n.(type) {
+	case *Caller, *Sms:
+		return true
+	}
+	return false
+}
+
+// 发送测试告警，成功之后再发送一条恢复通知，关闭 PagerDuty 的 incident、Slack 的 thread 等
+// 打电话、发短信不需要恢复通知
+func SendTestAlert(xl *xlog.Logger, n Notifier, a *Alert) (err, resolveErr error) {
+	if c, ok := n.(*Caller); ok {
+		err = c.NotifyTest(xl, a)
+		return
+	}
+	err = n.Notify(NewMessage(xl, a))
+	if err != nil || NeedTestConfirm(n) {
+		return
+	}
+	resolved := *a
+	resolved.Status = AlertResolved
+	resolved.Severity = SeveritySuccess
+	resolved.EndsAt = time.Now()
+	resolveErr = n.Notify(NewMessage(xl, &resolved))
+	return
+}
+
+// 测试告警的 alertname 为 alertcenter_test，带有 test=true 的 label，描述以 [TEST] 开头
+func NewTestAlert(severity Severity, description string) *Alert {
+	if severity == "" {
+		severity = SeverityWarning
+	}
+	if description == "" {
+		description = DefaultTestDescription
+	}
+	now := time.Now()
+	return &Alert{
+		Id:          bson.NewObjectId(),
+		Key:         TestAlertname + "_" + now.Format("20060102150405"),
+		Alertname:   TestAlertname,
+		Description: testDescriptionPrefix + description,
+		Status:      AlertFiring,
+		Severity:    severity,
+		Labels:      map[string]string{TestLabel: "true"},
+		StartsAt:    now,
+	}
+}
@@ -0,0 +1,133 @@
+package alertcenter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifiersPreview(t *testing.T) {
+	ast := assert.New(t)
+
+	ns := NewNotifiers(NotifiersCfg{
+		Default:   "slack",
+		SlackCfgs: []SlackCfg{{Name: "slack"}},
+		QQCfgs:    []QQCfg{{Name: "qq", Robot: "r", To: "t", OpType: "o", AK: "ak", SK: "sk"}},
+	}, nil, nil, nil)
+	ns.Append(&FakeNotifier{})
+
+	a := NewTestAlert("", "")
+	ast.Equal(TestAlertname, a.Alertname)
+	ast.Equal("true", a.Labels[TestLabel])
+	ast.Equal(SeverityWarning, a.Severity)
+	ast.True(strings.HasPrefix(a.Description, "[TEST] "))
+	msg := NewMessage(xlog.NewDummy(), a)
+
+	n, ok := ns.Get("slack")
+	ast.True(ok)
+	payload, err := n.(Previewer).Preview(msg)
+	ast.NoError(err)
+	req := payload.(*SlackReq)
+	ast.Equal(1, len(req.Attachments))
+	ast.Equal("[TEST] "+DefaultTestDescription+" | firing", req.Attachments[0].Title)
+
+	n, ok = ns.Get("qq")
+	ast.True(ok)
+	payload, err = n.(Previewer).Preview(msg)
+	ast.NoError(err)
+	ast.Equal("[TEST] "+DefaultTestDescription+"\nhttp://", payload)
+
+	n, ok = ns.Get("FakeNotifier")
+	ast.True(ok)
+	_, ok = n.(Previewer)
+	ast.False(ok)
+
+	_, ok = ns.Get("notexist")
+	ast.False(ok)
+}
+
+func TestNotifiersSkipRouted(t *testing.T) {
+	ast := assert.New(t)
+
+	apMgr := &AlertProfileMgr{
+		cache: map[string]AlertProfile{
+			"test": {Alertname: "test", Notifiers: []string{"slack"}, NeedOncall: true},
+		},
+	}
+	ns := NewNotifiers(NotifiersCfg{Default: "slack"}, apMgr, nil, nil)
+
+	a := &Alert{Alertname: "test"}
+	ast.Equal([]string{"qq"}, ns.skipRouted(a, []string{"slack", "qq", CallerName}, false))
+	// 指定了打电话的人时仍然打电话
+	ast.Equal([]string{"qq", CallerName}, ns.skipRouted(a, []string{"slack", "qq", CallerName}, true))
+	ast.Equal([]string{CallerName}, ns.skipRouted(&Alert{Alertname: "other"}, []string{"slack", CallerName}, false))
+}
+
+func TestSendTestAlert(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+
+	sendC := make(chan Message, 2)
+	err, resolveErr := SendTestAlert(xl, &FakeNotifier{sendC}, NewTestAlert("", ""))
+	ast.NoError(err)
+	ast.NoError(resolveErr)
+	ast.Equal(AlertFiring, (<-sendC).Alerts[0].Status)
+	// 成功之后发送恢复通知
+	resolved := (<-sendC).Alerts[0]
+	ast.Equal(AlertResolved, resolved.Status)
+	ast.Equal(SeveritySuccess, resolved.Severity)
+
+	ast.True(NeedTestConfirm(&Caller{}))
+	ast.True(NeedTestConfirm(&Sms{}))
+	ast.False(NeedTestConfirm(&FakeNotifier{}))
+}
+
+type fakeAckNotifier struct {
+	FakeNotifier
+	name string
+	ackC chan *Alert
+}
+
+func (n *fakeAckNotifier) Name() string {
+	return n.name
+}
+
+func (n *fakeAckNotifier) Ack(xl *xlog.Logger, a *Alert, ack Ack) error {
+	n.ackC <- a
+	return nil
+}
+
+func TestNotifiersDeliveredTo(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+
+	apMgr := &AlertProfileMgr{
+		cache: map[string]AlertProfile{
+			"test": {Alertname: "test", Notifiers: []string{"slack"}},
+		},
+	}
+	ns := NewNotifiers(NotifiersCfg{Default: "slack"}, apMgr, nil, nil)
+	sendC := make(chan Message, 2)
+	ackC := make(chan *Alert, 2)
+	ns.Append(&fakeAckNotifier{FakeNotifier{sendC}, "pagerduty", ackC})
+
+	// 只在升级步骤中配置的 notifier 也会收到 ack 和恢复通知
+	a := &Alert{Alertname: "test", Status: AlertFiring, Escalations: []EscalationRecord{
+		{Notifiers: []string{"slack"}},
+		{Notifiers: []string{"pagerduty", CallerName}},
+	}}
+	ast.Equal([]string{"slack", "pagerduty", CallerName}, ns.deliveredTo(a))
+
+	ns.Ack(xl, a, Ack{Username: "test"})
+	ast.Equal(a, <-ackC)
+
+	resolved := *a
+	resolved.Status = AlertResolved
+	ns.Notify(NewMessage(xl, &resolved))
+	ast.Equal(AlertResolved, (<-sendC).Alerts[0].Status)
+
+	// 没有升级过时只发送给 route 选中的 notifier
+	ast.Equal([]string{"slack"}, ns.deliveredTo(&Alert{Alertname: "test"}))
+}
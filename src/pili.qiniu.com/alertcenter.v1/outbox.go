@@ -0,0 +1,376 @@
+package alertcenter
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/qiniu/http/httputil.v1"
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+
+	pmgo "pili.qiniu.com/mgo"
+)
+
+const (
+	DefaultOutboxMaxAttempts = 8
+	DefaultOutboxBackoffMS   = 10 * 1e3
+	DefaultOutboxMaxBackoffS = 30 * 60
+	DefaultOutboxPollMS      = 1e3
+	DefaultOutboxLeaseS      = 60
+	DefaultOutboxListLimit   = 100
+)
+
+var (
+	ErrDeliveryNotFound = httputil.NewError(http.StatusNotFound, "delivery not found")
+)
+
+type DeliveryStatus string
+
+const (
+	DeliveryPending DeliveryStatus = "pending" // 等待发送或者重试
+	DeliveryDead    DeliveryStatus = "dead"    // 超过最大重试次数，需要人工 replay
+)
+
+// 一条消息发送给多个目标的 notifier，比如 Telegram 的多个会话、短信的多个手机号
+// targets 为空时发送给所有目标，返回发送失败的目标，outbox 重试时只发送给这些目标
+type TargetsNotifier interface {
+	Notifier
+	NotifyTargets(msg Message, targets []string) (failed []string, err error)
+}
+
+// 发送给某一个 notifier 的一条消息，发送成功后删除
+type Delivery struct {
+	Id        bson.ObjectId   `json:"id" bson:"_id"`
+	Notifier  string          `json:"notifier" bson:"notifier"`
+	Alerts    []*Alert        `json:"alerts" bson:"alerts"`
+	Staffs    []bson.ObjectId `json:"staffs,omitempty" bson:"staffs,omitempty"`
+	Targets   []string        `json:"targets,omitempty" bson:"targets,omitempty"` // 重试时只发送给这些目标，为空时发送给所有目标
+	ReqId     string          `json:"reqId" bson:"reqId"`
+	Status    DeliveryStatus  `json:"status" bson:"status"`
+	Attempts  int             `json:"attempts" bson:"attempts"`
+	NextAt    time.Time       `json:"nextAt" bson:"nextAt"`
+	LastError string          `json:"lastError" bson:"lastError"`
+	CreateAt  time.Time       `json:"createAt" bson:"createAt"`
+	UpdateAt  time.Time       `json:"updateAt" bson:"updateAt"`
+}
+
+func (d *Delivery) Message() Message {
+	return Message{
+		xl:     xlog.NewWith(d.ReqId),
+		Alerts: d.Alerts,
+		Staffs: d.Staffs,
+	}
+}
+
+// 放入 sendC 之前持久化的消息，发送给各个 notifier 的 delivery 写入 outbox 后删除
+// 进程重启时还在 sendC 或者分组中等待的消息从这里恢复
+type QueuedMessage struct {
+	Id         bson.ObjectId   `bson:"_id"`
+	Alerts     []*Alert        `bson:"alerts"`
+	Notifiers  []string        `bson:"notifiers,omitempty"`
+	Staffs     []bson.ObjectId `bson:"staffs,omitempty"`
+	Escalated  bool            `bson:"escalated,omitempty"`
+	SkipRouted bool            `bson:"skipRouted,omitempty"`
+	Resend     bool            `bson:"resend,omitempty"`
+	ReqId      string          `bson:"reqId"`
+	CreateAt   time.Time       `bson:"createAt"`
+}
+
+func (q *QueuedMessage) Message() Message {
+	return Message{
+		xl:         xlog.NewWith(q.ReqId),
+		Alerts:     q.Alerts,
+		Notifiers:  q.Notifiers,
+		Staffs:     q.Staffs,
+		Escalated:  q.Escalated,
+		SkipRouted: q.SkipRouted,
+		Resend:     q.Resend,
+		queueIds:   []bson.ObjectId{q.Id},
+	}
+}
+
+// 第 n 次失败后等待 BackoffMS * 2^(n-1)，最多等待 MaxBackoffS
+// QueueMgoOpt 为空时使用 MgoOpt 所在的 db，collection 为 MgoOpt.MgoColl + "_queue"
+type OutboxCfg struct {
+	MgoOpt      pmgo.Option `json:"mgo_opt"`
+	QueueMgoOpt pmgo.Option `json:"queue_mgo_opt"`
+	MaxAttempts int         `json:"max_attempts"`
+	BackoffMS   int         `json:"backoff_ms"`
+	MaxBackoffS int         `json:"max_backoff_s"`
+	PollMS      int         `json:"poll_ms"`
+	// 取出 delivery 后在 LeaseS 秒内其他实例不会重复发送
+	LeaseS int `json:"lease_s"`
+}
+
+func (cfg *OutboxCfg) Check() {
+	if cfg.QueueMgoOpt.MgoColl == "" {
+		cfg.QueueMgoOpt = cfg.MgoOpt
+		cfg.QueueMgoOpt.MgoColl = cfg.MgoOpt.MgoColl + "_queue"
+	}
+	if cfg.MaxAttempts == 0 {
+		cfg.MaxAttempts = DefaultOutboxMaxAttempts
+	}
+	if cfg.BackoffMS == 0 {
+		cfg.BackoffMS = DefaultOutboxBackoffMS
+	}
+	if cfg.MaxBackoffS == 0 {
+		cfg.MaxBackoffS = DefaultOutboxMaxBackoffS
+	}
+	if cfg.PollMS == 0 {
+		cfg.PollMS = DefaultOutboxPollMS
+	}
+	if cfg.LeaseS == 0 {
+		cfg.LeaseS = DefaultOutboxLeaseS
+	}
+}
+
+func (cfg *OutboxCfg) backoff(attempts int) time.Duration {
+	max := time.Duration(cfg.MaxBackoffS) * time.Second
+	d := time.Duration(cfg.BackoffMS) * time.Millisecond
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+type Outbox struct {
+	*OutboxCfg
+	mgo       pmgo.Mongo
+	queueMgo  pmgo.Mongo
+	events    *EventMgr
+	notifiers map[string]Notifier
+}
+
+func NewOutbox(cfg OutboxCfg, events *EventMgr) *Outbox {
+	cfg.Check()
+	outboxMgo, err := pmgo.New(cfg.MgoOpt)
+	if err != nil {
+		log.Panic("outbox: NewOutbox pmgo.New(cfg.MgoOpt) err:", err)
+	}
+	err = outboxMgo.Coll().EnsureIndex(mgo.Index{Key: []string{"status", "nextAt"}})
+	if err != nil {
+		log.Panic("outbox: EnsureIndex(status, nextAt) err:", err)
+	}
+	queueMgo, err := pmgo.New(cfg.QueueMgoOpt)
+	if err != nil {
+		log.Panic("outbox: NewOutbox pmgo.New(cfg.QueueMgoOpt) err:", err)
+	}
+	return &Outbox{
+		OutboxCfg: &cfg,
+		mgo:       outboxMgo,
+		queueMgo:  queueMgo,
+		events:    events,
+	}
+}
+
+// 放入 sendC 之前持久化，写入失败时消息依然会发送，只是重启后不能恢复
+func (o *Outbox) Queue(msg *Message) {
+	q := QueuedMessage{
+		Id:         bson.NewObjectId(),
+		Alerts:     msg.Alerts,
+		Notifiers:  msg.Notifiers,
+		Staffs:     msg.Staffs,
+		Escalated:  msg.Escalated,
+		SkipRouted: msg.SkipRouted,
+		Resend:     msg.Resend,
+		ReqId:      msg.xl.ReqId(),
+		CreateAt:   time.Now(),
+	}
+	err := o.queueMgo.Coll().Insert(q)
+	if err != nil {
+		msg.xl.Errorf("Outbox.Queue insert message, err: %v", err)
+		return
+	}
+	msg.queueIds = append(msg.queueIds, q.Id)
+}
+
+// 消息已经写入 outbox 或者被过滤掉，o 为 nil 时不处理，方便单独使用 Notifiers
+func (o *Outbox) Dequeue(msg Message) {
+	if o == nil || len(msg.queueIds) == 0 {
+		return
+	}
+	_, err := o.queueMgo.Coll().RemoveAll(M{"_id": M{"$in": msg.queueIds}})
+	if err != nil {
+		msg.xl.Errorf("Outbox.Dequeue ids: %v, err: %v", msg.queueIds, err)
+	}
+}
+
+// 进程启动时恢复上一次退出时还没有写入 outbox 的消息，按放入的顺序返回
+func (o *Outbox) Queued() (msgs []Message, err error) {
+	var qs []QueuedMessage
+	err = o.queueMgo.Coll().Find(nil).Sort("_id").All(&qs)
+	if err != nil {
+		return
+	}
+	for i := range qs {
+		msgs = append(msgs, qs[i].Message())
+	}
+	return
+}
+
+// 先写入 outbox 再异步发送，进程重启后由 Run 继续重试
+func (o *Outbox) Deliver(n Notifier, msg Message) {
+	now := time.Now()
+	d := Delivery{
+		Id:       bson.NewObjectId(),
+		Notifier: n.Name(),
+		Alerts:   msg.Alerts,
+		Staffs:   msg.Staffs,
+		ReqId:    msg.xl.ReqId(),
+		Status:   DeliveryPending,
+		NextAt:   now.Add(time.Duration(o.LeaseS) * time.Second),
+		CreateAt: now,
+		UpdateAt: now,
+	}
+	err := o.mgo.Coll().Insert(d)
+	if err != nil {
+		// 写入失败时依然尝试发送一次
+		msg.xl.Errorf("Outbox.Deliver insert delivery to %v, err: %v", d.Notifier, err)
+		go func() {
+			o.record(msg, n.Name(), n.Notify(msg), 1)
+		}()
+		return
+	}
+	go o.attempt(n, &d, msg)
+}
+
+func (o *Outbox) attempt(n Notifier, d *Delivery, msg Message) {
+	var failed []string
+	var err error
+	if tn, ok := n.(TargetsNotifier); ok {
+		failed, err = tn.NotifyTargets(msg, d.Targets)
+	} else {
+		err = n.Notify(msg)
+	}
+	d.Attempts++
+	o.record(msg, d.Notifier, err, d.Attempts)
+	if err == nil {
+		err = o.mgo.Coll().RemoveId(d.Id)
+		if err != nil && err != mgo.ErrNotFound {
+			msg.xl.Errorf("Outbox remove delivery %v, err: %v", d.Id.Hex(), err)
+		}
+		return
+	}
+
+	now := time.Now()
+	set := M{
+		"attempts":  d.Attempts,
+		"lastError": err.Error(),
+		"updateAt":  now,
+	}
+	if len(failed) != 0 {
+		d.Targets = failed
+		set["targets"] = failed
+	}
+	if d.Attempts >= o.MaxAttempts {
+		set["status"] = DeliveryDead
+		msg.xl.Errorf("Outbox delivery %v to %v is dead after %v attempts, err: %v", d.Id.Hex(), d.Notifier, d.Attempts, err)
+	} else {
+		set["nextAt"] = now.Add(o.backoff(d.Attempts))
+		msg.xl.Warnf("Outbox delivery %v to %v failed %v times, err: %v", d.Id.Hex(), d.Notifier, d.Attempts, err)
+	}
+	err = o.mgo.Coll().UpdateId(d.Id, M{"$set": set})
+	if err != nil {
+		msg.xl.Errorf("Outbox update delivery %v, err: %v", d.Id.Hex(), err)
+	}
+}
+
+func (o *Outbox) record(msg Message, notifier string, err error, attempts int) {
+	evs := make([]Event, 0, len(msg.Alerts))
+	for _, a := range msg.Alerts {
+		ev := NewEvent(EventNotified, a)
+		ev.Notifier = notifier
+		ev.Result = EventResult(err)
+		if attempts > 1 {
+			ev.Detail = "retry"
+		}
+		evs = append(evs, ev)
+	}
+	o.events.Record(msg.xl, evs...)
+}
+
+// 取出一条到期的 delivery，同时推迟 nextAt 避免被重复取出
+func (o *Outbox) next() (d Delivery, err error) {
+	now := time.Now()
+	change := mgo.Change{
+		Update:    M{"$set": M{"nextAt": now.Add(time.Duration(o.LeaseS) * time.Second)}},
+		ReturnNew: true,
+	}
+	q := M{"status": DeliveryPending, "nextAt": M{"$lte": now}}
+	_, err = o.mgo.Coll().Find(q).Sort("nextAt").Apply(change, &d)
+	return
+}
+
+func (o *Outbox) Run(xl *xlog.Logger) {
+	for range time.Tick(time.Duration(o.PollMS) * time.Millisecond) {
+		for {
+			d, err := o.next()
+			if err != nil {
+				if err != mgo.ErrNotFound {
+					xl.Errorf("Outbox.Run o.next() err: %v", err)
+				}
+				break
+			}
+			n, ok := o.notifiers[d.Notifier]
+			if !ok {
+				xl.Errorf("Outbox.Run unknown notifier %v of delivery %v", d.Notifier, d.Id.Hex())
+				o.mgo.Coll().UpdateId(d.Id, M{"$set": M{"status": DeliveryDead, "lastError": "unknown notifier", "updateAt": time.Now()}})
+				continue
+			}
+			o.attempt(n, &d, d.Message())
+		}
+	}
+}
+
+type DeliveriesQuery struct {
+	Status   DeliveryStatus `json:"status"`
+	Notifier string         `json:"notifier"`
+	Limit    int            `json:"limit"`
+	Marker   string         `json:"marker"`
+}
+
+func (o *Outbox) List(args *DeliveriesQuery) (ret []Delivery, marker string, err error) {
+	q := M{}
+	if args.Status != "" {
+		q["status"] = args.Status
+	}
+	if args.Notifier != "" {
+		q["notifier"] = args.Notifier
+	}
+	if args.Marker != "" {
+		if !bson.IsObjectIdHex(args.Marker) {
+			return nil, "", ErrInvalidObjectId
+		}
+		q["_id"] = M{"$lt": bson.ObjectIdHex(args.Marker)}
+	}
+	if args.Limit <= 0 || args.Limit > DefaultOutboxListLimit {
+		args.Limit = DefaultOutboxListLimit
+	}
+	err = o.mgo.Coll().Find(q).Sort("-_id").Limit(args.Limit).All(&ret)
+	if err != nil {
+		return
+	}
+	if len(ret) == args.Limit {
+		marker = ret[len(ret)-1].Id.Hex()
+	}
+	return
+}
+
+// 重置重试次数，由 Run 立即重新发送
+func (o *Outbox) Replay(id bson.ObjectId) (err error) {
+	err = o.mgo.Coll().UpdateId(id, M{"$set": M{
+		"status":   DeliveryPending,
+		"attempts": 0,
+		"nextAt":   time.Now(),
+		"updateAt": time.Now(),
+	}})
+	if err == mgo.ErrNotFound {
+		err = ErrDeliveryNotFound
+	}
+	return
+}
@@ -0,0 +1,153 @@
+package alertcenter
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+
+	pmgo "pili.qiniu.com/mgo"
+)
+
+type flakyNotifier struct {
+	fails int
+	sendC chan Message
+}
+
+func (n *flakyNotifier) Name() string {
+	return "flaky"
+}
+
+func (n *flakyNotifier) Notify(msg Message) error {
+	if n.fails > 0 {
+		n.fails--
+		return errors.New("service unavailable")
+	}
+	n.sendC <- msg
+	return nil
+}
+
+// 第一次发送时 fail 目标失败，之后都成功
+type flakyTargetsNotifier struct {
+	fail    string
+	targetC chan []string
+}
+
+func (n *flakyTargetsNotifier) Name() string {
+	return "flaky-targets"
+}
+
+func (n *flakyTargetsNotifier) Notify(msg Message) error {
+	_, err := n.NotifyTargets(msg, nil)
+	return err
+}
+
+func (n *flakyTargetsNotifier) NotifyTargets(msg Message, targets []string) (failed []string, err error) {
+	n.targetC <- targets
+	if n.fail != "" {
+		failed, n.fail = []string{n.fail}, ""
+		return failed, errors.New("target unavailable")
+	}
+	return
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	ast := assert.New(t)
+
+	cfg := OutboxCfg{BackoffMS: 1000, MaxBackoffS: 5}
+	cfg.Check()
+	ast.Equal(time.Second, cfg.backoff(1))
+	ast.Equal(2*time.Second, cfg.backoff(2))
+	ast.Equal(4*time.Second, cfg.backoff(3))
+	ast.Equal(5*time.Second, cfg.backoff(4))
+	ast.Equal(5*time.Second, cfg.backoff(100))
+}
+
+func TestOutbox(t *testing.T) {
+	log.Println("TestOutbox Begin")
+	defer log.Println("TestOutbox End")
+	defer clearTestDB()
+	xl := xlog.NewDummy()
+	ast := assert.New(t)
+
+	outbox := NewOutbox(OutboxCfg{
+		MgoOpt: pmgo.Option{
+			MgoDB:   "test-alertcenter",
+			MgoColl: "outbox",
+		},
+		MaxAttempts: 2,
+		BackoffMS:   10,
+		PollMS:      10,
+	}, nil)
+	n := &flakyNotifier{fails: 3, sendC: make(chan Message, 1)}
+	ns := NewNotifiers(NotifiersCfg{Default: "flaky"}, nil, nil, nil)
+	ns.Append(n)
+	ns.UseOutbox(outbox)
+	go outbox.Run(xl)
+
+	a := &Alert{Id: bson.NewObjectId(), Key: "test", Alertname: "test"}
+	outbox.Deliver(n, NewMessage(xl, a))
+
+	// 重试一次后进入 dead letter
+	var ds []Delivery
+	var err error
+	for i := 0; i < 100; i++ {
+		ds, _, err = outbox.List(&DeliveriesQuery{Status: DeliveryDead})
+		ast.NoError(err)
+		if len(ds) != 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ast.Equal(1, len(ds))
+	ast.Equal(2, ds[0].Attempts)
+	ast.Equal("service unavailable", ds[0].LastError)
+
+	// replay 后再失败一次，第二次重试成功
+	ast.NoError(outbox.Replay(ds[0].Id))
+	select {
+	case msg := <-n.sendC:
+		ast.Equal(1, len(msg.Alerts))
+		ast.Equal("test", msg.Alerts[0].Key)
+	case <-time.After(time.Second):
+		ast.Fail("replay timeout")
+	}
+	time.Sleep(50 * time.Millisecond)
+	ds, _, err = outbox.List(&DeliveriesQuery{})
+	ast.NoError(err)
+	ast.Equal(0, len(ds))
+
+	ast.Equal(ErrDeliveryNotFound, outbox.Replay(bson.NewObjectId()))
+
+	// 重试时只发送给失败的目标
+	tn := &flakyTargetsNotifier{fail: "b", targetC: make(chan []string, 2)}
+	outbox.notifiers[tn.Name()] = tn
+	outbox.Deliver(tn, NewMessage(xl, a))
+	ast.Nil(<-tn.targetC)
+	select {
+	case targets := <-tn.targetC:
+		ast.Equal([]string{"b"}, targets)
+	case <-time.After(time.Second):
+		ast.Fail("retry timeout")
+	}
+	// 放入 sendC 之前持久化的消息，重启后恢复，写入 outbox 后删除
+	msg := NewMessage(xl, a)
+	msg.Notifiers = []string{"flaky"}
+	outbox.Queue(&msg)
+	ast.Equal(1, len(msg.queueIds))
+	msgs, err := outbox.Queued()
+	ast.NoError(err)
+	if ast.Equal(1, len(msgs)) {
+		ast.Equal(msg.queueIds, msgs[0].queueIds)
+		ast.Equal([]string{"flaky"}, msgs[0].Notifiers)
+		ast.Equal("test", msgs[0].Alerts[0].Key)
+	}
+	ns.Notify(msgs[0])
+	msgs, err = outbox.Queued()
+	ast.NoError(err)
+	ast.Equal(0, len(msgs))
+}
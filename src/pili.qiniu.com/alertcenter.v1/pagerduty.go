@@ -0,0 +1,176 @@
+package alertcenter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	DefaultPagerDutyUrl       = "https://events.pagerduty.com/v2/enqueue"
+	DefaultPagerDutySource    = "alertcenter"
+	DefaultPagerDutyTimeoutMS = 10 * 1e3
+
+	PagerDutyTrigger     = "trigger"
+	PagerDutyAcknowledge = "acknowledge"
+	PagerDutyResolve     = "resolve"
+)
+
+// 实现 AckNotifier 的通知方式会在告警被 ack 时收到通知
+type AckNotifier interface {
+	Notifier
+	Ack(xl *xlog.Logger, a *Alert, ack Ack) error
+}
+
+// 使用 Alert.Key 作为 dedup_key，告警触发、ack、恢复时分别发送 trigger、acknowledge、resolve 事件
+type PagerDutyCfg struct {
+	Name       string `json:"name"`
+	Url        string `json:"url"`
+	RoutingKey string `json:"routing_key"`
+	Source     string `json:"source"`
+	TimeoutMS  int    `json:"timeout_ms"`
+}
+
+func (cfg *PagerDutyCfg) Check() {
+	if cfg.Name == "" {
+		log.Panic("miss Name of pagerDutyCfg")
+	}
+	if cfg.RoutingKey == "" {
+		log.Panic("miss RoutingKey of pagerDutyCfg:", cfg.Name)
+	}
+	if cfg.Url == "" {
+		cfg.Url = DefaultPagerDutyUrl
+	}
+	if cfg.Source == "" {
+		cfg.Source = DefaultPagerDutySource
+	}
+	if cfg.TimeoutMS == 0 {
+		cfg.TimeoutMS = DefaultPagerDutyTimeoutMS
+	}
+}
+
+type PagerDuty struct {
+	*PagerDutyCfg
+	cli *http.Client
+}
+
+func NewPagerDuty(cfg PagerDutyCfg) *PagerDuty {
+	cfg.Check()
+	return &PagerDuty{
+		PagerDutyCfg: &cfg,
+		cli:          &http.Client{Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond},
+	}
+}
+
+func NewPagerDutySeverity(s Severity) string {
+	switch s {
+	case SeverityCritical, SeverityP0:
+		return "critical"
+	case SeveritySuccess, SeverityInfo:
+		return "info"
+	default:
+		return "warning"
+	}
+}
+
+type pagerDutyPayload struct {
+	Summary       string            `json:"summary"`
+	Source        string            `json:"source"`
+	Severity      string            `json:"severity"`
+	Timestamp     string            `json:"timestamp,omitempty"`
+	Class         string            `json:"class,omitempty"`
+	CustomDetails map[string]string `json:"custom_details,omitempty"`
+}
+
+type pagerDutyLink struct {
+	Href string `json:"href"`
+	Text string `json:"text"`
+}
+
+type PagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+	Links       []pagerDutyLink   `json:"links,omitempty"`
+}
+
+func (n *PagerDuty) Name() string {
+	return n.PagerDutyCfg.Name
+}
+
+func (n *PagerDuty) Notify(msg Message) (err error) {
+	for _, ev := range n.GetEvents(msg) {
+		err1 := n.SendEvent(msg.xl, ev)
+		if err1 != nil {
+			err = err1
+		}
+	}
+	return
+}
+
+func (n *PagerDuty) Preview(msg Message) (interface{}, error) {
+	return n.GetEvents(msg), nil
+}
+
+func (n *PagerDuty) GetEvents(msg Message) []*PagerDutyEvent {
+	evs := make([]*PagerDutyEvent, 0, len(msg.Alerts))
+	for _, a := range msg.Alerts {
+		ev := &PagerDutyEvent{
+			RoutingKey: n.RoutingKey,
+			DedupKey:   a.Key,
+		}
+		if a.Status == AlertResolved {
+			ev.EventAction = PagerDutyResolve
+		} else {
+			ev.EventAction = PagerDutyTrigger
+			ev.Payload = &pagerDutyPayload{
+				Summary:       a.Description,
+				Source:        n.Source,
+				Severity:      NewPagerDutySeverity(a.Severity),
+				Timestamp:     a.StartsAt.Format(time.RFC3339),
+				Class:         a.Alertname,
+				CustomDetails: a.Labels,
+			}
+			if a.GeneratorURL != "" {
+				ev.Links = []pagerDutyLink{{Href: a.GeneratorURL, Text: a.Alertname}}
+			}
+		}
+		evs = append(evs, ev)
+	}
+	return evs
+}
+
+func (n *PagerDuty) Ack(xl *xlog.Logger, a *Alert, ack Ack) error {
+	return n.SendEvent(xl, &PagerDutyEvent{
+		RoutingKey:  n.RoutingKey,
+		EventAction: PagerDutyAcknowledge,
+		DedupKey:    a.Key,
+	})
+}
+
+func (n *PagerDuty) SendEvent(xl *xlog.Logger, ev *PagerDutyEvent) (err error) {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	resp, err := n.cli.Post(n.Url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		xl.Errorf("PagerDuty %v %v dedup_key: %v, err: %v", n.Name(), ev.EventAction, ev.DedupKey, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("pagerduty response %v: %s", resp.StatusCode, body)
+		xl.Errorf("PagerDuty %v %v dedup_key: %v, err: %v", n.Name(), ev.EventAction, ev.DedupKey, err)
+	}
+	return
+}
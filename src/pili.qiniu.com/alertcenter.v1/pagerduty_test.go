@@ -0,0 +1,75 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestPagerDuty(t *testing.T) {
+	ast := assert.New(t)
+
+	evC := make(chan PagerDutyEvent, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev PagerDutyEvent
+		ast.NoError(json.NewDecoder(r.Body).Decode(&ev))
+		evC <- ev
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(`{"status": "success", "message": "Event processed"}`))
+	}))
+	defer ts.Close()
+
+	apMgr := &AlertProfileMgr{
+		cache: map[string]AlertProfile{
+			"test": {Alertname: "test", Notifiers: []string{"pagerduty"}},
+		},
+	}
+	ns := NewNotifiers(NotifiersCfg{
+		Default: "pagerduty",
+		PagerDutyCfgs: []PagerDutyCfg{
+			{Name: "pagerduty", Url: ts.URL, RoutingKey: "routing-key"},
+		},
+	}, apMgr, nil, nil)
+	n := ns.notifiers["pagerduty"]
+	xl := xlog.NewDummy()
+
+	a := &Alert{
+		Id:           bson.NewObjectId(),
+		Key:          "key1",
+		Alertname:    "test",
+		Description:  "disk full",
+		Status:       AlertFiring,
+		Severity:     SeverityP0,
+		StartsAt:     time.Now(),
+		GeneratorURL: "http://prom",
+		Labels:       map[string]string{"idc": "xs"},
+	}
+	ast.NoError(n.Notify(NewMessage(xl, a)))
+	ev := <-evC
+	ast.Equal("routing-key", ev.RoutingKey)
+	ast.Equal(PagerDutyTrigger, ev.EventAction)
+	ast.Equal("key1", ev.DedupKey)
+	ast.Equal("disk full", ev.Payload.Summary)
+	ast.Equal("critical", ev.Payload.Severity)
+	ast.Equal(map[string]string{"idc": "xs"}, ev.Payload.CustomDetails)
+	ast.Equal("http://prom", ev.Links[0].Href)
+
+	// ack 时发送 acknowledge
+	ns.Ack(xl, a, Ack{Username: "test"})
+	ev = <-evC
+	ast.Equal(PagerDutyAcknowledge, ev.EventAction)
+	ast.Equal("key1", ev.DedupKey)
+	ast.Nil(ev.Payload)
+
+	a.Status = AlertResolved
+	ast.NoError(n.Notify(NewMessage(xl, a)))
+	ev = <-evC
+	ast.Equal(PagerDutyResolve, ev.EventAction)
+	ast.Equal("key1", ev.DedupKey)
+}
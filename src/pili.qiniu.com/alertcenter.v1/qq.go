@@ -27,11 +27,20 @@ type QQCfg struct {
 	AK       string `json:"ak"`
 	SK       string `json:"sk"`
 	MaxLines int    `json:"max_lines"`
+
+	// 每个告警的 title、body、footer 模板，以换行分隔
+	Template TemplateCfg `json:"template"`
+}
+
+var DefaultQQTemplate = TemplateCfg{
+	Title: `{{.Description}}`,
+	Body:  `{{.GeneratorURL}}`,
 }
 
 type QQ struct {
 	*QQCfg
-	Cli rpc.Client
+	Cli  rpc.Client
+	tmpl *Templates
 }
 
 func (cfg *QQCfg) Check() {
@@ -72,6 +81,7 @@ func NewQQ(cfg QQCfg) *QQ {
 		Cli: rpc.Client{
 			Client: digest_auth.NewClient(cfg.AK, cfg.SK, nil),
 		},
+		tmpl: NewTemplates(cfg.Template, DefaultQQTemplate),
 	}
 }
 
@@ -84,20 +94,26 @@ func (n *QQ) Notify(msg Message) (err error) {
 	if len(msg.Alerts) == 0 {
 		return
 	}
+	err = n.SendMsg(xl, n.GetMsg(msg))
+	return
+}
+
+func (n *QQ) Preview(msg Message) (interface{}, error) {
+	return n.GetMsg(msg), nil
+}
+
+func (n *QQ) GetMsg(msg Message) string {
 	desc := ""
 	for i, a := range msg.Alerts {
 		if i == n.MaxLines {
 			continue
 		}
-		desc += a.Description + "\n"
 		if !strings.HasPrefix(a.GeneratorURL, "http://") && !strings.HasPrefix(a.GeneratorURL, "https://") {
 			a.GeneratorURL = "http://" + a.GeneratorURL
 		}
-		desc += a.GeneratorURL
+		desc += n.GetText(a)
 	}
-
-	err = n.SendMsg(xl, desc)
-	return
+	return desc
 }
 
 func (n *QQ) SendMsg(xl *xlog.Logger, desc string) (err error) {
@@ -113,3 +129,12 @@ func (n *QQ) SendMsg(xl *xlog.Logger, desc string) (err error) {
 	}
 	return
 }
+
+func (n *QQ) GetText(a *Alert) string {
+	data := &TemplateData{Alert: a}
+	text := n.tmpl.Execute(TemplateTitle, data) + "\n" + n.tmpl.Execute(TemplateBody, data)
+	if footer := n.tmpl.Execute(TemplateFooter, data); footer != "" {
+		text += "\n" + footer
+	}
+	return text
+}
@@ -0,0 +1,185 @@
+package alertcenter
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/qiniu/http/httputil.v1"
+	"github.com/qiniu/xlog.v1"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	ErrQuietHourNotFound = httputil.NewError(http.StatusNotFound, "quiet hour not found")
+)
+
+// 不打电话的时间段，StartAt 大于 EndAt 时跨过零点，比如 22:00-08:00，StartAt 等于 EndAt 时表示全天
+// Weekdays 为开始的那一天是星期几，0 表示星期天，为空时表示每天；Timezone 为空时使用本地时区
+// ExemptSeverities 中级别的告警在这个时间段内仍然打电话
+type QuietHour struct {
+	Id               bson.ObjectId `json:"id"`
+	Weekdays         []int         `json:"weekdays"`
+	StartAt          string        `json:"startAt"`
+	EndAt            string        `json:"endAt"`
+	Timezone         string        `json:"timezone"`
+	ExemptSeverities []Severity    `json:"exemptSeverities"`
+}
+
+func parseMinute(s string) (int, error) {
+	t, err := time.Parse(timeFmt, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (q *QuietHour) location() (*time.Location, error) {
+	if q.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(q.Timezone)
+}
+
+func (q *QuietHour) Check() error {
+	if _, err := parseMinute(q.StartAt); err != nil {
+		return httputil.NewError(400, "startAt fmt error")
+	}
+	if _, err := parseMinute(q.EndAt); err != nil {
+		return httputil.NewError(400, "endAt fmt error")
+	}
+	for _, d := range q.Weekdays {
+		if d < 0 || d > 6 {
+			return httputil.NewError(400, "wrong weekday")
+		}
+	}
+	if _, err := q.location(); err != nil {
+		return httputil.NewError(400, "unknown timezone")
+	}
+	return nil
+}
+
+func (q *QuietHour) onDay(d time.Weekday) bool {
+	if len(q.Weekdays) == 0 {
+		return true
+	}
+	for _, w := range q.Weekdays {
+		if time.Weekday(w) == d {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *QuietHour) Exempt(s Severity) bool {
+	for _, e := range q.ExemptSeverities {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// now 是否在这个时间段内，跨过零点时零点之后的部分属于前一天
+func (q *QuietHour) Contains(now time.Time) bool {
+	loc, err := q.location()
+	if err != nil {
+		return false
+	}
+	start, err := parseMinute(q.StartAt)
+	if err != nil {
+		return false
+	}
+	end, err := parseMinute(q.EndAt)
+	if err != nil {
+		return false
+	}
+
+	now = now.In(loc)
+	m := now.Hour()*60 + now.Minute()
+	today := now.Weekday()
+	yesterday := now.AddDate(0, 0, -1).Weekday()
+	switch {
+	case start == end:
+		return q.onDay(today)
+	case start < end:
+		return q.onDay(today) && m >= start && m < end
+	}
+	return (m >= start && q.onDay(today)) || (m < end && q.onDay(yesterday))
+}
+
+// 返回 now 所在的、severity 没有豁免的时间段
+func (c *Caller) InQuietHours(now time.Time, s Severity) (q QuietHour, ok bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for _, q := range c.QuietHours {
+		if q.Contains(now) && !q.Exempt(s) {
+			return q, true
+		}
+	}
+	return
+}
+
+func (c *Caller) ListQuietHours() []QuietHour {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return append([]QuietHour{}, c.QuietHours...)
+}
+
+func (c *Caller) GetQuietHour(id bson.ObjectId) (q QuietHour, err error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	for _, q := range c.QuietHours {
+		if q.Id == id {
+			return q, nil
+		}
+	}
+	return q, ErrQuietHourNotFound
+}
+
+func (c *Caller) CreateQuietHour(xl *xlog.Logger, q *QuietHour) (err error) {
+	if err = q.Check(); err != nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	q.Id = bson.NewObjectId()
+	c.QuietHours = append(c.QuietHours, *q)
+	save(xl, c.CallerParams, c.FilePath)
+	return
+}
+
+func (c *Caller) UpdateQuietHour(xl *xlog.Logger, id bson.ObjectId, q *QuietHour) (err error) {
+	if err = q.Check(); err != nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := range c.QuietHours {
+		if c.QuietHours[i].Id == id {
+			q.Id = id
+			c.QuietHours[i] = *q
+			save(xl, c.CallerParams, c.FilePath)
+			return
+		}
+	}
+	return ErrQuietHourNotFound
+}
+
+func (c *Caller) RemoveQuietHour(xl *xlog.Logger, id bson.ObjectId) (err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for i := range c.QuietHours {
+		if c.QuietHours[i].Id == id {
+			c.QuietHours = append(c.QuietHours[:i], c.QuietHours[i+1:]...)
+			save(xl, c.CallerParams, c.FilePath)
+			return
+		}
+	}
+	return ErrQuietHourNotFound
+}
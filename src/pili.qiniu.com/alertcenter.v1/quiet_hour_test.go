@@ -0,0 +1,95 @@
+package alertcenter
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuietHourContains(t *testing.T) {
+	ast := assert.New(t)
+
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	ast.NoError(err)
+	at := func(day, hour, min int) time.Time {
+		// 2017-11-13 是星期一
+		return time.Date(2017, 11, day, hour, min, 0, 0, shanghai)
+	}
+
+	cases := []struct {
+		q    QuietHour
+		now  time.Time
+		want bool
+	}{
+		{QuietHour{StartAt: "09:00", EndAt: "18:00", Timezone: "Asia/Shanghai"}, at(13, 9, 0), true},
+		{QuietHour{StartAt: "09:00", EndAt: "18:00", Timezone: "Asia/Shanghai"}, at(13, 18, 0), false},
+		// 按 UTC 计算时 Asia/Shanghai 的 09:00 是 01:00
+		{QuietHour{StartAt: "09:00", EndAt: "18:00", Timezone: "UTC"}, at(13, 9, 0), false},
+		{QuietHour{StartAt: "00:00", EndAt: "02:00", Timezone: "UTC"}, at(13, 9, 0), true},
+		// 跨过零点
+		{QuietHour{StartAt: "22:00", EndAt: "08:00", Timezone: "Asia/Shanghai"}, at(13, 23, 0), true},
+		{QuietHour{StartAt: "22:00", EndAt: "08:00", Timezone: "Asia/Shanghai"}, at(14, 7, 59), true},
+		{QuietHour{StartAt: "22:00", EndAt: "08:00", Timezone: "Asia/Shanghai"}, at(14, 8, 0), false},
+		{QuietHour{StartAt: "22:00", EndAt: "08:00", Timezone: "Asia/Shanghai"}, at(13, 21, 59), false},
+		// 星期五晚上开始，零点之后算星期五
+		{QuietHour{Weekdays: []int{5}, StartAt: "22:00", EndAt: "08:00", Timezone: "Asia/Shanghai"}, at(18, 7, 0), true},
+		{QuietHour{Weekdays: []int{5}, StartAt: "22:00", EndAt: "08:00", Timezone: "Asia/Shanghai"}, at(17, 7, 0), false},
+		{QuietHour{Weekdays: []int{5}, StartAt: "22:00", EndAt: "08:00", Timezone: "Asia/Shanghai"}, at(18, 23, 0), false},
+		// 周末全天
+		{QuietHour{Weekdays: []int{0, 6}, StartAt: "00:00", EndAt: "00:00", Timezone: "Asia/Shanghai"}, at(19, 12, 0), true},
+		{QuietHour{Weekdays: []int{0, 6}, StartAt: "00:00", EndAt: "00:00", Timezone: "Asia/Shanghai"}, at(20, 12, 0), false},
+	}
+	for i, c := range cases {
+		ast.Equal(c.want, c.q.Contains(c.now), "case %v", i)
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+	defer os.Remove(testCallerFilePath)
+
+	caller := NewCaller(CallerCfg{FilePath: testCallerFilePath, VoiceProvider: VoiceFake}, &FakeDutyMgr{}, func(Message) {}, nil)
+
+	ast.Error(caller.CreateQuietHour(xl, &QuietHour{StartAt: "25:00", EndAt: "08:00"}))
+	ast.Error(caller.CreateQuietHour(xl, &QuietHour{StartAt: "22:00", EndAt: "08:00", Weekdays: []int{7}}))
+	ast.Error(caller.CreateQuietHour(xl, &QuietHour{StartAt: "22:00", EndAt: "08:00", Timezone: "Mars/Olympus"}))
+
+	q := &QuietHour{StartAt: "00:00", EndAt: "00:00", ExemptSeverities: []Severity{SeverityP0}}
+	ast.NoError(caller.CreateQuietHour(xl, q))
+	_, ok := caller.InQuietHours(time.Now(), SeverityP1)
+	ast.True(ok)
+	_, ok = caller.InQuietHours(time.Now(), SeverityP0)
+	ast.False(ok)
+
+	// 重启之后仍然生效
+	caller2 := NewCaller(CallerCfg{FilePath: testCallerFilePath, VoiceProvider: VoiceFake}, &FakeDutyMgr{}, func(Message) {}, nil)
+	ast.Equal(caller.ListQuietHours(), caller2.ListQuietHours())
+
+	q.Weekdays = []int{int(time.Now().Weekday()+1) % 7}
+	ast.NoError(caller.UpdateQuietHour(xl, q.Id, q))
+	got, err := caller.GetQuietHour(q.Id)
+	ast.NoError(err)
+	ast.Equal(*q, got)
+	_, ok = caller.InQuietHours(time.Now(), SeverityP1)
+	ast.False(ok)
+
+	ast.NoError(caller.RemoveQuietHour(xl, q.Id))
+	ast.Equal(ErrQuietHourNotFound, caller.RemoveQuietHour(xl, q.Id))
+	ast.Equal(0, len(caller.ListQuietHours()))
+
+	// 兼容之前保存的 start_at、end_at
+	ast.NoError(save(xl, map[string]int{"start_at": 22 * 3600, "end_at": 8 * 3600}, testCallerFilePath))
+	caller3 := NewCaller(CallerCfg{FilePath: testCallerFilePath, VoiceProvider: VoiceFake}, &FakeDutyMgr{}, func(Message) {}, nil)
+	qs := caller3.ListQuietHours()
+	if ast.Equal(1, len(qs)) {
+		ast.Equal("22:00", qs[0].StartAt)
+		ast.Equal("08:00", qs[0].EndAt)
+	}
+	// 迁移之后已经保存，重启之后 id 不变
+	caller4 := NewCaller(CallerCfg{FilePath: testCallerFilePath, VoiceProvider: VoiceFake}, &FakeDutyMgr{}, func(Message) {}, nil)
+	ast.Equal(qs, caller4.ListQuietHours())
+}
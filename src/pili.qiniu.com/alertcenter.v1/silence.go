@@ -0,0 +1,279 @@
+package alertcenter
+
+import (
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/qiniu/http/httputil.v1"
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+
+	pmgo "pili.qiniu.com/mgo"
+)
+
+const (
+	DefaultSilenceReloadMS = 10 * 1e3
+)
+
+var (
+	ErrSilenceNotFound   = httputil.NewError(http.StatusNotFound, "silence not found")
+	ErrDuplicatedSilence = httputil.NewError(http.StatusConflict, "duplicated silence")
+)
+
+// ================================================
+// Matcher
+
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+type Matcher struct {
+	Name  string    `json:"name" bson:"name"`
+	Value string    `json:"value" bson:"value"`
+	Type  MatchType `json:"type" bson:"type"`
+
+	re *regexp.Regexp
+}
+
+func (m *Matcher) Check() (err error) {
+	if m.Name == "" {
+		return httputil.NewError(400, "empty matcher name")
+	}
+	if m.Type == "" {
+		m.Type = MatchEqual
+	}
+	switch m.Type {
+	case MatchEqual, MatchNotEqual:
+	case MatchRegexp, MatchNotRegexp:
+		// 与 Prometheus 一致，正则需要完整匹配
+		m.re, err = regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return httputil.NewError(400, "invalid matcher regexp: "+err.Error())
+		}
+	default:
+		return httputil.NewError(400, "unknown matcher type: "+string(m.Type))
+	}
+	return
+}
+
+func (m *Matcher) Match(a *Alert) bool {
+	v := a.LabelValue(m.Name)
+	switch m.Type {
+	case MatchEqual, "":
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re != nil && m.re.MatchString(v)
+	case MatchNotRegexp:
+		return m.re != nil && !m.re.MatchString(v)
+	}
+	return false
+}
+
+type Matchers []Matcher
+
+func (ms Matchers) Check() (err error) {
+	for i := range ms {
+		err = ms[i].Check()
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 所有 matcher 都匹配才算匹配
+func (ms Matchers) Match(a *Alert) bool {
+	for i := range ms {
+		if !ms[i].Match(a) {
+			return false
+		}
+	}
+	return true
+}
+
+// ================================================
+// Silence
+
+type SilenceCfg struct {
+	MgoOpt   pmgo.Option `json:"mgo_opt"`
+	ReloadMS int         `json:"reload_ms"`
+}
+
+func (cfg *SilenceCfg) Check() {
+	if cfg.ReloadMS == 0 {
+		cfg.ReloadMS = DefaultSilenceReloadMS
+	}
+}
+
+type Silence struct {
+	Id        bson.ObjectId `json:"id" bson:"_id"`
+	Matchers  Matchers      `json:"matchers" bson:"matchers"`
+	StartsAt  time.Time     `json:"startsAt" bson:"startsAt"`
+	EndsAt    time.Time     `json:"endsAt" bson:"endsAt"`
+	CreatedBy string        `json:"createdBy" bson:"createdBy"`
+	Comment   string        `json:"comment" bson:"comment"`
+	CreateAt  time.Time     `json:"createAt" bson:"createAt"`
+}
+
+func (s *Silence) Check() (err error) {
+	if len(s.Matchers) == 0 {
+		return httputil.NewError(400, "empty matchers")
+	}
+	if s.CreatedBy == "" {
+		return httputil.NewError(400, "empty createdBy")
+	}
+	if s.EndsAt.IsZero() {
+		return httputil.NewError(400, "empty endsAt")
+	}
+	if s.StartsAt.IsZero() {
+		s.StartsAt = time.Now()
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return httputil.NewError(400, "endsAt should be after startsAt")
+	}
+	return s.Matchers.Check()
+}
+
+func (s *Silence) IsActive(now time.Time) bool {
+	return !now.Before(s.StartsAt) && now.Before(s.EndsAt)
+}
+
+type SilenceMgr struct {
+	*SilenceCfg
+	mgo pmgo.Mongo
+
+	cache []Silence
+	mutex sync.RWMutex
+}
+
+func NewSilenceMgr(cfg SilenceCfg) (sm *SilenceMgr) {
+	cfg.Check()
+	mgo, err := pmgo.New(cfg.MgoOpt)
+	if err != nil {
+		log.Panic("silence: NewSilenceMgr pmgo.New(cfg.MgoOpt) err:", err)
+	}
+
+	sm = &SilenceMgr{SilenceCfg: &cfg, mgo: mgo}
+	xl := xlog.NewDummy()
+	err = sm.reload()
+	if err != nil {
+		xl.Errorf("silence: sm.reload() err: %v", err)
+	}
+	go sm.TimingReload(xl)
+	return
+}
+
+func (sm *SilenceMgr) TimingReload(xl *xlog.Logger) {
+	for range time.Tick(time.Duration(sm.ReloadMS) * time.Millisecond) {
+		err := sm.reload()
+		if err != nil {
+			xl.Errorf("silence: sm.reload() err: %v", err)
+		}
+	}
+}
+
+// 只缓存还没有过期的 silence
+func (sm *SilenceMgr) reload() (err error) {
+	var ss []Silence
+	err = sm.mgo.Coll().Find(M{"endsAt": M{"$gt": time.Now()}}).All(&ss)
+	if err != nil {
+		return
+	}
+	cache := make([]Silence, 0, len(ss))
+	for _, s := range ss {
+		if err1 := s.Matchers.Check(); err1 != nil {
+			log.Errorf("silence: invalid silence %v, err: %v", s.Id.Hex(), err1)
+			continue
+		}
+		cache = append(cache, s)
+	}
+
+	sm.mutex.Lock()
+	sm.cache = cache
+	sm.mutex.Unlock()
+	return
+}
+
+func (sm *SilenceMgr) Create(s *Silence) (err error) {
+	err = s.Check()
+	if err != nil {
+		return
+	}
+	if s.Id == "" {
+		s.Id = bson.NewObjectId()
+	}
+	s.CreateAt = time.Now()
+	err = sm.mgo.Coll().Insert(s)
+	if err != nil {
+		if mgo.IsDup(err) {
+			err = ErrDuplicatedSilence
+		}
+		return
+	}
+	return sm.reload()
+}
+
+func (sm *SilenceMgr) Get(id bson.ObjectId) (ret Silence, err error) {
+	err = sm.mgo.Coll().FindId(id).One(&ret)
+	if err == mgo.ErrNotFound {
+		err = ErrSilenceNotFound
+	}
+	return
+}
+
+func (sm *SilenceMgr) List() (ret []Silence, err error) {
+	err = sm.mgo.Coll().Find(M{}).Sort("-_id").All(&ret)
+	return
+}
+
+func (sm *SilenceMgr) Delete(id bson.ObjectId) (err error) {
+	err = sm.mgo.Coll().RemoveId(id)
+	if err != nil {
+		if err == mgo.ErrNotFound {
+			err = ErrSilenceNotFound
+		}
+		return
+	}
+	return sm.reload()
+}
+
+// implement action interface
+// 只给命中 silence 的告警打上标记，告警依然会被记录到历史中，真正的过滤发生在发送前
+func (sm *SilenceMgr) Do(xl *xlog.Logger, as []*Alert) []*Alert {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	now := time.Now()
+	for _, a := range as {
+		a.SilencedBy = ""
+		for i := range sm.cache {
+			if sm.cache[i].IsActive(now) && sm.cache[i].Matchers.Match(a) {
+				a.SilencedBy = sm.cache[i].Id.Hex()
+				xl.Infof("alert %v(%v) is silenced by %v", a.Alertname, a.Key, a.SilencedBy)
+				break
+			}
+		}
+	}
+	return as
+}
+
+// 重新计算 silence 并返回需要通知的告警，重发的告警也会经过这里
+func (sm *SilenceMgr) Filter(xl *xlog.Logger, as []*Alert) (newAs []*Alert) {
+	for _, a := range sm.Do(xl, as) {
+		if a.SilencedBy == "" {
+			newAs = append(newAs, a)
+		}
+	}
+	return
+}
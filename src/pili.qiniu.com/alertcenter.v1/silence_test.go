@@ -0,0 +1,80 @@
+package alertcenter
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestMatchers(t *testing.T) {
+	ast := assert.New(t)
+
+	a := &Alert{
+		Alertname: "pili_vdn_node_lrtime",
+		Severity:  SeverityP0,
+		Labels:    map[string]string{"node": "vdn-gzgy-tel-1-2", "idc": "gzgy"},
+	}
+
+	cases := []struct {
+		matchers Matchers
+		want     bool
+	}{
+		{Matchers{{Name: "alertname", Value: "pili_vdn_node_lrtime"}}, true},
+		{Matchers{{Name: "alertname", Value: "pili_vdn_node_.*", Type: MatchRegexp}}, true},
+		{Matchers{{Name: "alertname", Value: "pili_vdn", Type: MatchRegexp}}, false},
+		{Matchers{{Name: "severity", Value: "P0"}, {Name: "idc", Value: "gzgy"}}, true},
+		{Matchers{{Name: "severity", Value: "P0"}, {Name: "idc", Value: "gzgy", Type: MatchNotEqual}}, false},
+		{Matchers{{Name: "node", Value: "vdn-.*-tel-.*", Type: MatchNotRegexp}}, false},
+		{Matchers{{Name: "missing", Value: "", Type: MatchEqual}}, true},
+	}
+	for i, c := range cases {
+		if !ast.NoError(c.matchers.Check(), "case %d", i) {
+			continue
+		}
+		ast.Equal(c.want, c.matchers.Match(a), "case %d", i)
+	}
+
+	bad := Matchers{{Name: "node", Value: "(", Type: MatchRegexp}}
+	ast.Error(bad.Check())
+	bad = Matchers{{Name: "node", Value: "x", Type: "=="}}
+	ast.Error(bad.Check())
+}
+
+func TestSilenceDo(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+
+	active := Silence{
+		Id:       bson.NewObjectId(),
+		Matchers: Matchers{{Name: "alertname", Value: "test"}},
+		StartsAt: time.Now().Add(-time.Minute),
+		EndsAt:   time.Now().Add(time.Hour),
+	}
+	pending := Silence{
+		Id:       bson.NewObjectId(),
+		Matchers: Matchers{{Name: "alertname", Value: "pending"}},
+		StartsAt: time.Now().Add(time.Hour),
+		EndsAt:   time.Now().Add(2 * time.Hour),
+	}
+	sm := &SilenceMgr{cache: []Silence{active, pending}}
+
+	as := []*Alert{
+		{Alertname: "test"},
+		{Alertname: "pending"},
+		{Alertname: "other", SilencedBy: "stale"},
+	}
+	as = sm.Do(xl, as)
+	ast.Equal(3, len(as), "silenced alerts should be kept by the action")
+	ast.Equal(active.Id.Hex(), as[0].SilencedBy)
+	ast.Equal("", as[1].SilencedBy)
+	ast.Equal("", as[2].SilencedBy)
+
+	as = sm.Filter(xl, as)
+	if ast.Equal(2, len(as)) {
+		ast.Equal("pending", as[0].Alertname)
+		ast.Equal("other", as[1].Alertname)
+	}
+}
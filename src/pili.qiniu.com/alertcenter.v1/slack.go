@@ -1,9 +1,21 @@
 package alertcenter
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/qiniu/http/httputil.v1"
 	"github.com/qiniu/log.v1"
 	"github.com/qiniu/rpc.v1/lb.v2.1"
 	"github.com/qiniu/xlog.v1"
@@ -19,6 +31,24 @@ const (
 	DefaultSlackMoreAlertsText      = "更多告警请点我"
 	DefaultSlackMaxDisplayCnt       = 3
 	DefaultSlackMinCloseAlertsTimes = 3
+	DefaultSlackAckComment          = "ack from slack"
+	DefaultSlackSilenceComment      = "silence from slack"
+	DefaultSlackSilenceDuration     = time.Hour
+	DefaultSlackApiUrl              = "https://slack.com/api"
+	DefaultSlackThreadsFile         = "run/slack_%v.threads"
+	DefaultSlackBotTimeoutMS        = 10 * 1e3
+
+	SlackActionAck     = "ack"
+	SlackActionSilence = "silence"
+	SlackActionResolve = "resolve"
+
+	// 超过 5 分钟的回调请求认为是重放
+	SlackSignatureMaxAge = 5 * time.Minute
+)
+
+var (
+	ErrInvalidSlackSignature = httputil.NewError(http.StatusUnauthorized, "invalid slack signature")
+	ErrInvalidSlackAction    = httputil.NewError(400, "invalid slack action")
 )
 
 type SlackCfg struct {
@@ -52,11 +82,41 @@ type SlackCfg struct {
 	TryTimes      uint32 `json:"try_times"`
 
 	PortalUrl string `json:"portal_url"`
+
+	// Slack App 的 Signing Secret，不为空时告警消息上会有 Ack、Silence 1h、Resolve 按钮，
+	// 按钮的回调需要在 Slack App 中配置 Request URL 为 POST /slack/interactions
+	SigningSecret string `json:"signing_secret"`
+	// Slack 用户 id 到用户名的映射，找不到时使用 Slack 的用户名
+	Users map[string]string `json:"users"`
+
+	// 配置了 BotToken 时通过 chat.postMessage 发送到 Channel，同一个告警的后续通知和恢复以 thread 回复，
+	// 并在恢复、ack 时修改第一条消息，不再使用 Hosts、ServiceId
+	BotToken    string `json:"bot_token"`
+	Channel     string `json:"channel"`
+	ApiUrl      string `json:"api_url"`
+	ThreadsFile string `json:"threads_file"`
+
+	// 告警的 title、text、footer 模板
+	Template TemplateCfg `json:"template"`
+}
+
+// 已经 ack 的告警标题显示 ack 的人，正文为各类告警分析结果的链接，footer 带 id、key 和紧急告警的 portal 链接
+var DefaultSlackTemplate = TemplateCfg{
+	Title: `{{.Description}} | {{if .AckedBy}}acked by {{.AckedBy}}{{else}}{{.Status}}{{if and (eq .Status "resolved") .IsEmergent}} | 该告警是升级的告警{{end}}{{end}}`,
+	Body: `{{range $i, $t := .AnalyzerTypes}}{{if $i}}
+{{end}}*<{{analyzerUrl $.PortalUrl $t $.Id.Hex}}|点击查看 {{$t}} 类型告警分析结果>*{{end}}`,
+	Footer: DefaultLeanAlertIdHeader + ` {{.Id.Hex}} ` + DefaultSlackAlertKeyHeader +
+		` {{.Key}}{{if .IsEmergent}} <{{.PortalUrl}}|[` + DefaultLeanChatEmergencyText + `]>{{end}}`,
 }
 
 type Slack struct {
 	*SlackCfg
-	cli *lb.Client
+	cli  *lb.Client
+	tmpl *Templates
+
+	bot     *http.Client
+	mutex   sync.Mutex
+	threads map[string]*SlackThread // key 是 Alert.Key
 }
 
 func (cfg *SlackCfg) Check() {
@@ -89,11 +149,32 @@ func (cfg *SlackCfg) Check() {
 	if cfg.MinCloseAlertsTimes == 0 {
 		cfg.MinCloseAlertsTimes = DefaultSlackMinCloseAlertsTimes
 	}
+
+	if cfg.BotToken != "" {
+		if cfg.Channel == "" {
+			log.Panic("miss Channel of slackCfg:", cfg.Name)
+		}
+		if cfg.ApiUrl == "" {
+			cfg.ApiUrl = DefaultSlackApiUrl
+		}
+		cfg.ApiUrl = strings.TrimSuffix(cfg.ApiUrl, "/")
+		if cfg.ThreadsFile == "" {
+			cfg.ThreadsFile = fmt.Sprintf(DefaultSlackThreadsFile, cfg.Name)
+		}
+		if cfg.DialTimeoutMs == 0 {
+			cfg.DialTimeoutMs = DefaultSlackBotTimeoutMS
+		}
+	}
 }
 
 func NewSlack(cfg SlackCfg) *Slack {
 	cfg.Check()
 
+	threads := make(map[string]*SlackThread)
+	if cfg.BotToken != "" {
+		load(xlog.NewDummy(), &threads, cfg.ThreadsFile)
+	}
+
 	return &Slack{
 		SlackCfg: &cfg,
 		cli: lb.New(
@@ -101,6 +182,9 @@ func NewSlack(cfg SlackCfg) *Slack {
 				Hosts:    cfg.Hosts,
 				TryTimes: cfg.TryTimes,
 			}, nil),
+		tmpl:    NewTemplates(cfg.Template, DefaultSlackTemplate),
+		bot:     &http.Client{Timeout: time.Duration(cfg.DialTimeoutMs) * time.Millisecond},
+		threads: threads,
 	}
 }
 
@@ -110,6 +194,7 @@ const (
 	SlackGood    SlackColor = "good"
 	SlackWarning SlackColor = "warning"
 	SlackDanger  SlackColor = "danger"
+	SlackAcked   SlackColor = "#439FE0"
 )
 
 func NewSlackColor(s Severity) (color SlackColor) {
@@ -126,6 +211,14 @@ func NewSlackColor(s Severity) (color SlackColor) {
 	return
 }
 
+type SlackAction struct {
+	Name  string `json:"name"`
+	Text  string `json:"text,omitempty"`
+	Type  string `json:"type,omitempty"`
+	Value string `json:"value,omitempty"`
+	Style string `json:"style,omitempty"`
+}
+
 type SlackAttachment struct {
 	Fallback   string     `json:"fallback,omitempty"`
 	Text       string     `json:"text,omitempty"`
@@ -137,9 +230,15 @@ type SlackAttachment struct {
 	Ts         string     `json:"ts,omitempty"`
 	Color      SlackColor `json:"color,omitempty"`
 	MrkdwnIn   []string   `json:"mrkdwn_in,omitempty"`
+
+	CallbackId string        `json:"callback_id,omitempty"`
+	Actions    []SlackAction `json:"actions,omitempty"`
 }
 
 type SlackReq struct {
+	Channel     string            `json:"channel,omitempty"`
+	Ts          string            `json:"ts,omitempty"`
+	ThreadTs    string            `json:"thread_ts,omitempty"`
 	Text        string            `json:"text,omitempty"`
 	Username    string            `json:"username,omitempty"`
 	IconUrl     string            `json:"icon_url,omitempty"`
@@ -159,26 +258,22 @@ func (n *Slack) Notify(msg Message) (err error) {
 	if len(msg.Alerts) == 0 {
 		return
 	}
+	if n.BotToken != "" {
+		return n.notifyByBot(msg)
+	}
+	err = n.SendMsg(xl, n.GetReq(msg))
+	return
+}
+
+func (n *Slack) Preview(msg Message) (interface{}, error) {
+	return n.GetReq(msg), nil
+}
+
+func (n *Slack) GetReq(msg Message) *SlackReq {
 	atts := make([]SlackAttachment, 0, len(msg.Alerts))
 
 	for i, a := range msg.Alerts {
-		if !strings.HasPrefix(a.GeneratorURL, "http://") && !strings.HasPrefix(a.GeneratorURL, "https://") {
-			a.GeneratorURL = "http://" + a.GeneratorURL
-		}
-		att := SlackAttachment{
-			Fallback:   n.GetTitle(a),
-			Title:      n.GetTitle(a), // [PILI] vdn-gzgy-tel-1-2 pili-streamd fd 3013 > 3000 | firing | 第 1 次
-			TitleLink:  a.GeneratorURL,
-			Footer:     n.GetFooter(a),
-			FooterIcon: n.FooterIcon,
-			Ts:         n.GetTs(a), // 2016-11-23 21:58:37",
-			Color:      NewSlackColor(a.Severity),
-			MrkdwnIn:   []string{"text"},
-		}
-		if len(a.AnalyzerTypes) != 0 {
-			att.Text = n.GetAnalyzerResults(a)
-		}
-		atts = append(atts, att)
+		atts = append(atts, n.GetAttachment(a))
 
 		if i == n.MaxDisplayCnt-1 {
 			break
@@ -204,9 +299,7 @@ func (n *Slack) Notify(msg Message) (err error) {
 			TitleLink: n.PortalUrl,
 		})
 	}
-
-	err = n.SendMsg(xl, req)
-	return
+	return req
 }
 
 func (n *Slack) SendMsg(xl *xlog.Logger, req *SlackReq) (err error) {
@@ -226,6 +319,28 @@ func (n *Slack) SendMsg(xl *xlog.Logger, req *SlackReq) (err error) {
 	return
 }
 
+func (n *Slack) GetAttachment(a *Alert) SlackAttachment {
+	if !strings.HasPrefix(a.GeneratorURL, "http://") && !strings.HasPrefix(a.GeneratorURL, "https://") {
+		a.GeneratorURL = "http://" + a.GeneratorURL
+	}
+	att := SlackAttachment{
+		Fallback:   n.GetTitle(a),
+		Title:      n.GetTitle(a), // [PILI] vdn-gzgy-tel-1-2 pili-streamd fd 3013 > 3000 | firing | 第 1 次
+		TitleLink:  a.GeneratorURL,
+		Footer:     n.GetFooter(a),
+		FooterIcon: n.FooterIcon,
+		Ts:         n.GetTs(a), // 2016-11-23 21:58:37",
+		Color:      NewSlackColor(a.Severity),
+		MrkdwnIn:   []string{"text"},
+	}
+	att.Text = n.GetText(a)
+	if n.SigningSecret != "" && a.Status == AlertFiring && a.Id.Valid() {
+		att.CallbackId = a.Id.Hex()
+		att.Actions = n.GetActions(a)
+	}
+	return att
+}
+
 func (n *Slack) GetPath() string {
 	return fmt.Sprintf("%v/%v", n.Path, n.ServiceId)
 }
@@ -234,19 +349,26 @@ func (n *Slack) GetMoreAlertsText(cnt int) string {
 	return fmt.Sprintf("共有 %v 个告警 %v", cnt, n.MoreAlertsText)
 }
 
-func (n *Slack) GetTitle(a *Alert) string {
-	if a.Status == AlertResolved && a.IsEmergent {
-		return fmt.Sprintf("%v | %v | 该告警是升级的告警", a.Description, a.Status)
+func (n *Slack) templateData(a *Alert) *TemplateData {
+	return &TemplateData{
+		Alert:         a,
+		PortalUrl:     n.PortalUrl,
+		TimeLayout:    n.TimeLayout,
+		TimeHeader:    n.TimeHeader,
+		AlertIdHeader: n.AlertIdHeader,
 	}
-	return fmt.Sprintf("%v | %v", a.Description, a.Status)
+}
+
+func (n *Slack) GetTitle(a *Alert) string {
+	return n.tmpl.Execute(TemplateTitle, n.templateData(a))
+}
+
+func (n *Slack) GetText(a *Alert) string {
+	return n.tmpl.Execute(TemplateBody, n.templateData(a))
 }
 
 func (n *Slack) GetFooter(a *Alert) string {
-	s := fmt.Sprintf("%s %s %s %s", DefaultLeanAlertIdHeader, a.Id.Hex(), DefaultSlackAlertKeyHeader, a.Key)
-	if a.IsEmergent {
-		s += fmt.Sprintf(" <%s|[%s]>", n.PortalUrl, n.GetEmergencyText())
-	}
-	return s
+	return n.tmpl.Execute(TemplateFooter, n.templateData(a))
 }
 
 func (n *Slack) GetTs(a *Alert) string {
@@ -257,12 +379,278 @@ func (n *Slack) GetEmergencyText() string {
 	return fmt.Sprintf("该告警被升级请赶紧处理告警")
 }
 
-func (n *Slack) GetAnalyzerResults(a *Alert) (text string) {
-	for i, t := range a.AnalyzerTypes {
-		text += fmt.Sprintf("*<%v/loganalyzer?type=%v&alertId=%v|点击查看 %v 类型告警分析结果>*", n.PortalUrl, t, a.Id.Hex(), t)
-		if i != len(a.AnalyzerTypes)-1 {
-			text += "\n"
+func (n *Slack) GetActions(a *Alert) []SlackAction {
+	id := a.Id.Hex()
+	return []SlackAction{
+		{Name: SlackActionAck, Text: "Ack", Type: "button", Value: id, Style: "primary"},
+		{Name: SlackActionSilence, Text: "Silence 1h", Type: "button", Value: id},
+		{Name: SlackActionResolve, Text: "Resolve", Type: "button", Value: id, Style: "danger"},
+	}
+}
+
+// ================================================
+// Bot Token 模式
+
+// 每个告警第一条通知的位置，后续通知都回复在它的 thread 里
+type SlackThread struct {
+	Channel    string          `json:"channel"`
+	Ts         string          `json:"ts"`
+	Attachment SlackAttachment `json:"attachment"`
+}
+
+type slackApiResp struct {
+	Ok      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	Ts      string `json:"ts"`
+}
+
+// 每个告警单独一条消息，这样才能按 Alert.Key 跟踪
+func (n *Slack) notifyByBot(msg Message) (err error) {
+	xl := msg.xl
+	for _, a := range msg.Alerts {
+		err1 := n.notifyThread(xl, a)
+		if err1 != nil {
+			err = err1
+		}
+	}
+	return
+}
+
+// 调用 Slack API 时不持有 n.mutex，只在读写 threads 时加锁
+func (n *Slack) notifyThread(xl *xlog.Logger, a *Alert) (err error) {
+	att := n.GetAttachment(a)
+	req := &SlackReq{
+		Channel:     n.Channel,
+		IconUrl:     n.IconUrl,
+		IconEmoji:   n.IconEmoji,
+		Username:    n.Username,
+		Attachments: []SlackAttachment{att},
+	}
+
+	th, ok := n.getThread(a.Key)
+	if !ok {
+		var res slackApiResp
+		res, err = n.CallApi(xl, "chat.postMessage", req)
+		if err != nil || a.Status == AlertResolved || a.Key == "" {
+			return
+		}
+		n.mutex.Lock()
+		n.threads[a.Key] = &SlackThread{Channel: res.Channel, Ts: res.Ts, Attachment: att}
+		save(xl, n.threads, n.ThreadsFile)
+		n.mutex.Unlock()
+		return
+	}
+
+	req.Channel = th.Channel
+	req.ThreadTs = th.Ts
+	_, err = n.CallApi(xl, "chat.postMessage", req)
+	if err != nil || a.Status != AlertResolved {
+		return
+	}
+
+	// 恢复时修改第一条消息，之后同一个 key 的告警重新开始一个 thread
+	parent := th.Attachment
+	parent.Title = n.GetTitle(a)
+	parent.Fallback = parent.Title
+	parent.Color = SlackGood
+	parent.Actions = nil
+	err = n.updateParent(xl, &th, parent)
+
+	n.mutex.Lock()
+	if cur, ok := n.threads[a.Key]; ok && cur.Ts == th.Ts {
+		delete(n.threads, a.Key)
+		save(xl, n.threads, n.ThreadsFile)
+	}
+	n.mutex.Unlock()
+	return
+}
+
+func (n *Slack) getThread(key string) (th SlackThread, ok bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	t, ok := n.threads[key]
+	if ok {
+		th = *t
+	}
+	return
+}
+
+// 告警被 ack 时把第一条消息修改为 "acked by X"
+func (n *Slack) Ack(xl *xlog.Logger, a *Alert, ack Ack) (err error) {
+	if n.BotToken == "" {
+		return
+	}
+
+	th, ok := n.getThread(a.Key)
+	if !ok {
+		return
+	}
+	parent := th.Attachment
+	data := n.templateData(a)
+	data.AckedBy = ack.Username
+	parent.Title = n.tmpl.Execute(TemplateTitle, data)
+	parent.Fallback = parent.Title
+	parent.Color = SlackAcked
+	parent.Actions = nil
+	err = n.updateParent(xl, &th, parent)
+	if err != nil {
+		return
+	}
+
+	// 修改期间 thread 可能已经因为恢复被删除
+	n.mutex.Lock()
+	if cur, ok := n.threads[a.Key]; ok && cur.Ts == th.Ts {
+		cur.Attachment = parent
+		save(xl, n.threads, n.ThreadsFile)
+	}
+	n.mutex.Unlock()
+	return
+}
+
+func (n *Slack) updateParent(xl *xlog.Logger, th *SlackThread, parent SlackAttachment) (err error) {
+	_, err = n.CallApi(xl, "chat.update", &SlackReq{
+		Channel:     th.Channel,
+		Ts:          th.Ts,
+		Attachments: []SlackAttachment{parent},
+	})
+	return
+}
+
+func (n *Slack) CallApi(xl *xlog.Logger, method string, req *SlackReq) (res slackApiResp, err error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	httpReq, err := http.NewRequest("POST", n.ApiUrl+"/"+method, bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	httpReq.Header.Set("Content-Type", "application/json; charset=utf-8")
+	httpReq.Header.Set("Authorization", "Bearer "+n.BotToken)
+	resp, err := n.bot.Do(httpReq)
+	if err != nil {
+		xl.Errorf("Slack %v %v error: %+v", n.Name(), method, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		xl.Errorf("Slack %v decode resp, status: %v, err: %v", method, resp.StatusCode, err)
+		return
+	}
+	if !res.Ok {
+		xl.Errorf("Slack %v %v Resp: %+v", n.Name(), method, res)
+		err = fmt.Errorf("slack %v: %v", method, res.Error)
+	}
+	return
+}
+
+// ================================================
+// 按钮回调
+
+type SlackInteraction struct {
+	Type       string        `json:"type"`
+	CallbackId string        `json:"callback_id"`
+	Actions    []SlackAction `json:"actions"`
+	User       struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"user"`
+	OriginalMessage SlackReq `json:"original_message"`
+}
+
+// 签名为 "v0=" + hex(HmacSHA256(signingSecret, "v0:" + timestamp + ":" + body))
+func SlackSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// 用配置了 SigningSecret 的 slackCfg 校验回调的签名，返回回调内容和执行操作的用户名
+func ParseSlackInteraction(cfgs []SlackCfg, header http.Header, body []byte, now time.Time) (p *SlackInteraction, username string, err error) {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, "", ErrInvalidSlackSignature
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > SlackSignatureMaxAge || d < -SlackSignatureMaxAge {
+		return nil, "", ErrInvalidSlackSignature
+	}
+
+	var cfg *SlackCfg
+	sig := []byte(header.Get("X-Slack-Signature"))
+	for i := range cfgs {
+		if cfgs[i].SigningSecret == "" {
+			continue
+		}
+		if hmac.Equal(sig, []byte(SlackSignature(cfgs[i].SigningSecret, timestamp, body))) {
+			cfg = &cfgs[i]
+			break
 		}
 	}
+	if cfg == nil {
+		return nil, "", ErrInvalidSlackSignature
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, "", ErrInvalidSlackAction
+	}
+	p = &SlackInteraction{}
+	err = json.Unmarshal([]byte(form.Get("payload")), p)
+	if err != nil || len(p.Actions) != 1 || p.CallbackId == "" {
+		return nil, "", ErrInvalidSlackAction
+	}
+
+	username = cfg.Users[p.User.Id]
+	if username == "" {
+		username = p.User.Name
+	}
+	if username == "" {
+		username = p.User.Id
+	}
 	return
 }
+
+// 去掉被操作的告警上的按钮，并在告警下面显示谁做了什么操作，用于替换原消息
+func (p *SlackInteraction) UpdatedMessage(text string) *SlackReq {
+	msg := p.OriginalMessage
+	msg.Attachments = make([]SlackAttachment, len(p.OriginalMessage.Attachments))
+	copy(msg.Attachments, p.OriginalMessage.Attachments)
+	for i, att := range msg.Attachments {
+		if att.CallbackId != p.CallbackId {
+			continue
+		}
+		att.Actions = nil
+		if att.Text != "" {
+			att.Text += "\n"
+		}
+		att.Text += text
+		msg.Attachments[i] = att
+	}
+	return &msg
+}
+
+// 按告警的 alertname 和所有 label 精确匹配
+func NewSlackSilence(a *Alert, username string, now time.Time) *Silence {
+	matchers := Matchers{{Name: AlertNameLabel, Value: a.Alertname, Type: MatchEqual}}
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		matchers = append(matchers, Matcher{Name: k, Value: a.Labels[k], Type: MatchEqual})
+	}
+	return &Silence{
+		Matchers:  matchers,
+		StartsAt:  now,
+		EndsAt:    now.Add(DefaultSlackSilenceDuration),
+		CreatedBy: username,
+		Comment:   DefaultSlackSilenceComment,
+	}
+}
@@ -0,0 +1,205 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/qiniu/http/rpcutil.v1"
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestSlackInteraction(t *testing.T) {
+	ast := assert.New(t)
+
+	id := bson.NewObjectId()
+	a := &Alert{Id: id, Alertname: "disk", Status: AlertFiring, Labels: map[string]string{"idc": "xs", "host": "h1"}}
+	n := NewSlack(SlackCfg{Name: "slack", SigningSecret: "secret"})
+	actions := n.GetActions(a)
+	ast.Equal(3, len(actions))
+
+	p := SlackInteraction{
+		Type:       "interactive_message",
+		CallbackId: id.Hex(),
+		Actions:    []SlackAction{actions[0]},
+		OriginalMessage: SlackReq{
+			Attachments: []SlackAttachment{
+				{Title: "other", CallbackId: bson.NewObjectId().Hex(), Actions: actions},
+				{Title: "disk", CallbackId: id.Hex(), Actions: actions},
+			},
+		},
+	}
+	p.User.Id = "U1"
+	p.User.Name = "slacker"
+	b, _ := json.Marshal(p)
+	body := []byte(url.Values{"payload": {string(b)}}.Encode())
+
+	now := time.Now()
+	ts := strconv.FormatInt(now.Unix(), 10)
+	header := http.Header{}
+	header.Set("X-Slack-Request-Timestamp", ts)
+	header.Set("X-Slack-Signature", SlackSignature("secret", ts, body))
+
+	cfgs := []SlackCfg{{Name: "nosecret"}, {Name: "slack", SigningSecret: "secret", Users: map[string]string{"U1": "zhangsan"}}}
+	ret, username, err := ParseSlackInteraction(cfgs, header, body, now)
+	ast.NoError(err)
+	ast.Equal("zhangsan", username)
+	ast.Equal(SlackActionAck, ret.Actions[0].Name)
+
+	// 过期的请求
+	_, _, err = ParseSlackInteraction(cfgs, header, body, now.Add(10*time.Minute))
+	ast.Equal(ErrInvalidSlackSignature, err)
+
+	// 签名错误
+	header.Set("X-Slack-Signature", SlackSignature("other", ts, body))
+	_, _, err = ParseSlackInteraction(cfgs, header, body, now)
+	ast.Equal(ErrInvalidSlackSignature, err)
+
+	msg := ret.UpdatedMessage("*zhangsan* acked")
+	ast.Equal(3, len(msg.Attachments[0].Actions))
+	ast.Nil(msg.Attachments[1].Actions)
+	ast.Equal("*zhangsan* acked", msg.Attachments[1].Text)
+	ast.Equal(3, len(ret.OriginalMessage.Attachments[1].Actions))
+
+	s := NewSlackSilence(a, username, now)
+	ast.NoError(s.Check())
+	ast.Equal(Matchers{
+		{Name: AlertNameLabel, Value: "disk", Type: MatchEqual},
+		{Name: "host", Value: "h1", Type: MatchEqual},
+		{Name: "idc", Value: "xs", Type: MatchEqual},
+	}, s.Matchers)
+	ast.Equal(time.Hour, s.EndsAt.Sub(s.StartsAt))
+	ast.True(s.Matchers.Match(a))
+}
+
+func TestPostSlackInteractions(t *testing.T) {
+	ast := assert.New(t)
+	xl := xlog.NewDummy()
+
+	resolveC := make(chan Message, 1)
+	aam := &AlertActiveMgr{
+		AlertActiveCfg: &AlertActiveCfg{EmergenctIntervalS: 3600},
+		data:           make(map[string]*AlertActive),
+		f: func(msg Message) {
+			resolveC <- msg
+		},
+	}
+	a := &Alert{Id: bson.NewObjectId(), Key: "k1", Alertname: "disk", Status: AlertFiring, StartsAt: time.Now()}
+	ast.NoError(aam.Add(xl, a))
+	s := &Service{
+		Config:         &Config{NotifiersCfg: NotifiersCfg{SlackCfgs: []SlackCfg{{Name: "slack", SigningSecret: "secret"}}}},
+		alertActiveMgr: aam,
+	}
+
+	post := func(action, user string) (*SlackReq, error) {
+		p := SlackInteraction{
+			CallbackId: a.Id.Hex(),
+			Actions:    []SlackAction{{Name: action}},
+			OriginalMessage: SlackReq{
+				Attachments: []SlackAttachment{{Title: "disk", CallbackId: a.Id.Hex()}},
+			},
+		}
+		p.User.Name = user
+		b, _ := json.Marshal(p)
+		body := url.Values{"payload": {string(b)}}.Encode()
+		req := httptest.NewRequest("POST", "/slack/interactions", strings.NewReader(body))
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("X-Slack-Request-Timestamp", ts)
+		req.Header.Set("X-Slack-Signature", SlackSignature("secret", ts, []byte(body)))
+		return s.PostSlackInteractions(&rpcutil.Env{W: httptest.NewRecorder(), Req: req})
+	}
+
+	// 第二次点击 Ack 不做处理，之后依然可以恢复
+	ret, err := post(SlackActionAck, "A")
+	ast.NoError(err)
+	ast.Equal("*A* acked", ret.Attachments[0].Text)
+	ret, err = post(SlackActionAck, "B")
+	ast.NoError(err)
+	ast.Equal("already acked by *A*", ret.Attachments[0].Text)
+	acked, _ := aam.GetById(a.Id.Hex())
+	ast.Equal(1, len(acked.Acks))
+
+	ret, err = post(SlackActionResolve, "B")
+	ast.NoError(err)
+	ast.Equal("*B* resolved", ret.Attachments[0].Text)
+	ast.Equal(AlertResolved, (<-resolveC).Alerts[0].Status)
+	_, err = post(SlackActionResolve, "B")
+	ast.Equal(ErrAlertNotFound, err)
+}
+
+func TestSlackBot(t *testing.T) {
+	ast := assert.New(t)
+
+	type call struct {
+		method string
+		req    SlackReq
+	}
+	calls := make(chan call, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ast.Equal("Bearer xoxb-token", r.Header.Get("Authorization"))
+		var req SlackReq
+		ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+		calls <- call{r.URL.Path, req}
+		json.NewEncoder(w).Encode(slackApiResp{Ok: true, Channel: "C1", Ts: "1.1"})
+	}))
+	defer ts.Close()
+
+	threadsFile := "slack_test.threads"
+	defer os.Remove(threadsFile)
+	n := NewSlack(SlackCfg{
+		Name:        "slack-bot",
+		BotToken:    "xoxb-token",
+		Channel:     "alerts",
+		ApiUrl:      ts.URL + "/",
+		ThreadsFile: threadsFile,
+	})
+	ast.Equal(time.Duration(DefaultSlackBotTimeoutMS)*time.Millisecond, n.bot.Timeout)
+	xl := xlog.NewDummy()
+	a := &Alert{Id: bson.NewObjectId(), Key: "k1", Description: "disk", Status: AlertFiring, Severity: SeverityCritical}
+
+	// 第一次通知发送新消息
+	ast.NoError(n.Notify(NewMessage(xl, a)))
+	c := <-calls
+	ast.Equal("/chat.postMessage", c.method)
+	ast.Equal("alerts", c.req.Channel)
+	ast.Equal("", c.req.ThreadTs)
+
+	// 重启后从文件恢复
+	n = NewSlack(*n.SlackCfg)
+	ast.Equal("1.1", n.threads["k1"].Ts)
+
+	// 重复通知回复在 thread 里
+	ast.NoError(n.Notify(NewMessage(xl, a)))
+	c = <-calls
+	ast.Equal("C1", c.req.Channel)
+	ast.Equal("1.1", c.req.ThreadTs)
+
+	// ack 修改第一条消息
+	ast.NoError(n.Ack(xl, a, Ack{Username: "zhangsan"}))
+	c = <-calls
+	ast.Equal("/chat.update", c.method)
+	ast.Equal("1.1", c.req.Ts)
+	ast.Equal("disk | acked by zhangsan", c.req.Attachments[0].Title)
+	ast.Equal(SlackAcked, c.req.Attachments[0].Color)
+
+	// 恢复时回复在 thread 里并修改第一条消息
+	resolved := *a
+	resolved.Status = AlertResolved
+	ast.NoError(n.Notify(NewMessage(xl, &resolved)))
+	c = <-calls
+	ast.Equal("1.1", c.req.ThreadTs)
+	c = <-calls
+	ast.Equal("/chat.update", c.method)
+	ast.Equal("disk | resolved", c.req.Attachments[0].Title)
+	ast.Equal(SlackGood, c.req.Attachments[0].Color)
+	ast.Equal(0, len(n.threads))
+	ast.Equal(0, len(calls))
+}
@@ -0,0 +1,161 @@
+package alertcenter
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	DefaultSmsName   = "sms"
+	DefaultSmsMaxLen = 140
+	smsEllipsis      = "..."
+)
+
+// 通过 Morse 给值班人员发送普通短信，使用 caller_cfg 中的 morse_host、morse_uid
+type SmsCfg struct {
+	Name string `json:"name"`
+	// 短信的最大字符数，超过时截断告警描述
+	MaxLen int `json:"max_len"`
+	// 每次打电话之后再给接电话的人发一条短信
+	CallFollowUp bool `json:"call_follow_up"`
+
+	// 第一个告警的 title、body、footer 模板，短信为 "title body 等 N 个告警 footer"，超过 MaxLen 时截断 body
+	Template TemplateCfg `json:"template"`
+}
+
+// 短信内容为告警级别、描述和告警 id，不带 key
+var DefaultSmsTemplate = TemplateCfg{
+	Title:  `[{{.Severity}}]`,
+	Body:   `{{.Description}}`,
+	Footer: DefaultLeanAlertIdHeader + ` {{.Id.Hex}}`,
+}
+
+func (cfg *SmsCfg) Check() {
+	if cfg.Name == "" {
+		cfg.Name = DefaultSmsName
+	}
+	if cfg.MaxLen == 0 {
+		cfg.MaxLen = DefaultSmsMaxLen
+	}
+}
+
+type Sms struct {
+	*SmsCfg
+	uid     uint
+	morse   *MorseClient
+	dutyMgr DutyManager
+	events  *EventMgr
+	tmpl    *Templates
+}
+
+func NewSms(cfg SmsCfg, uid uint, morse *MorseClient, dutyMgr DutyManager, events *EventMgr) *Sms {
+	cfg.Check()
+	return &Sms{
+		SmsCfg:  &cfg,
+		uid:     uid,
+		morse:   morse,
+		dutyMgr: dutyMgr,
+		events:  events,
+		tmpl:    NewTemplates(cfg.Template, DefaultSmsTemplate),
+	}
+}
+
+func (n *Sms) Name() string {
+	return n.SmsCfg.Name
+}
+
+// 只发送 firing 的告警，msg.Staffs 为空时发给当前值班人员
+func (n *Sms) Notify(msg Message) (err error) {
+	_, err = n.NotifyTargets(msg, nil)
+	return
+}
+
+// targets 为手机号，为空时发给 msg.Staffs 或者当前值班人员的所有手机号
+func (n *Sms) NotifyTargets(msg Message, targets []string) (failed []string, err error) {
+	xl := msg.xl
+	as := make([]*Alert, 0, len(msg.Alerts))
+	for _, a := range msg.Alerts {
+		if a.Status != AlertResolved {
+			as = append(as, a)
+		}
+	}
+	if len(as) == 0 {
+		return
+	}
+
+	if len(targets) == 0 {
+		staffs, err := getStaffs(xl, n.dutyMgr, msg.Staffs)
+		if err != nil {
+			xl.Error("getStaffs(xl, n.dutyMgr, msg.Staffs) error", err)
+			return nil, err
+		}
+		for _, staff := range staffs {
+			targets = append(targets, staff.Phones...)
+		}
+	}
+	for _, phone := range targets {
+		err1 := n.Send(xl, phone, as)
+		if err1 != nil {
+			err = err1
+			failed = append(failed, phone)
+		}
+	}
+	return
+}
+
+func (n *Sms) Send(xl *xlog.Logger, phone string, as []*Alert) (err error) {
+	param := SendSmsIn{
+		Uid:         n.uid,
+		PhoneNumber: phone,
+		Message:     n.GetText(as),
+	}
+	oid, err := n.morse.SendSms(xl, param)
+	evs := make([]Event, 0, len(as))
+	for _, a := range as {
+		ev := NewEvent(EventNotified, a)
+		ev.Notifier = n.Name()
+		ev.Result = EventResult(err)
+		ev.Detail = phone
+		evs = append(evs, ev)
+	}
+	n.events.Record(xl, evs...)
+	if err != nil {
+		xl.Errorf("Sms.Send param: %#v, Error: %v", param, err)
+		return
+	}
+	xl.Infof("SendSms to %v success, Oid is %v", phone, oid)
+	return
+}
+
+func (n *Sms) Preview(msg Message) (interface{}, error) {
+	return n.GetText(msg.Alerts), nil
+}
+
+// 默认的短信内容为 "[severity] 描述 等 N 个告警 [AlertId] xxx"，超过 MaxLen 时截断描述
+func (n *Sms) GetText(as []*Alert) string {
+	data := &TemplateData{Alert: as[0]}
+	prefix := n.tmpl.Execute(TemplateTitle, data)
+	if prefix != "" {
+		prefix += " "
+	}
+	suffix := ""
+	if len(as) > 1 {
+		suffix = fmt.Sprintf(" 等 %v 个告警", len(as))
+	}
+	if footer := n.tmpl.Execute(TemplateFooter, data); footer != "" {
+		suffix += " " + footer
+	}
+
+	desc := n.tmpl.Execute(TemplateBody, data)
+	remain := n.MaxLen - utf8.RuneCountInString(prefix) - utf8.RuneCountInString(suffix)
+	if utf8.RuneCountInString(desc) > remain {
+		if remain > len(smsEllipsis) {
+			desc = string([]rune(desc)[:remain-len(smsEllipsis)]) + smsEllipsis
+		} else {
+			desc = ""
+		}
+	}
+	return prefix + desc + suffix
+}
@@ -0,0 +1,62 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/qiniu/rpc.v1"
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestSms(t *testing.T) {
+	ast := assert.New(t)
+
+	reqC := make(chan SendSmsIn, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/notification/send/sms", func(w http.ResponseWriter, r *http.Request) {
+		var req SendSmsIn
+		ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+		reqC <- req
+		json.NewEncoder(w).Encode(SendOut{Oid: testCallerOid})
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	morse := NewMorseClient(ts.URL, &rpc.Client{Client: http.DefaultClient})
+	n := NewSms(SmsCfg{MaxLen: 60}, 1, morse, &FakeDutyMgr{}, nil)
+	ast.Equal(DefaultSmsName, n.Name())
+
+	a1 := &Alert{
+		Id:          bson.NewObjectId(),
+		Description: strings.Repeat("磁盘", 20),
+		Status:      AlertFiring,
+		Severity:    SeverityP0,
+	}
+	a2 := &Alert{Id: bson.NewObjectId(), Description: "a2", Status: AlertResolved}
+
+	// resolved 的告警不发送
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a2)))
+
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a1, a2)))
+	req := <-reqC
+	ast.Equal(uint(1), req.Uid)
+	ast.Equal("18650317419", req.PhoneNumber)
+	ast.Equal(60, utf8.RuneCountInString(req.Message))
+	ast.True(strings.HasPrefix(req.Message, "[P0] 磁盘"))
+	ast.True(strings.HasSuffix(req.Message, "..."+" [AlertId] "+a1.Id.Hex()))
+	ast.Equal(0, len(reqC))
+
+	// 重试时只发送给失败的手机号
+	failed, err := n.NotifyTargets(NewMessage(xlog.NewDummy(), a1), []string{"13800000000"})
+	ast.NoError(err)
+	ast.Nil(failed)
+	ast.Equal("13800000000", (<-reqC).PhoneNumber)
+
+	ast.Equal("[P0] a2 等 2 个告警 [AlertId] "+a2.Id.Hex(), n.GetText([]*Alert{{Id: a2.Id, Description: "a2", Severity: SeverityP0}, a1}))
+}
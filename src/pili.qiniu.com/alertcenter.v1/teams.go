@@ -0,0 +1,245 @@
+package alertcenter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	DefaultTeamsTimeLayout    = "2006-01-02 15:04:05"
+	DefaultTeamsMaxDisplayCnt = 3
+	DefaultTeamsTimeoutMS     = 10 * 1e3
+	DefaultTeamsViewText      = "View source"
+	DefaultTeamsAckText       = "Ack in portal"
+)
+
+type TeamsCfg struct {
+	Name       string `json:"name"`
+	WebhookUrl string `json:"webhook_url"`
+	TimeLayout string `json:"time_layout"`
+	// 表示一条消息里最多可以装多少条告警
+	MaxDisplayCnt int    `json:"max_display_count"`
+	TimeoutMS     int    `json:"timeout_ms"`
+	PortalUrl     string `json:"portal_url"`
+
+	// 每个告警的 title、body、footer 模板，分别为 section 的 activityTitle、activitySubtitle 和 text，
+	// 第一个告警的 title 同时作为卡片标题
+	Template TemplateCfg `json:"template"`
+}
+
+// 标题带告警级别，正文只有开始时间
+var DefaultTeamsTemplate = TemplateCfg{
+	Title: `[{{.Severity}}] {{.Description}} | {{.Status}}`,
+	Body:  `[StartsAt] {{.StartsAt.Format .TimeLayout}}`,
+}
+
+func (cfg *TeamsCfg) Check() {
+	if cfg.Name == "" {
+		log.Panic("miss Name of teamsCfg")
+	}
+	if cfg.WebhookUrl == "" {
+		log.Panic("miss WebhookUrl of teamsCfg:", cfg.Name)
+	}
+	if cfg.TimeLayout == "" {
+		cfg.TimeLayout = DefaultTeamsTimeLayout
+	}
+	if cfg.MaxDisplayCnt == 0 {
+		cfg.MaxDisplayCnt = DefaultTeamsMaxDisplayCnt
+	}
+	if cfg.TimeoutMS == 0 {
+		cfg.TimeoutMS = DefaultTeamsTimeoutMS
+	}
+}
+
+type Teams struct {
+	*TeamsCfg
+	cli  *http.Client
+	tmpl *Templates
+}
+
+func NewTeams(cfg TeamsCfg) *Teams {
+	cfg.Check()
+	return &Teams{
+		TeamsCfg: &cfg,
+		cli:      &http.Client{Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond},
+		tmpl:     NewTemplates(cfg.Template, DefaultTeamsTemplate),
+	}
+}
+
+type TeamsColor string
+
+// 与 Slack 的 good、warning、danger 对应
+const (
+	TeamsGood    TeamsColor = "2EB886"
+	TeamsWarning TeamsColor = "DAA038"
+	TeamsDanger  TeamsColor = "A30200"
+)
+
+func NewTeamsColor(s Severity) (color TeamsColor) {
+	switch NewSlackColor(s) {
+	case SlackGood:
+		color = TeamsGood
+	case SlackDanger:
+		color = TeamsDanger
+	default:
+		color = TeamsWarning
+	}
+	return
+}
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type teamsTarget struct {
+	OS  string `json:"os"`
+	Uri string `json:"uri"`
+}
+
+type teamsAction struct {
+	Type    string        `json:"@type"`
+	Name    string        `json:"name"`
+	Targets []teamsTarget `json:"targets"`
+}
+
+type teamsSection struct {
+	ActivityTitle    string        `json:"activityTitle"`
+	ActivitySubtitle string        `json:"activitySubtitle,omitempty"`
+	Text             string        `json:"text,omitempty"`
+	Facts            []teamsFact   `json:"facts,omitempty"`
+	Markdown         bool          `json:"markdown"`
+	PotentialAction  []teamsAction `json:"potentialAction,omitempty"`
+}
+
+type TeamsReq struct {
+	Type       string         `json:"@type"`
+	Context    string         `json:"@context"`
+	ThemeColor TeamsColor     `json:"themeColor"`
+	Summary    string         `json:"summary"`
+	Title      string         `json:"title"`
+	Text       string         `json:"text,omitempty"`
+	Sections   []teamsSection `json:"sections"`
+}
+
+func newTeamsOpenUri(name, uri string) teamsAction {
+	return teamsAction{
+		Type:    "OpenUri",
+		Name:    name,
+		Targets: []teamsTarget{{OS: "default", Uri: uri}},
+	}
+}
+
+func (n *Teams) Name() string {
+	return n.TeamsCfg.Name
+}
+
+func (n *Teams) Notify(msg Message) (err error) {
+	xl := msg.xl
+	if len(msg.Alerts) == 0 {
+		return
+	}
+	err = n.SendMsg(xl, n.GetReq(msg))
+	return
+}
+
+func (n *Teams) Preview(msg Message) (interface{}, error) {
+	return n.GetReq(msg), nil
+}
+
+func (n *Teams) GetReq(msg Message) *TeamsReq {
+	a := msg.Alerts[0]
+	req := &TeamsReq{
+		Type:       "MessageCard",
+		Context:    "http://schema.org/extensions",
+		ThemeColor: NewTeamsColor(a.Severity),
+		Summary:    a.Description,
+		Title:      n.GetTitle(a),
+		Sections:   make([]teamsSection, 0, len(msg.Alerts)),
+	}
+	if len(msg.Alerts) > 1 {
+		req.Title = fmt.Sprintf("%v 等 %v 个告警", req.Title, len(msg.Alerts))
+	}
+	for i, a := range msg.Alerts {
+		req.Sections = append(req.Sections, n.GetSection(a))
+		if i == n.MaxDisplayCnt-1 {
+			break
+		}
+	}
+	if len(msg.Alerts) > n.MaxDisplayCnt {
+		req.Text = fmt.Sprintf("共有 %v 个告警", len(msg.Alerts))
+		if n.PortalUrl != "" {
+			req.Text += fmt.Sprintf(" [%v](%v)", DefaultSlackMoreAlertsText, n.PortalUrl)
+		}
+	}
+	return req
+}
+
+func (n *Teams) templateData(a *Alert) *TemplateData {
+	return &TemplateData{
+		Alert:      a,
+		PortalUrl:  n.PortalUrl,
+		TimeLayout: n.TimeLayout,
+	}
+}
+
+func (n *Teams) GetTitle(a *Alert) string {
+	return n.tmpl.Execute(TemplateTitle, n.templateData(a))
+}
+
+func (n *Teams) GetSection(a *Alert) teamsSection {
+	sec := teamsSection{
+		ActivityTitle:    n.GetTitle(a),
+		ActivitySubtitle: n.tmpl.Execute(TemplateBody, n.templateData(a)),
+		Text:             n.tmpl.Execute(TemplateFooter, n.templateData(a)),
+		Markdown:         true,
+	}
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sec.Facts = append(sec.Facts, teamsFact{k, a.Labels[k]})
+	}
+	sec.Facts = append(sec.Facts, teamsFact{"AlertId", a.Id.Hex()}, teamsFact{"Key", a.Key})
+	if a.IsEmergent {
+		sec.Facts = append(sec.Facts, teamsFact{"Emergent", DefaultLeanChatEmergencyText})
+	}
+
+	if a.GeneratorURL != "" {
+		sec.PotentialAction = append(sec.PotentialAction, newTeamsOpenUri(DefaultTeamsViewText, a.GeneratorURL))
+	}
+	if n.PortalUrl != "" && a.Status == AlertFiring {
+		sec.PotentialAction = append(sec.PotentialAction, newTeamsOpenUri(DefaultTeamsAckText, n.PortalUrl))
+	}
+	return sec
+}
+
+func (n *Teams) SendMsg(xl *xlog.Logger, req *TeamsReq) (err error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	resp, err := n.cli.Post(n.WebhookUrl, "application/json", bytes.NewReader(b))
+	if err != nil {
+		xl.Errorf("Teams Notify(msg) error: %+v", err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("teams response %v: %s", resp.StatusCode, body)
+		xl.Errorf("Teams %v Notify(msg) error: %v", n.Name(), err)
+	}
+	return
+}
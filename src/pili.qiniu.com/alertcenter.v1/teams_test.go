@@ -0,0 +1,59 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestTeams(t *testing.T) {
+	ast := assert.New(t)
+
+	reqC := make(chan TeamsReq, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req TeamsReq
+		ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+		reqC <- req
+		w.Write([]byte("1"))
+	}))
+	defer ts.Close()
+
+	n := NewTeams(TeamsCfg{
+		Name:          "teams",
+		WebhookUrl:    ts.URL,
+		MaxDisplayCnt: 1,
+		PortalUrl:     "http://portal",
+	})
+
+	a1 := &Alert{
+		Id:           bson.NewObjectId(),
+		Key:          "key1",
+		Description:  "a1",
+		Status:       AlertFiring,
+		Severity:     SeverityCritical,
+		GeneratorURL: "http://prom",
+		Labels:       map[string]string{"idc": "xs"},
+	}
+	a2 := &Alert{Id: bson.NewObjectId(), Description: "a2", Status: AlertResolved, Severity: SeveritySuccess}
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a1, a2)))
+
+	req := <-reqC
+	ast.Equal("MessageCard", req.Type)
+	ast.Equal(TeamsDanger, req.ThemeColor)
+	ast.Equal(1, len(req.Sections))
+	ast.Contains(req.Text, "共有 2 个告警")
+	sec := req.Sections[0]
+	ast.Equal([]teamsFact{{"idc", "xs"}, {"AlertId", a1.Id.Hex()}, {"Key", "key1"}}, sec.Facts)
+	ast.Equal(2, len(sec.PotentialAction))
+	ast.Equal("http://prom", sec.PotentialAction[0].Targets[0].Uri)
+	ast.Equal(DefaultTeamsAckText, sec.PotentialAction[1].Name)
+	ast.Equal("http://portal", sec.PotentialAction[1].Targets[0].Uri)
+
+	ast.Equal(TeamsGood, NewTeamsColor(SeveritySuccess))
+	ast.Equal(TeamsWarning, NewTeamsColor(SeverityP1))
+}
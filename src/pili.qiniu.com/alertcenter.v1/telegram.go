@@ -0,0 +1,283 @@
+package alertcenter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	DefaultTelegramApiUrl     = "https://api.telegram.org"
+	DefaultTelegramTimeLayout = "2006-01-02 15:04:05"
+	DefaultTelegramTimeoutMS  = 10 * 1e3
+
+	// 一条消息最多 4096 个字符
+	TelegramMaxMsgLen = 4096
+)
+
+type TelegramCfg struct {
+	Name     string   `json:"name"`
+	ApiUrl   string   `json:"api_url"`
+	BotToken string   `json:"bot_token"`
+	ChatIds  []string `json:"chat_ids"`
+
+	TimeLayout string `json:"time_layout"`
+	TimeoutMS  int    `json:"timeout_ms"`
+	PortalUrl  string `json:"portal_url"`
+
+	// 每个告警的 title、body、footer 模板，输出为普通文本，发送时转义为 MarkdownV2；
+	// title 前面加上级别，body 后面是 label，footer 不为空时追加在 label 后面
+	Template TemplateCfg `json:"template"`
+}
+
+// 标题为描述和状态，正文为开始时间，最后附上告警的 id 和 key
+var DefaultTelegramTemplate = TemplateCfg{
+	Title:  `{{.Description}} | {{.Status}}`,
+	Body:   `[StartsAt] {{.StartsAt.Format .TimeLayout}}`,
+	Footer: DefaultLeanAlertIdHeader + ` {{.Id.Hex}} ` + DefaultSlackAlertKeyHeader + ` {{.Key}}`,
+}
+
+func (cfg *TelegramCfg) Check() {
+	if cfg.Name == "" {
+		log.Panic("miss Name of telegramCfg")
+	}
+	if cfg.BotToken == "" {
+		log.Panic("miss BotToken of telegramCfg:", cfg.Name)
+	}
+	if len(cfg.ChatIds) == 0 {
+		log.Panic("miss ChatIds of telegramCfg:", cfg.Name)
+	}
+	if cfg.ApiUrl == "" {
+		cfg.ApiUrl = DefaultTelegramApiUrl
+	}
+	cfg.ApiUrl = strings.TrimSuffix(cfg.ApiUrl, "/")
+	if cfg.TimeLayout == "" {
+		cfg.TimeLayout = DefaultTelegramTimeLayout
+	}
+	if cfg.TimeoutMS == 0 {
+		cfg.TimeoutMS = DefaultTelegramTimeoutMS
+	}
+}
+
+type Telegram struct {
+	*TelegramCfg
+	cli  *http.Client
+	tmpl *Templates
+}
+
+func NewTelegram(cfg TelegramCfg) *Telegram {
+	cfg.Check()
+	return &Telegram{
+		TelegramCfg: &cfg,
+		cli:         &http.Client{Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond},
+		tmpl:        NewTemplates(cfg.Template, DefaultTelegramTemplate),
+	}
+}
+
+type TelegramReq struct {
+	ChatId                string `json:"chat_id"`
+	Text                  string `json:"text"`
+	ParseMode             string `json:"parse_mode"`
+	DisableWebPagePreview bool   `json:"disable_web_page_preview"`
+}
+
+type telegramResp struct {
+	Ok          bool   `json:"ok"`
+	ErrorCode   int    `json:"error_code"`
+	Description string `json:"description"`
+}
+
+var telegramEscaper = strings.NewReplacer(
+	"\\", "\\\\", "_", "\\_", "*", "\\*", "[", "\\[", "]", "\\]", "(", "\\(", ")", "\\)",
+	"~", "\\~", "`", "\\`", ">", "\\>", "#", "\\#", "+", "\\+", "-", "\\-", "=", "\\=",
+	"|", "\\|", "{", "\\{", "}", "\\}", ".", "\\.", "!", "\\!",
+)
+
+// MarkdownV2 中普通文本需要转义的字符
+func EscapeTelegram(s string) string {
+	return telegramEscaper.Replace(s)
+}
+
+// MarkdownV2 链接地址中只需要转义 ) 和 \
+func escapeTelegramUrl(s string) string {
+	return strings.NewReplacer("\\", "\\\\", ")", "\\)").Replace(s)
+}
+
+func NewTelegramEmoji(s Severity) string {
+	switch s {
+	case SeverityCritical, SeverityP0:
+		return "🔴"
+	case SeveritySuccess:
+		return "✅"
+	default:
+		return "🟠"
+	}
+}
+
+func (n *Telegram) Name() string {
+	return n.TelegramCfg.Name
+}
+
+func (n *Telegram) Notify(msg Message) (err error) {
+	_, err = n.NotifyTargets(msg, nil)
+	return
+}
+
+// targets 为会话 id，为空时发送给所有会话；一个会话中有一条消息发送失败时，重试时重新发送这个会话的所有消息
+func (n *Telegram) NotifyTargets(msg Message, targets []string) (failed []string, err error) {
+	xl := msg.xl
+	if len(msg.Alerts) == 0 {
+		return
+	}
+	if len(targets) == 0 {
+		targets = n.ChatIds
+	}
+
+	texts := n.GetTexts(msg)
+	for _, chatId := range targets {
+		for _, text := range texts {
+			err1 := n.SendMsg(xl, &TelegramReq{
+				ChatId:                chatId,
+				Text:                  text,
+				ParseMode:             "MarkdownV2",
+				DisableWebPagePreview: true,
+			})
+			if err1 != nil {
+				err = err1
+				failed = append(failed, chatId)
+				break
+			}
+		}
+	}
+	return
+}
+
+// 返回发送到每个会话的消息
+func (n *Telegram) Preview(msg Message) (interface{}, error) {
+	return n.GetTexts(msg), nil
+}
+
+func (n *Telegram) GetTexts(msg Message) []string {
+	blocks := make([]string, 0, len(msg.Alerts))
+	for _, a := range msg.Alerts {
+		blocks = append(blocks, n.GetText(a))
+	}
+	return SplitTelegramText(blocks, TelegramMaxMsgLen)
+}
+
+func (n *Telegram) templateData(a *Alert) *TemplateData {
+	return &TemplateData{
+		Alert:      a,
+		PortalUrl:  n.PortalUrl,
+		TimeLayout: n.TimeLayout,
+	}
+}
+
+func (n *Telegram) GetText(a *Alert) string {
+	title := EscapeTelegram(n.tmpl.Execute(TemplateTitle, n.templateData(a)))
+	if a.GeneratorURL != "" {
+		title = fmt.Sprintf("[%v](%v)", title, escapeTelegramUrl(a.GeneratorURL))
+	}
+	lines := []string{
+		fmt.Sprintf("%v *\\[%v\\]* %v", NewTelegramEmoji(a.Severity), EscapeTelegram(string(a.Severity)), title),
+	}
+	if body := n.tmpl.Execute(TemplateBody, n.templateData(a)); body != "" {
+		lines = append(lines, EscapeTelegram(body))
+	}
+
+	keys := make([]string, 0, len(a.Labels))
+	for k := range a.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		lines = append(lines, fmt.Sprintf("_%v_: %v", EscapeTelegram(k), EscapeTelegram(a.Labels[k])))
+	}
+	if footer := n.tmpl.Execute(TemplateFooter, n.templateData(a)); footer != "" {
+		lines = append(lines, EscapeTelegram(footer))
+	}
+	if a.IsEmergent {
+		emergency := EscapeTelegram(DefaultLeanChatEmergencyText)
+		if n.PortalUrl != "" {
+			emergency = fmt.Sprintf("[%v](%v)", emergency, escapeTelegramUrl(n.PortalUrl))
+		}
+		lines = append(lines, "*"+emergency+"*")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// 把多个告警的文本合并成尽量少的消息，每条消息不超过 limit 个字符
+// 单个告警超过 limit 时按行切分，避免切开 *bold*、[text](url)；单行仍然超过 limit 时按字符切分，并且不会在转义符 \ 之后切开
+func SplitTelegramText(blocks []string, limit int) (texts []string) {
+	cur := ""
+	add := func(s, sep string) {
+		if cur != "" && utf8.RuneCountInString(cur)+len(sep)+utf8.RuneCountInString(s) <= limit {
+			cur += sep + s
+			return
+		}
+		if cur != "" {
+			texts = append(texts, cur)
+		}
+		cur = s
+	}
+	for _, b := range blocks {
+		if utf8.RuneCountInString(b) <= limit {
+			add(b, "\n\n")
+			continue
+		}
+		for i, line := range strings.Split(b, "\n") {
+			sep := "\n"
+			if i == 0 {
+				sep = "\n\n"
+			}
+			for utf8.RuneCountInString(line) > limit {
+				rs := []rune(line)
+				j := limit
+				for j > 1 && rs[j-1] == '\\' {
+					j--
+				}
+				add(string(rs[:j]), sep)
+				line = string(rs[j:])
+			}
+			add(line, sep)
+		}
+	}
+	if cur != "" {
+		texts = append(texts, cur)
+	}
+	return
+}
+
+func (n *Telegram) SendMsg(xl *xlog.Logger, req *TelegramReq) (err error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	url := fmt.Sprintf("%v/bot%v/sendMessage", n.ApiUrl, n.BotToken)
+	resp, err := n.cli.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		xl.Errorf("Telegram Notify(msg) chat: %v, error: %+v", req.ChatId, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var res telegramResp
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		xl.Errorf("Telegram decode resp, status: %v, err: %v", resp.StatusCode, err)
+		return
+	}
+	if !res.Ok {
+		xl.Errorf("Telegram chat: %v, Resp: %+v", req.ChatId, res)
+		err = fmt.Errorf("%v %v", res.ErrorCode, res.Description)
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestEscapeTelegram(t *testing.T) {
+	ast := assert.New(t)
+
+	ast.Equal(`cpu\.usage \> 90% \(node\-1\) \[x\_y\]\!`, EscapeTelegram("cpu.usage > 90% (node-1) [x_y]!"))
+	ast.Equal(`a\\b`, EscapeTelegram(`a\b`))
+}
+
+func TestSplitTelegramText(t *testing.T) {
+	ast := assert.New(t)
+
+	ast.Equal([]string{"aaa\n\nbbb", "cccc"}, SplitTelegramText([]string{"aaa", "bbb", "cccc"}, 8))
+	ast.Equal([]string{"aaaa", "aa", "b"}, SplitTelegramText([]string{"aaaaaa", "b"}, 4))
+	// 不在转义符之后切开
+	ast.Equal([]string{"ab", `\.c`, "d"}, SplitTelegramText([]string{`ab\.cd`}, 3))
+
+	// 超过 limit 的告警按行切分
+	ast.Equal([]string{"x\n\n*a*", "[b](u)\n_c_"}, SplitTelegramText([]string{"x", "*a*\n[b](u)\n_c_"}, 10))
+
+	long := strings.Repeat("告警", 3000)
+	for _, text := range SplitTelegramText([]string{long}, TelegramMaxMsgLen) {
+		ast.True(utf8.RuneCountInString(text) <= TelegramMaxMsgLen)
+	}
+}
+
+func TestTelegram(t *testing.T) {
+	ast := assert.New(t)
+
+	reqC := make(chan TelegramReq, 4)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ast.Equal("/botbot-token/sendMessage", r.URL.Path)
+		var req TelegramReq
+		ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+		reqC <- req
+		if req.ChatId == "bad" {
+			w.Write([]byte(`{"ok": false, "error_code": 400, "description": "Bad Request: chat not found"}`))
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	}))
+	defer ts.Close()
+
+	n := NewTelegram(TelegramCfg{
+		Name:     "telegram",
+		ApiUrl:   ts.URL + "/",
+		BotToken: "bot-token",
+		ChatIds:  []string{"-1001", "bad"},
+	})
+
+	a := &Alert{
+		Id:           bson.NewObjectId(),
+		Key:          "key1",
+		Description:  "disk.usage > 90%",
+		Status:       AlertFiring,
+		Severity:     SeverityP0,
+		GeneratorURL: "http://prom/graph?g0.expr=(up)",
+		Labels:       map[string]string{"node_name": "vdn-1"},
+	}
+	err := n.Notify(NewMessage(xlog.NewDummy(), a))
+	ast.EqualError(err, "400 Bad Request: chat not found")
+
+	req := <-reqC
+	ast.Equal("-1001", req.ChatId)
+	ast.Equal("MarkdownV2", req.ParseMode)
+	ast.Contains(req.Text, `[disk\.usage \> 90% \| firing](http://prom/graph?g0.expr=(up\))`)
+	ast.Contains(req.Text, `_node\_name_: vdn\-1`)
+	ast.Contains(req.Text, a.Id.Hex())
+	req = <-reqC
+	ast.Equal("bad", req.ChatId)
+
+	// 只重试发送失败的会话
+	failed, err := n.NotifyTargets(NewMessage(xlog.NewDummy(), a), nil)
+	ast.Error(err)
+	ast.Equal([]string{"bad"}, failed)
+	<-reqC
+	<-reqC
+	failed, err = n.NotifyTargets(NewMessage(xlog.NewDummy(), a), []string{"-1001"})
+	ast.NoError(err)
+	ast.Nil(failed)
+	ast.Equal("-1001", (<-reqC).ChatId)
+	ast.Equal(0, len(reqC))
+}
@@ -0,0 +1,207 @@
+package alertcenter
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"text/template"
+	"time"
+	"unicode/utf8"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	DefaultTemplateReloadMS = 10 * 1e3
+
+	TemplateTitle  = "title"
+	TemplateBody   = "body"
+	TemplateFooter = "footer"
+)
+
+// 通知消息的标题、正文、页脚模板，使用 text/template 语法，为空时使用 notifier 默认的模板
+// File 中通过 {{define "title"}}...{{end}} 的方式定义，优先级高于 Title、Body、Footer，文件修改后自动重新加载
+type TemplateCfg struct {
+	Title    string `json:"title"`
+	Body     string `json:"body"`
+	Footer   string `json:"footer"`
+	File     string `json:"file"`
+	ReloadMS int    `json:"reload_ms"`
+}
+
+func (cfg *TemplateCfg) Check() {
+	if cfg.ReloadMS == 0 {
+		cfg.ReloadMS = DefaultTemplateReloadMS
+	}
+}
+
+// 模板中可以使用的数据，Alert 的字段可以直接使用，比如 {{.Description}}
+type TemplateData struct {
+	*Alert
+	PortalUrl     string
+	TimeLayout    string
+	TimeHeader    string
+	AlertIdHeader string
+	// 告警被 ack 时为 ack 的用户名，目前只有 Slack 修改消息标题时使用
+	AckedBy string
+}
+
+var templateFuncs = template.FuncMap{
+	"humanize":    humanizeDuration,
+	"since":       time.Since,
+	"label":       func(name string, a *Alert) string { return a.LabelValue(name) },
+	"truncate":    truncate,
+	"analyzerUrl": analyzerUrl,
+}
+
+// 1d2h、2h3m、3m4s
+func humanizeDuration(d time.Duration) string {
+	d = d / time.Second * time.Second
+	switch {
+	case d >= day:
+		return fmt.Sprintf("%dd%dh", d/day, d%day/time.Hour)
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%dm", d/time.Hour, d%time.Hour/time.Minute)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%ds", d/time.Minute, d%time.Minute/time.Second)
+	}
+	return d.String()
+}
+
+// 按字符截断，超过 n 个字符时以 ... 结尾
+func truncate(n int, s string) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	if n <= 3 {
+		return string([]rune(s)[:n])
+	}
+	return string([]rune(s)[:n-3]) + "..."
+}
+
+func analyzerUrl(portalUrl, typ, alertId string) string {
+	return fmt.Sprintf("%v/loganalyzer?type=%v&alertId=%v", portalUrl, typ, alertId)
+}
+
+type Templates struct {
+	*TemplateCfg
+	mutex    sync.RWMutex
+	defaults *template.Template
+	tmpl     *template.Template
+	modTime  time.Time
+}
+
+// defaults 是 notifier 默认的模板，与没有模板之前的输出一致
+func NewTemplates(cfg TemplateCfg, defaults TemplateCfg) *Templates {
+	cfg.Check()
+	t := &Templates{TemplateCfg: &cfg}
+
+	var err error
+	t.defaults, err = parseTemplates(defaults, "")
+	if err != nil {
+		log.Panic("parse default templates err:", err)
+	}
+	content, err := t.readFile()
+	if err != nil {
+		log.Panic("read template file err:", err)
+	}
+	t.tmpl, err = parseTemplates(t.merge(defaults), content)
+	if err != nil {
+		log.Panic("parse templates err:", err)
+	}
+	if cfg.File != "" {
+		go t.TimingReload(xlog.NewDummy(), defaults)
+	}
+	return t
+}
+
+func (t *Templates) merge(defaults TemplateCfg) TemplateCfg {
+	if t.Title != "" {
+		defaults.Title = t.Title
+	}
+	if t.Body != "" {
+		defaults.Body = t.Body
+	}
+	if t.Footer != "" {
+		defaults.Footer = t.Footer
+	}
+	return defaults
+}
+
+func (t *Templates) readFile() (content string, err error) {
+	if t.File == "" {
+		return
+	}
+	fi, err := os.Stat(t.File)
+	if err != nil {
+		return
+	}
+	b, err := ioutil.ReadFile(t.File)
+	if err != nil {
+		return
+	}
+	t.modTime = fi.ModTime()
+	return string(b), nil
+}
+
+func parseTemplates(cfg TemplateCfg, content string) (tmpl *template.Template, err error) {
+	tmpl = template.New("").Funcs(templateFuncs)
+	for name, text := range map[string]string{TemplateTitle: cfg.Title, TemplateBody: cfg.Body, TemplateFooter: cfg.Footer} {
+		_, err = tmpl.New(name).Parse(text)
+		if err != nil {
+			return
+		}
+	}
+	if content != "" {
+		_, err = tmpl.Parse(content)
+	}
+	return
+}
+
+// 模板文件修改后重新加载，加载失败时继续使用之前的模板
+func (t *Templates) TimingReload(xl *xlog.Logger, defaults TemplateCfg) {
+	for range time.Tick(time.Duration(t.ReloadMS) * time.Millisecond) {
+		fi, err := os.Stat(t.File)
+		if err != nil {
+			xl.Errorf("os.Stat(%v) err: %v", t.File, err)
+			continue
+		}
+		if !fi.ModTime().After(t.modTime) {
+			continue
+		}
+		content, err := t.readFile()
+		if err != nil {
+			xl.Errorf("read template file %v err: %v", t.File, err)
+			continue
+		}
+		tmpl, err := parseTemplates(t.merge(defaults), content)
+		if err != nil {
+			xl.Errorf("parse template file %v err: %v", t.File, err)
+			continue
+		}
+		t.mutex.Lock()
+		t.tmpl = tmpl
+		t.mutex.Unlock()
+		xl.Infof("template file %v reloaded", t.File)
+	}
+}
+
+// 执行出错时使用默认的模板
+func (t *Templates) Execute(name string, data *TemplateData) string {
+	t.mutex.RLock()
+	tmpl := t.tmpl
+	t.mutex.RUnlock()
+
+	var buf bytes.Buffer
+	err := tmpl.ExecuteTemplate(&buf, name, data)
+	if err == nil {
+		return buf.String()
+	}
+	log.Errorf("execute template %v err: %v", name, err)
+	buf.Reset()
+	t.defaults.ExecuteTemplate(&buf, name, data)
+	return buf.String()
+}
@@ -0,0 +1,149 @@
+package alertcenter
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestDefaultTemplates(t *testing.T) {
+	ast := assert.New(t)
+
+	id := bson.NewObjectId()
+	startsAt := time.Date(2017, 8, 1, 12, 0, 0, 0, time.Local)
+	a := &Alert{
+		Id:            id,
+		Key:           "k1",
+		Description:   "disk full",
+		Status:        AlertResolved,
+		IsEmergent:    true,
+		StartsAt:      startsAt,
+		AnalyzerTypes: []string{"t1", "t2"},
+	}
+
+	slack := NewSlack(SlackCfg{Name: "slack", PortalUrl: "http://portal"})
+	ast.Equal("disk full | resolved | 该告警是升级的告警", slack.GetTitle(a))
+	ast.Equal("[AlertId] "+id.Hex()+" [Key] k1 <http://portal|[该告警被升级请赶紧处理告警]>", slack.GetFooter(a))
+	ast.Equal("*<http://portal/loganalyzer?type=t1&alertId="+id.Hex()+"|点击查看 t1 类型告警分析结果>*\n"+
+		"*<http://portal/loganalyzer?type=t2&alertId="+id.Hex()+"|点击查看 t2 类型告警分析结果>*", slack.GetText(a))
+
+	lc := NewLeanChat(LeanChatCfg{Name: "leanchat", Hosts: []string{"http://leanchat"}})
+	ast.Equal("disk full | resolved ", lc.GetTitle(a))
+	ast.Equal("[StartsAt] "+startsAt.Format(DefaultLeanChatTimeLayout)+"    [AlertId] "+id.Hex(), lc.GetDescription(a))
+
+	a.Status = AlertFiring
+	a.IsEmergent = false
+	ast.Equal("disk full | firing", slack.GetTitle(a))
+	ast.Equal("disk full | firing", lc.GetTitle(a))
+
+	qq := NewQQ(QQCfg{Name: "qq", Robot: "r", To: "t", OpType: "o", AK: "ak", SK: "sk"})
+	a.GeneratorURL = "http://prom"
+	ast.Equal("disk full\nhttp://prom", qq.GetText(a))
+}
+
+func TestNotifierTemplates(t *testing.T) {
+	ast := assert.New(t)
+
+	id := bson.NewObjectId()
+	a := &Alert{
+		Id:          id,
+		Key:         "k1",
+		Description: "disk full",
+		Severity:    SeverityP0,
+		Status:      AlertFiring,
+		Labels:      map[string]string{"idc": "xs"},
+		StartsAt:    time.Now().Add(-90 * time.Minute),
+	}
+	tmpl := TemplateCfg{
+		Title:  `{{label "idc" .Alert}} {{.Description}}`,
+		Body:   `已持续 {{humanize (since .StartsAt)}}`,
+		Footer: `{{.Key}}`,
+	}
+
+	dt := NewDingTalk(DingTalkCfg{Name: "dingtalk", AccessToken: "t", Template: tmpl}, nil)
+	ast.Equal("xs disk full", dt.GetTitle(a))
+	ast.Equal("### <font color=\"#FF0000\">[P0]</font> xs disk full\n已持续 1h30m\nk1", dt.GetText(a))
+
+	wc := NewWeCom(WeComCfg{Name: "wecom", Key: "k", Template: tmpl}, nil)
+	ast.Equal("**<font color=\"warning\">[P0]</font>** xs disk full\n已持续 1h30m\nk1", wc.GetText(a))
+
+	fs := NewFeishu(FeishuCfg{Name: "feishu", WebhookUrl: "http://feishu", Template: tmpl})
+	ast.Equal("[P0] xs disk full", fs.GetTitle(NewMessage(nil, a)))
+	ast.Equal("已持续 1h30m\nk1", fs.GetElements(a)[0].Text.Content)
+
+	tg := NewTelegram(TelegramCfg{Name: "telegram", BotToken: "t", ChatIds: []string{"1"}, Template: tmpl})
+	ast.Equal("🔴 *\\[P0\\]* xs disk full\n已持续 1h30m\n_idc_: xs\nk1", tg.GetText(a))
+
+	tm := NewTeams(TeamsCfg{Name: "teams", WebhookUrl: "http://teams", Template: tmpl})
+	sec := tm.GetSection(a)
+	ast.Equal("xs disk full", sec.ActivityTitle)
+	ast.Equal("已持续 1h30m", sec.ActivitySubtitle)
+	ast.Equal("k1", sec.Text)
+
+	em := NewEmail(EmailCfg{Name: "email", Host: "smtp", From: "a@b.c", To: []string{"d@e.f"}, Template: tmpl})
+	ast.Equal("[Alertcenter] xs disk full | 1 firing", em.GetSubject(NewMessage(nil, a)))
+	b, err := em.Render(NewMessage(nil, a))
+	ast.NoError(err)
+	ast.Contains(string(b), "[P0] xs disk full | firing\n已持续 1h30m\nk1\n")
+
+	sms := NewSms(SmsCfg{Template: tmpl}, 0, nil, nil, nil)
+	ast.Equal("xs disk full 已持续 1h30m k1", sms.GetText([]*Alert{a}))
+
+	// 默认模板与之前的输出一致
+	tm = NewTeams(TeamsCfg{Name: "teams", WebhookUrl: "http://teams"})
+	ast.Equal("[P0] disk full | firing", tm.GetSection(a).ActivityTitle)
+	ast.Equal("", tm.GetSection(a).Text)
+	sms = NewSms(SmsCfg{}, 0, nil, nil, nil)
+	ast.Equal("[P0] disk full [AlertId] "+id.Hex(), sms.GetText([]*Alert{a}))
+}
+
+func TestTemplates(t *testing.T) {
+	ast := assert.New(t)
+
+	a := &Alert{
+		Id:          bson.NewObjectId(),
+		Description: "磁盘空间不足请尽快处理",
+		Labels:      map[string]string{"idc": "xs"},
+		StartsAt:    time.Now().Add(-90 * time.Minute),
+	}
+	data := &TemplateData{Alert: a}
+	defaults := TemplateCfg{Title: "{{.Description}}", Body: "body", Footer: "footer"}
+
+	tmpl := NewTemplates(TemplateCfg{
+		Title: `[{{label "idc" .Alert}}] {{truncate 6 .Description}} {{humanize (since .StartsAt)}}`,
+	}, defaults)
+	ast.Equal("[xs] 磁盘空... 1h30m", tmpl.Execute(TemplateTitle, data))
+	ast.Equal("body", tmpl.Execute(TemplateBody, data))
+
+	// 执行出错时使用默认模板
+	tmpl = NewTemplates(TemplateCfg{Body: `{{.NotExist}}`}, defaults)
+	ast.Equal("body", tmpl.Execute(TemplateBody, data))
+
+	// 模板文件优先，修改后自动重新加载
+	file := "template_test.tmpl"
+	defer os.Remove(file)
+	ast.NoError(ioutil.WriteFile(file, []byte(`{{define "footer"}}v1 {{.Id.Hex}}{{end}}`), 0666))
+	tmpl = NewTemplates(TemplateCfg{Footer: "inline", File: file, ReloadMS: 10}, defaults)
+	ast.Equal("v1 "+a.Id.Hex(), tmpl.Execute(TemplateFooter, data))
+
+	time.Sleep(20 * time.Millisecond)
+	modTime := time.Now().Add(time.Second)
+	ast.NoError(ioutil.WriteFile(file, []byte(`{{define "footer"}}v2{{end}}`), 0666))
+	ast.NoError(os.Chtimes(file, modTime, modTime))
+	time.Sleep(50 * time.Millisecond)
+	ast.Equal("v2", tmpl.Execute(TemplateFooter, data))
+
+	// 解析失败时继续使用之前的模板
+	modTime = modTime.Add(time.Second)
+	ast.NoError(ioutil.WriteFile(file, []byte(`{{define "footer"}}{{end`), 0666))
+	ast.NoError(os.Chtimes(file, modTime, modTime))
+	time.Sleep(50 * time.Millisecond)
+	ast.Equal("v2", tmpl.Execute(TemplateFooter, data))
+
+	ast.Equal("30s", humanizeDuration(30*time.Second))
+	ast.Equal("1d2h", humanizeDuration(26*time.Hour+time.Minute))
+}
@@ -83,20 +83,23 @@ type Ack struct {
 // =====================================================================
 
 type Alert struct {
-	Id            bson.ObjectId     `bson:"_id" json:"id"`
-	Key           string            `json:"key" bson:"key"`
-	Status        AlertStatus       `json:"status" bson:"status"`
-	Description   string            `json:"desc" bson:"desc"`
-	StartsAt      time.Time         `json:"startsAt" bson:"startsAt"`
-	EndsAt        time.Time         `json:"endsAt" bson:"endsAt"`
-	Severity      Severity          `json:"severity" bson:"severity"`
-	Alertname     string            `json:"alertname" bson:"alertname"`
-	GeneratorURL  string            `json:"generatorUrl" bson:"generatorUrl"`
-	NeedHandle    bool              `json:"needHandle" bson:"needHandle"`
-	IsEmergent    bool              `json:"isEmergent" bson:"isEmergent"`
-	Labels        map[string]string `json:"labels" bson:"labels"`
-	Acks          []Ack             `json:"comments" bson:"acks"` // TODO
-	AnalyzerTypes []string          `json:"-" bson:"-"`
+	Id            bson.ObjectId      `bson:"_id" json:"id"`
+	Key           string             `json:"key" bson:"key"`
+	Status        AlertStatus        `json:"status" bson:"status"`
+	Description   string             `json:"desc" bson:"desc"`
+	StartsAt      time.Time          `json:"startsAt" bson:"startsAt"`
+	EndsAt        time.Time          `json:"endsAt" bson:"endsAt"`
+	Severity      Severity           `json:"severity" bson:"severity"`
+	Alertname     string             `json:"alertname" bson:"alertname"`
+	GeneratorURL  string             `json:"generatorUrl" bson:"generatorUrl"`
+	NeedHandle    bool               `json:"needHandle" bson:"needHandle"`
+	IsEmergent    bool               `json:"isEmergent" bson:"isEmergent"`
+	Labels        map[string]string  `json:"labels" bson:"labels"`
+	Acks          []Ack              `json:"comments" bson:"acks"` // TODO
+	SilencedBy    string             `json:"silencedBy,omitempty" bson:"silencedBy,omitempty"`
+	InhibitedBy   string             `json:"inhibitedBy,omitempty" bson:"inhibitedBy,omitempty"`
+	Escalations   []EscalationRecord `json:"escalations,omitempty" bson:"escalations,omitempty"`
+	AnalyzerTypes []string           `json:"-" bson:"-"`
 }
 
 func NewAlert(alert interface{}) (newAlert *Alert) {
@@ -155,6 +158,17 @@ func (alert *Alert) CalKey() string {
 	return hex.EncodeToString(h.Sum(nil))
 }
 
+// alertname 和 severity 在 NewAlert 时被从 Labels 中移除，这里统一处理
+func (alert *Alert) LabelValue(name string) string {
+	switch name {
+	case AlertNameLabel:
+		return alert.Alertname
+	case SeverityLabel:
+		return string(alert.Severity)
+	}
+	return alert.Labels[name]
+}
+
 func (s *Alert) Spawn() Alert {
 	return *s
 }
@@ -180,10 +194,24 @@ func (s ByStartsAt) Less(i, j int) bool {
 type Message struct {
 	xl     *xlog.Logger
 	Alerts []*Alert
+
+	// 不为空时忽略 AlertProfile 和默认的通知方式，只发送给这些 notifier
+	Notifiers []string
+	// caller 打电话的对象，为空时打给当前值班人员
+	Staffs []bson.ObjectId
+	// 升级策略发送的消息，caller 不受 CallIntervals 限制
+	Escalated bool
+	// 跳过 AlertProfile 路由已经发送过的 notifier，用于和告警同时发送的升级步骤
+	SkipRouted bool
+	// 紧急告警的重复发送，不参与分组，每次都直接发送
+	Resend bool
+
+	// Outbox.Queue 持久化的记录，发送给各个 notifier 的 delivery 写入 outbox 后删除
+	queueIds []bson.ObjectId
 }
 
 func NewMessage(xl *xlog.Logger, alerts ...*Alert) Message {
-	return Message{xl, alerts}
+	return Message{xl: xl, Alerts: alerts}
 }
 
 // =====================================================================
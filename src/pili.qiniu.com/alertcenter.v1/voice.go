@@ -0,0 +1,324 @@
+package alertcenter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniu/http/httputil.v1"
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	VoiceMorse  = "morse"
+	VoiceTwilio = "twilio"
+	VoiceFake   = "fake"
+
+	DefaultTwilioApiUrl    = "https://api.twilio.com"
+	DefaultTwilioTimeoutMS = 10 * 1e3
+	DefaultTwilioLanguage  = "zh-CN"
+	DefaultTwilioAckText   = "告警已确认"
+	TwilioSignatureHeader  = "X-Twilio-Signature"
+)
+
+var (
+	ErrInvalidTwilioSignature = httputil.NewError(http.StatusUnauthorized, "invalid twilio signature")
+	ErrTwilioNotConfigured    = httputil.NewError(http.StatusNotFound, "twilio voice provider not configured")
+)
+
+// 打电话的服务，返回服务商的呼叫 id 和实际呼叫的服务名
+type VoiceProvider interface {
+	Name() string
+	Call(xl *xlog.Logger, phone string, a *Alert) (callId, provider string, err error)
+}
+
+func NewVoiceProvider(name string, cfg *CallerCfg, morse *MorseClient) VoiceProvider {
+	switch name {
+	case VoiceMorse, "":
+		return NewMorseVoice(cfg.MorseUid, morse)
+	case VoiceTwilio:
+		return NewTwilioVoice(cfg.TwilioCfg)
+	case VoiceFake:
+		return NewFakeVoice()
+	}
+	log.Panic("unknown voice provider:", name)
+	return nil
+}
+
+// 没有使用 Twilio 时返回 nil
+func findTwilioVoice(p VoiceProvider) *TwilioVoice {
+	switch v := p.(type) {
+	case *TwilioVoice:
+		return v
+	case *FailoverVoice:
+		if t := findTwilioVoice(v.primary); t != nil {
+			return t
+		}
+		return findTwilioVoice(v.secondary)
+	}
+	return nil
+}
+
+// ================================================
+// Morse
+
+type MorseVoice struct {
+	uid   uint
+	morse *MorseClient
+}
+
+func NewMorseVoice(uid uint, morse *MorseClient) *MorseVoice {
+	return &MorseVoice{uid: uid, morse: morse}
+}
+
+func (v *MorseVoice) Name() string {
+	return VoiceMorse
+}
+
+// 由于 morse api 的限制，语音内容只能是不小于 100000 的数字，否则使用 DefaultCallerMsg
+func (v *MorseVoice) Call(xl *xlog.Logger, phone string, a *Alert) (callId, provider string, err error) {
+	msg := a.Description
+	if i, err := strconv.ParseInt(msg, 10, 64); err != nil || i < 100000 {
+		msg = DefaultCallerMsg
+	}
+	callId, err = v.morse.SendVoiceSms(xl, SendSmsIn{
+		Uid:         v.uid,
+		PhoneNumber: phone,
+		Message:     msg,
+	})
+	return callId, v.Name(), err
+}
+
+// ================================================
+// Twilio
+
+// 兼容 Twilio 的 REST API，通过 TwiML 的 <Say> 播报告警描述
+type TwilioCfg struct {
+	ApiUrl     string `json:"api_url"`
+	AccountSid string `json:"account_sid"`
+	AuthToken  string `json:"auth_token"`
+	From       string `json:"from"`
+	Language   string `json:"language"`
+	TimeoutMS  int    `json:"timeout_ms"`
+	// POST /caller/callback/twilio 的完整地址，设置后接收呼叫状态回调，接听的人按任意键 ack 告警
+	CallbackUrl string `json:"callback_url"`
+}
+
+func (cfg *TwilioCfg) Check() {
+	if cfg.AccountSid == "" {
+		log.Panic("miss AccountSid of twilioCfg")
+	}
+	if cfg.AuthToken == "" {
+		log.Panic("miss AuthToken of twilioCfg")
+	}
+	if cfg.From == "" {
+		log.Panic("miss From of twilioCfg")
+	}
+	if cfg.ApiUrl == "" {
+		cfg.ApiUrl = DefaultTwilioApiUrl
+	}
+	cfg.ApiUrl = strings.TrimSuffix(cfg.ApiUrl, "/")
+	if cfg.Language == "" {
+		cfg.Language = DefaultTwilioLanguage
+	}
+	if cfg.TimeoutMS == 0 {
+		cfg.TimeoutMS = DefaultTwilioTimeoutMS
+	}
+}
+
+type TwilioVoice struct {
+	*TwilioCfg
+	cli *http.Client
+}
+
+func NewTwilioVoice(cfg TwilioCfg) *TwilioVoice {
+	cfg.Check()
+	return &TwilioVoice{
+		TwilioCfg: &cfg,
+		cli:       &http.Client{Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond},
+	}
+}
+
+type twilioCallResp struct {
+	Sid     string `json:"sid"`
+	Status  string `json:"status"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (v *TwilioVoice) Name() string {
+	return VoiceTwilio
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (v *TwilioVoice) Twiml(a *Alert) string {
+	say := fmt.Sprintf(`<Say language="%v" loop="2">%v</Say>`, v.Language, xmlEscape(a.Description))
+	if v.CallbackUrl != "" {
+		say = fmt.Sprintf(`<Gather numDigits="1" action="%v">%v</Gather>`, xmlEscape(v.CallbackUrl), say)
+	}
+	return "<Response>" + say + "</Response>"
+}
+
+func (v *TwilioVoice) Call(xl *xlog.Logger, phone string, a *Alert) (callId, provider string, err error) {
+	provider = v.Name()
+	form := url.Values{}
+	form.Set("To", phone)
+	form.Set("From", v.From)
+	form.Set("Twiml", v.Twiml(a))
+	if v.CallbackUrl != "" {
+		form.Set("StatusCallback", v.CallbackUrl)
+		form.Add("StatusCallbackEvent", "answered")
+		form.Add("StatusCallbackEvent", "completed")
+	}
+
+	u := fmt.Sprintf("%v/2010-04-01/Accounts/%v/Calls.json", v.ApiUrl, v.AccountSid)
+	req, err := http.NewRequest("POST", u, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(v.AccountSid, v.AuthToken)
+	resp, err := v.cli.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var res twilioCallResp
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		return "", provider, fmt.Errorf("twilio decode resp, status: %v, err: %v", resp.StatusCode, err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return "", provider, fmt.Errorf("twilio %v %v", res.Code, res.Message)
+	}
+	return res.Sid, provider, nil
+}
+
+// 按键之后返回给 Twilio 的 TwiML
+func (v *TwilioVoice) AckTwiml() string {
+	return fmt.Sprintf(`<Response><Say language="%v">%v</Say></Response>`, v.Language, DefaultTwilioAckText)
+}
+
+// Twilio 的签名为 CallbackUrl 加上按 key 排序的所有参数，以 AuthToken 做 HMAC-SHA1 后 base64 编码
+func (v *TwilioVoice) Signature(form url.Values) string {
+	keys := make([]string, 0, len(form))
+	for k := range form {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	b.WriteString(v.CallbackUrl)
+	for _, k := range keys {
+		for _, value := range form[k] {
+			b.WriteString(k)
+			b.WriteString(value)
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(v.AuthToken))
+	mac.Write(b.Bytes())
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 状态回调和 <Gather> 按键都会请求 CallbackUrl，按键时 CallStatus 为 in-progress
+func (v *TwilioVoice) ParseCallback(header http.Header, form url.Values) (args *CallCallbackArgs, err error) {
+	if !hmac.Equal([]byte(header.Get(TwilioSignatureHeader)), []byte(v.Signature(form))) {
+		return nil, ErrInvalidTwilioSignature
+	}
+	args = &CallCallbackArgs{
+		CallId: form.Get("CallSid"),
+		Digits: form.Get("Digits"),
+	}
+	switch status := form.Get("CallStatus"); status {
+	case "in-progress":
+		args.Status = CallAnswered
+	case "canceled":
+		args.Status = CallFailed
+	default:
+		args.Status = CallStatus(status)
+	}
+	return
+}
+
+// ================================================
+// Fake
+
+type FakeCall struct {
+	Phone   string
+	AlertId string
+}
+
+// 只记录呼叫，用于测试环境，Err 不为空时呼叫失败
+type FakeVoice struct {
+	mutex sync.Mutex
+	Calls []FakeCall
+	Err   error
+}
+
+func NewFakeVoice() *FakeVoice {
+	return &FakeVoice{}
+}
+
+func (v *FakeVoice) Name() string {
+	return VoiceFake
+}
+
+func (v *FakeVoice) Call(xl *xlog.Logger, phone string, a *Alert) (callId, provider string, err error) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if v.Err != nil {
+		return "", v.Name(), v.Err
+	}
+	v.Calls = append(v.Calls, FakeCall{Phone: phone, AlertId: a.Id.Hex()})
+	return strconv.Itoa(len(v.Calls)), v.Name(), nil
+}
+
+// ================================================
+// Failover
+
+// 主服务呼叫失败时使用备用服务再呼叫一次
+type FailoverVoice struct {
+	primary   VoiceProvider
+	secondary VoiceProvider
+}
+
+func NewFailoverVoice(primary, secondary VoiceProvider) *FailoverVoice {
+	return &FailoverVoice{primary: primary, secondary: secondary}
+}
+
+func (v *FailoverVoice) Name() string {
+	return v.primary.Name()
+}
+
+// provider 为实际呼叫成功的服务，都失败时为备用服务
+func (v *FailoverVoice) Call(xl *xlog.Logger, phone string, a *Alert) (callId, provider string, err error) {
+	callId, provider, err = v.primary.Call(xl, phone, a)
+	if err == nil {
+		return
+	}
+	xl.Warnf("voice provider %v call %v err: %v, failover to %v", v.primary.Name(), phone, err, v.secondary.Name())
+	callId, provider, err1 := v.secondary.Call(xl, phone, a)
+	if err1 != nil {
+		return "", provider, fmt.Errorf("%v: %v; %v: %v", v.primary.Name(), err, v.secondary.Name(), err1)
+	}
+	return callId, provider, nil
+}
@@ -0,0 +1,122 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestTwilioVoice(t *testing.T) {
+	ast := assert.New(t)
+
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ast.Equal("/2010-04-01/Accounts/AC1/Calls.json", r.URL.Path)
+		user, pwd, ok := r.BasicAuth()
+		ast.True(ok)
+		ast.Equal("AC1", user)
+		ast.Equal("token", pwd)
+		ast.NoError(r.ParseForm())
+		ast.Equal("+8618600000000", r.PostForm.Get("To"))
+		ast.Equal("+10000000000", r.PostForm.Get("From"))
+		ast.Equal(`<Response><Say language="zh-CN" loop="2">disk &lt;90%&gt;</Say></Response>`, r.PostForm.Get("Twiml"))
+		if fail {
+			w.WriteHeader(400)
+			json.NewEncoder(w).Encode(twilioCallResp{Code: 21211, Message: "invalid To"})
+			return
+		}
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(twilioCallResp{Sid: "CA1", Status: "queued"})
+	}))
+	defer ts.Close()
+
+	v := NewTwilioVoice(TwilioCfg{ApiUrl: ts.URL, AccountSid: "AC1", AuthToken: "token", From: "+10000000000"})
+	a := &Alert{Id: bson.NewObjectId(), Description: "disk <90%>"}
+	callId, provider, err := v.Call(xlog.NewDummy(), "+8618600000000", a)
+	ast.NoError(err)
+	ast.Equal("CA1", callId)
+	ast.Equal(VoiceTwilio, provider)
+
+	fail = true
+	_, _, err = v.Call(xlog.NewDummy(), "+8618600000000", a)
+	ast.EqualError(err, "twilio 21211 invalid To")
+}
+
+func TestTwilioCallback(t *testing.T) {
+	ast := assert.New(t)
+
+	v := NewTwilioVoice(TwilioCfg{
+		AccountSid:  "AC1",
+		AuthToken:   "token",
+		From:        "+10000000000",
+		CallbackUrl: "https://alertcenter.example.com/caller/callback/twilio",
+	})
+	a := &Alert{Id: bson.NewObjectId(), Description: "disk full"}
+	ast.Equal(`<Response><Gather numDigits="1" action="https://alertcenter.example.com/caller/callback/twilio"><Say language="zh-CN" loop="2">disk full</Say></Gather></Response>`, v.Twiml(a))
+
+	form := url.Values{}
+	form.Set("CallSid", "CA1")
+	form.Set("CallStatus", "in-progress")
+	form.Set("Digits", "1")
+	header := http.Header{}
+	header.Set(TwilioSignatureHeader, v.Signature(form))
+	args, err := v.ParseCallback(header, form)
+	ast.NoError(err)
+	ast.Equal(&CallCallbackArgs{CallId: "CA1", Status: CallAnswered, Digits: "1"}, args)
+
+	form.Set("CallStatus", "no-answer")
+	_, err = v.ParseCallback(header, form)
+	ast.Equal(ErrInvalidTwilioSignature, err)
+
+	header.Set(TwilioSignatureHeader, v.Signature(form))
+	args, err = v.ParseCallback(header, form)
+	ast.NoError(err)
+	ast.Equal(CallNoAnswer, args.Status)
+}
+
+func TestFailoverVoice(t *testing.T) {
+	ast := assert.New(t)
+
+	xl := xlog.NewDummy()
+	a := &Alert{Id: bson.NewObjectId()}
+	primary, secondary := NewFakeVoice(), NewFakeVoice()
+	v := NewFailoverVoice(primary, secondary)
+
+	_, provider, err := v.Call(xl, "1", a)
+	ast.NoError(err)
+	ast.Equal(VoiceFake, provider)
+	ast.Equal(1, len(primary.Calls))
+	ast.Equal(0, len(secondary.Calls))
+
+	primary.Err = errors.New("primary down")
+	_, _, err = v.Call(xl, "2", a)
+	ast.NoError(err)
+	ast.Equal([]FakeCall{{Phone: "2", AlertId: a.Id.Hex()}}, secondary.Calls)
+
+	secondary.Err = errors.New("secondary down")
+	_, _, err = v.Call(xl, "3", a)
+	ast.EqualError(err, "fake: primary down; fake: secondary down")
+
+	// 返回实际呼叫成功的服务
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer ts.Close()
+	v = NewFailoverVoice(NewTwilioVoice(TwilioCfg{ApiUrl: ts.URL, AccountSid: "AC1", AuthToken: "token"}), NewFakeVoice())
+	callId, provider, err := v.Call(xl, "4", a)
+	ast.NoError(err)
+	ast.Equal("1", callId)
+	ast.Equal(VoiceFake, provider)
+
+	// caller 使用配置的 provider
+	caller := NewCaller(CallerCfg{VoiceProvider: VoiceFake, FilePath: "tmp"}, &FakeDutyMgr{}, func(Message) {}, nil)
+	ast.NoError(caller.SendVoiceSms(xl, a, nil))
+	ast.Equal([]FakeCall{{Phone: "18650317419", AlertId: a.Id.Hex()}}, caller.voice.(*FakeVoice).Calls)
+}
@@ -0,0 +1,218 @@
+package alertcenter
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	DefaultWebhookMethod          = "POST"
+	DefaultWebhookBody            = `{"alerts": {{json .Alerts}}}`
+	DefaultWebhookSignatureHeader = "X-Alertcenter-Signature"
+	DefaultWebhookTimeoutMS       = 10 * 1e3
+	DefaultWebhookTryTimes        = 1
+)
+
+// Url、Method、Headers 和 Body 都是 text/template，渲染的数据为 WebhookData
+// Method 渲染结果为空时使用 POST
+// 配置了 Secret 时，用 HMAC-SHA256(Secret, body) 签名，以 sha256=<hex> 的形式放在 SignatureHeader 中
+type WebhookCfg struct {
+	Name            string            `json:"name"`
+	Url             string            `json:"url"`
+	Method          string            `json:"method"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	Secret          string            `json:"secret"`
+	SignatureHeader string            `json:"signature_header"`
+	TimeoutMS       int               `json:"timeout_ms"`
+	TryTimes        int               `json:"try_times"`
+}
+
+func (cfg *WebhookCfg) Check() {
+	if cfg.Name == "" {
+		log.Panic("miss Name of webhookCfg")
+	}
+	if cfg.Url == "" {
+		log.Panic("miss Url of webhookCfg:", cfg.Name)
+	}
+	if cfg.Method == "" {
+		cfg.Method = DefaultWebhookMethod
+	}
+	if cfg.Body == "" {
+		cfg.Body = DefaultWebhookBody
+	}
+	if cfg.SignatureHeader == "" {
+		cfg.SignatureHeader = DefaultWebhookSignatureHeader
+	}
+	if cfg.TimeoutMS == 0 {
+		cfg.TimeoutMS = DefaultWebhookTimeoutMS
+	}
+	if cfg.TryTimes == 0 {
+		cfg.TryTimes = DefaultWebhookTryTimes
+	}
+}
+
+// 模板中可以使用 .Alerts 获取所有告警，.Alert 获取第一个告警
+type WebhookData struct {
+	Message
+	Alert *Alert
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join": strings.Join,
+}
+
+type Webhook struct {
+	*WebhookCfg
+	url     *template.Template
+	method  *template.Template
+	headers map[string]*template.Template
+	body    *template.Template
+	cli     *http.Client
+}
+
+func parseWebhookTemplate(name, text string) *template.Template {
+	t, err := template.New(name).Funcs(webhookFuncs).Parse(text)
+	if err != nil {
+		log.Panic("webhook: parse template", name, "err:", err)
+	}
+	return t
+}
+
+func NewWebhook(cfg WebhookCfg) *Webhook {
+	cfg.Check()
+
+	headers := make(map[string]*template.Template, len(cfg.Headers))
+	for k, v := range cfg.Headers {
+		headers[k] = parseWebhookTemplate(cfg.Name+".headers."+k, v)
+	}
+	return &Webhook{
+		WebhookCfg: &cfg,
+		url:        parseWebhookTemplate(cfg.Name+".url", cfg.Url),
+		method:     parseWebhookTemplate(cfg.Name+".method", cfg.Method),
+		headers:    headers,
+		body:       parseWebhookTemplate(cfg.Name+".body", cfg.Body),
+		cli:        &http.Client{Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond},
+	}
+}
+
+func (n *Webhook) Name() string {
+	return n.WebhookCfg.Name
+}
+
+func execWebhookTemplate(t *template.Template, data *WebhookData) (string, error) {
+	var buf bytes.Buffer
+	err := t.Execute(&buf, data)
+	return buf.String(), err
+}
+
+func (n *Webhook) Sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(n.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *Webhook) Notify(msg Message) (err error) {
+	xl := msg.xl
+	if len(msg.Alerts) == 0 {
+		return
+	}
+
+	r, err := n.Render(msg)
+	if err != nil {
+		xl.Errorf("Webhook %v render err: %v", n.Name(), err)
+		return
+	}
+
+	for i := 0; i < n.TryTimes; i++ {
+		err = n.send(xl, r.Method, r.Url, r.Headers, []byte(r.Body))
+		if err == nil {
+			return
+		}
+		xl.Warnf("Webhook %v send to %v failed %v times, err: %v", n.Name(), r.Url, i+1, err)
+	}
+	return
+}
+
+// 渲染后的请求
+type WebhookRequest struct {
+	Url     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+func (n *Webhook) Preview(msg Message) (interface{}, error) {
+	return n.Render(msg)
+}
+
+func (n *Webhook) Render(msg Message) (r *WebhookRequest, err error) {
+	data := &WebhookData{Message: msg, Alert: msg.Alerts[0]}
+	r = &WebhookRequest{Headers: make(map[string]string, len(n.headers))}
+	r.Url, err = execWebhookTemplate(n.url, data)
+	if err != nil {
+		return nil, fmt.Errorf("url: %v", err)
+	}
+	r.Method, err = execWebhookTemplate(n.method, data)
+	if err != nil {
+		return nil, fmt.Errorf("method: %v", err)
+	}
+	r.Method = strings.TrimSpace(r.Method)
+	if r.Method == "" {
+		r.Method = DefaultWebhookMethod
+	}
+	r.Body, err = execWebhookTemplate(n.body, data)
+	if err != nil {
+		return nil, fmt.Errorf("body: %v", err)
+	}
+	for k, t := range n.headers {
+		r.Headers[k], err = execWebhookTemplate(t, data)
+		if err != nil {
+			return nil, fmt.Errorf("header %v: %v", k, err)
+		}
+	}
+	return
+}
+
+func (n *Webhook) send(xl *xlog.Logger, method, url string, headers map[string]string, body []byte) (err error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Reqid", xl.ReqId())
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if n.Secret != "" {
+		req.Header.Set(n.SignatureHeader, n.Sign(body))
+	}
+
+	resp, err := n.cli.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook %v response %v: %s", n.Name(), resp.StatusCode, b)
+	}
+	return
+}
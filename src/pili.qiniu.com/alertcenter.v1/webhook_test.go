@@ -0,0 +1,74 @@
+package alertcenter
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhook(t *testing.T) {
+	ast := assert.New(t)
+
+	type request struct {
+		path, method, token, signature, body string
+	}
+	reqC := make(chan request, 2)
+	fails := 1
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fails > 0 {
+			fails--
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		reqC <- request{r.URL.Path, r.Method, r.Header.Get("X-Token"), r.Header.Get("X-Sign"), string(b)}
+	}))
+	defer ts.Close()
+
+	n := NewWebhook(WebhookCfg{
+		Name:            "hook",
+		Url:             ts.URL + "/alerts/{{.Alert.Alertname}}",
+		Method:          `{{if eq .Alert.Status "resolved"}}DELETE{{else}}PUT{{end}}`,
+		Headers:         map[string]string{"X-Token": "token-{{len .Alerts}}"},
+		Body:            `{"text": "{{range $i, $a := .Alerts}}{{if $i}}; {{end}}{{$a.Description}}|{{$a.Status}}{{end}}"}`,
+		Secret:          "secret",
+		SignatureHeader: "X-Sign",
+		TryTimes:        2,
+	})
+
+	a1 := &Alert{Alertname: "test", Description: "a1", Status: AlertFiring}
+	a2 := &Alert{Alertname: "test", Description: "a2", Status: AlertResolved}
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a1, a2)))
+
+	req := <-reqC
+	ast.Equal("/alerts/test", req.path)
+	ast.Equal("PUT", req.method)
+	ast.Equal("token-2", req.token)
+	ast.Equal(`{"text": "a1|firing; a2|resolved"}`, req.body)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(req.body))
+	ast.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), req.signature)
+
+	// method 也可以使用模板
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a2)))
+	req = <-reqC
+	ast.Equal("DELETE", req.method)
+	r, err := n.Render(NewMessage(xlog.NewDummy(), a2))
+	ast.NoError(err)
+	ast.Equal("DELETE", r.Method)
+
+	// 默认 body 为所有告警的 json
+	n = NewWebhook(WebhookCfg{Name: "default", Url: ts.URL})
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a1)))
+	req = <-reqC
+	ast.Equal("POST", req.method)
+	ast.Contains(req.body, `"alerts": [{`)
+	ast.Equal("", req.signature)
+}
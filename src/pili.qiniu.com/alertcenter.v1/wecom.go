@@ -0,0 +1,256 @@
+package alertcenter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/qiniu/log.v1"
+	"github.com/qiniu/xlog.v1"
+)
+
+const (
+	DefaultWeComUrl           = "https://qyapi.weixin.qq.com/cgi-bin/webhook/send"
+	DefaultWeComTimeLayout    = "2006-01-02 15:04:05"
+	DefaultWeComMaxDisplayCnt = 3
+	DefaultWeComTimeoutMS     = 10 * 1e3
+	DefaultWeComMentionText   = "请值班人员尽快处理"
+
+	// 一次通知包含 markdown 消息和 @ 值班人员的 text 消息，outbox 重试时只发送失败的那一条
+	WeComTargetMarkdown = "markdown"
+	WeComTargetMention  = "mention"
+)
+
+type WeComCfg struct {
+	Name string `json:"name"`
+	Url  string `json:"url"`
+	// 群机器人 webhook 地址中的 key
+	Key        string `json:"key"`
+	TimeLayout string `json:"time_layout"`
+	// 表示一条消息里最多可以装多少条告警
+	MaxDisplayCnt int `json:"max_display_count"`
+	// P0 告警时提醒当前值班人员，markdown 消息不支持 @ 手机号，会额外发送一条 text 消息
+	AtOncall    bool   `json:"at_oncall"`
+	MentionText string `json:"mention_text"`
+	TimeoutMS   int    `json:"timeout_ms"`
+	PortalUrl   string `json:"portal_url"`
+
+	// 每个告警的 title、body、footer 模板，title 前面加上级别，footer 不为空时追加在 body 后面
+	Template TemplateCfg `json:"template"`
+}
+
+// markdown 引用块，紧急告警在最后用 warning 颜色提示
+var DefaultWeComTemplate = TemplateCfg{
+	Title: `{{.Description}} | {{.Status}}`,
+	Body: `> [StartsAt] {{.StartsAt.Format .TimeLayout}}
+> ` + DefaultLeanAlertIdHeader + ` {{.Id.Hex}} ` + DefaultSlackAlertKeyHeader + ` {{.Key}}`,
+	Footer: `{{if .IsEmergent}}> <font color="warning">` + DefaultLeanChatEmergencyText + `</font>{{end}}`,
+}
+
+func (cfg *WeComCfg) Check() {
+	if cfg.Name == "" {
+		log.Panic("miss Name of weComCfg")
+	}
+	if cfg.Key == "" {
+		log.Panic("miss Key of weComCfg:", cfg.Name)
+	}
+	if cfg.Url == "" {
+		cfg.Url = DefaultWeComUrl
+	}
+	if cfg.TimeLayout == "" {
+		cfg.TimeLayout = DefaultWeComTimeLayout
+	}
+	if cfg.MaxDisplayCnt == 0 {
+		cfg.MaxDisplayCnt = DefaultWeComMaxDisplayCnt
+	}
+	if cfg.MentionText == "" {
+		cfg.MentionText = DefaultWeComMentionText
+	}
+	if cfg.TimeoutMS == 0 {
+		cfg.TimeoutMS = DefaultWeComTimeoutMS
+	}
+}
+
+type WeCom struct {
+	*WeComCfg
+	dutyMgr DutyManager
+	cli     *http.Client
+	tmpl    *Templates
+}
+
+func NewWeCom(cfg WeComCfg, dutyMgr DutyManager) *WeCom {
+	cfg.Check()
+	return &WeCom{
+		WeComCfg: &cfg,
+		dutyMgr:  dutyMgr,
+		cli:      &http.Client{Timeout: time.Duration(cfg.TimeoutMS) * time.Millisecond},
+		tmpl:     NewTemplates(cfg.Template, DefaultWeComTemplate),
+	}
+}
+
+// 企业微信 markdown 只支持 info(绿色)、comment(灰色)、warning(橙红色) 三种颜色
+func NewWeComColor(s Severity) string {
+	switch s {
+	case SeveritySuccess:
+		return "info"
+	case SeverityCritical, SeverityP0:
+		return "warning"
+	default:
+		return "comment"
+	}
+}
+
+type weComMarkdown struct {
+	Content string `json:"content"`
+}
+
+type weComText struct {
+	Content             string   `json:"content"`
+	MentionedMobileList []string `json:"mentioned_mobile_list,omitempty"`
+}
+
+type WeComReq struct {
+	MsgType  string         `json:"msgtype"`
+	Markdown *weComMarkdown `json:"markdown,omitempty"`
+	Text     *weComText     `json:"text,omitempty"`
+}
+
+type weComResp struct {
+	ErrCode int    `json:"errcode"`
+	ErrMsg  string `json:"errmsg"`
+}
+
+func (n *WeCom) Name() string {
+	return n.WeComCfg.Name
+}
+
+func (n *WeCom) Notify(msg Message) (err error) {
+	_, err = n.NotifyTargets(msg, nil)
+	return
+}
+
+// targets 为 WeComTargetMarkdown、WeComTargetMention，为空时都发送；markdown 发送失败时不单独 @ 值班人员
+func (n *WeCom) NotifyTargets(msg Message, targets []string) (failed []string, err error) {
+	xl := msg.xl
+	if len(msg.Alerts) == 0 {
+		return
+	}
+	markdown, mention := len(targets) == 0, len(targets) == 0
+	for _, t := range targets {
+		switch t {
+		case WeComTargetMarkdown:
+			markdown = true
+		case WeComTargetMention:
+			mention = true
+		}
+	}
+
+	if markdown {
+		err = n.SendMsg(xl, n.GetReq(msg))
+		if err != nil {
+			failed = append(failed, WeComTargetMarkdown)
+			if mention {
+				failed = append(failed, WeComTargetMention)
+			}
+			return
+		}
+	}
+
+	if !mention || !n.AtOncall {
+		return
+	}
+	mobiles := oncallMobiles(xl, n.dutyMgr, msg.Alerts)
+	if len(mobiles) != 0 {
+		err = n.SendMsg(xl, &WeComReq{
+			MsgType: "text",
+			Text:    &weComText{Content: n.MentionText, MentionedMobileList: mobiles},
+		})
+		if err != nil {
+			failed = append(failed, WeComTargetMention)
+		}
+	}
+	return
+}
+
+// 只返回 markdown 消息，不包含 @ 值班人员的文本消息
+func (n *WeCom) Preview(msg Message) (interface{}, error) {
+	return n.GetReq(msg), nil
+}
+
+func (n *WeCom) GetReq(msg Message) *WeComReq {
+	lines := make([]string, 0, len(msg.Alerts)+1)
+	for i, a := range msg.Alerts {
+		lines = append(lines, n.GetText(a))
+		if i == n.MaxDisplayCnt-1 {
+			break
+		}
+	}
+	if len(msg.Alerts) > n.MaxDisplayCnt {
+		lines = append(lines, n.GetMoreAlertsText(len(msg.Alerts)))
+	}
+	return &WeComReq{
+		MsgType:  "markdown",
+		Markdown: &weComMarkdown{Content: strings.Join(lines, "\n\n")},
+	}
+}
+
+func (n *WeCom) SendMsg(xl *xlog.Logger, req *WeComReq) (err error) {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	resp, err := n.cli.Post(n.GetUrl(), "application/json", bytes.NewReader(b))
+	if err != nil {
+		xl.Errorf("WeCom Notify(msg) error: %+v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var res weComResp
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	if err != nil {
+		xl.Errorf("WeCom decode resp, status: %v, err: %v", resp.StatusCode, err)
+		return
+	}
+	if res.ErrCode != 0 {
+		xl.Errorf("Req: %+v, Resp: %+v", req, res)
+		err = fmt.Errorf("%v %v", res.ErrCode, res.ErrMsg)
+	}
+	return
+}
+
+func (n *WeCom) GetUrl() string {
+	return n.Url + "?key=" + url.QueryEscape(n.Key)
+}
+
+func (n *WeCom) templateData(a *Alert) *TemplateData {
+	return &TemplateData{
+		Alert:      a,
+		PortalUrl:  n.PortalUrl,
+		TimeLayout: n.TimeLayout,
+	}
+}
+
+func (n *WeCom) GetText(a *Alert) string {
+	title := n.tmpl.Execute(TemplateTitle, n.templateData(a))
+	if a.GeneratorURL != "" {
+		title = fmt.Sprintf("[%v](%v)", title, a.GeneratorURL)
+	}
+	s := fmt.Sprintf("**<font color=\"%v\">[%v]</font>** %v\n", NewWeComColor(a.Severity), a.Severity, title)
+	s += n.tmpl.Execute(TemplateBody, n.templateData(a))
+	if footer := n.tmpl.Execute(TemplateFooter, n.templateData(a)); footer != "" {
+		s += "\n" + footer
+	}
+	return s
+}
+
+func (n *WeCom) GetMoreAlertsText(cnt int) string {
+	if n.PortalUrl == "" {
+		return fmt.Sprintf("共有 %v 个告警", cnt)
+	}
+	return fmt.Sprintf("共有 %v 个告警 [%v](%v)", cnt, DefaultSlackMoreAlertsText, n.PortalUrl)
+}
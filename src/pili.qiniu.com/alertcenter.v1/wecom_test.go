@@ -0,0 +1,73 @@
+package alertcenter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/qiniu/xlog.v1"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestWeCom(t *testing.T) {
+	ast := assert.New(t)
+
+	reqC := make(chan WeComReq, 2)
+	errcode := 0
+	failText := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ast.Equal("robot-key", r.URL.Query().Get("key"))
+		var req WeComReq
+		ast.NoError(json.NewDecoder(r.Body).Decode(&req))
+		reqC <- req
+		if errcode != 0 || (failText && req.MsgType == "text") {
+			w.Write([]byte(`{"errcode": 93000, "errmsg": "invalid webhook url"}`))
+			return
+		}
+		w.Write([]byte(`{"errcode": 0, "errmsg": "ok"}`))
+	}))
+	defer ts.Close()
+
+	n := NewWeCom(WeComCfg{
+		Name:     "wecom",
+		Url:      ts.URL,
+		Key:      "robot-key",
+		AtOncall: true,
+	}, &FakeDutyMgr{})
+
+	a := &Alert{Id: bson.NewObjectId(), Key: "key1", Description: "a1", Status: AlertFiring, Severity: SeverityP0, GeneratorURL: "http://prom"}
+	ast.NoError(n.Notify(NewMessage(xlog.NewDummy(), a)))
+
+	req := <-reqC
+	ast.Equal("markdown", req.MsgType)
+	ast.Contains(req.Markdown.Content, "[a1 | firing](http://prom)")
+	ast.Contains(req.Markdown.Content, `<font color="warning">[P0]</font>`)
+	ast.Contains(req.Markdown.Content, a.Id.Hex())
+	ast.Contains(req.Markdown.Content, "key1")
+
+	req = <-reqC
+	ast.Equal("text", req.MsgType)
+	ast.Equal([]string{"18650317419"}, req.Text.MentionedMobileList)
+
+	// 只有 @ 值班人员失败时只重试这一条
+	failText = true
+	failed, err := n.NotifyTargets(NewMessage(xlog.NewDummy(), a), nil)
+	ast.Error(err)
+	ast.Equal([]string{WeComTargetMention}, failed)
+	<-reqC
+	<-reqC
+	failText = false
+	failed, err = n.NotifyTargets(NewMessage(xlog.NewDummy(), a), failed)
+	ast.NoError(err)
+	ast.Nil(failed)
+	ast.Equal("text", (<-reqC).MsgType)
+	ast.Equal(0, len(reqC))
+
+	errcode = 93000
+	a.Severity = SeverityP1
+	err = n.Notify(NewMessage(xlog.NewDummy(), a))
+	ast.EqualError(err, "93000 invalid webhook url")
+	<-reqC
+}